@@ -0,0 +1,65 @@
+package reactivetools
+
+import (
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// сколько ждать файл bolt, заблокированный другим процессом
+	boltOpenTimeout = time.Second
+)
+
+// файлы bolt, открытые в процессе, по абсолютному пути.
+// bolt блокирует файл целиком, поэтому компоненты одного процесса, которым задан один и тот же файл
+// (агрегатор изменений, кэш результатов, outbox), используют общий дескриптор, каждый - в своем бакете.
+// файл, открытый другим процессом, использовать нельзя: открытие завершится ошибкой через boltOpenTimeout.
+var sharedBolts = struct {
+	m   sync.Mutex
+	dbs map[string]*sharedBolt
+}{dbs: make(map[string]*sharedBolt)}
+
+type sharedBolt struct {
+	*bolt.DB
+	path string
+	refs int
+}
+
+// открывает файл bolt или берет уже открытый в процессе. каждый вызов должен завершаться Close.
+func openSharedBolt(path string) (*sharedBolt, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("cant get bolt storage path %v: %v", path, err)
+	}
+	sharedBolts.m.Lock()
+	defer sharedBolts.m.Unlock()
+	if db, ok := sharedBolts.dbs[abs]; ok {
+		db.refs++
+		return db, nil
+	}
+	db, err := bolt.Open(abs, 0666, &bolt.Options{Timeout: boltOpenTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("cant open bolt storage %v: %v", abs, err)
+	}
+	sdb := &sharedBolt{DB: db, path: abs, refs: 1}
+	sharedBolts.dbs[abs] = sdb
+	return sdb, nil
+}
+
+// закрывает файл, когда его закрыли все, кто открывал
+func (b *sharedBolt) Close() error {
+	sharedBolts.m.Lock()
+	defer sharedBolts.m.Unlock()
+	if b.refs == 0 {
+		return nil
+	}
+	b.refs--
+	if b.refs > 0 {
+		return nil
+	}
+	delete(sharedBolts.dbs, b.path)
+	return b.DB.Close()
+}
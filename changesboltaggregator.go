@@ -1,7 +1,9 @@
 package reactivetools
 
 import (
+	"context"
 	"fmt"
+	"github.com/iddqdeika/reactivetools/statistic"
 	"github.com/iddqdeika/rrr/helpful"
 	bolt "go.etcd.io/bbolt"
 	"sync"
@@ -23,7 +25,8 @@ func NewBoltChangesAggregator(cfg helpful.Config, l helpful.Logger) (ChangesAggr
 	if err != nil {
 		return nil, err
 	}
-	db, err := bolt.Open(storagePath, 0666, nil)
+	// файл может быть общим с другими компонентами процесса (например, кэшем результатов)
+	db, err := openSharedBolt(storagePath)
 	if err != nil {
 		return nil, err
 	}
@@ -32,6 +35,7 @@ func NewBoltChangesAggregator(cfg helpful.Config, l helpful.Logger) (ChangesAggr
 		return err
 	})
 	if err != nil {
+		_ = db.Close()
 		return nil, err
 	}
 
@@ -41,7 +45,7 @@ func NewBoltChangesAggregator(cfg helpful.Config, l helpful.Logger) (ChangesAggr
 }
 
 type boltChangesAggregator struct {
-	db *bolt.DB
+	db *sharedBolt
 	m  sync.RWMutex
 }
 
@@ -85,6 +89,22 @@ func (b *boltChangesAggregator) Process(event ChangeEvent) error {
 	return b.Set(event.ObjectIdentifier(), event.Data())
 }
 
+// доступность хранилища: база открыта и бакет на месте
+func (b *boltChangesAggregator) HealthChecks() []statistic.HealthCheck {
+	return []statistic.HealthCheck{{Name: "bolt", Kind: statistic.Readiness, Check: b.check}}
+}
+
+func (b *boltChangesAggregator) check(ctx context.Context) error {
+	return callCtx(ctx, func() error {
+		return b.db.View(func(tx *bolt.Tx) error {
+			if tx.Bucket(bucketName) == nil {
+				return fmt.Errorf("bucket " + string(bucketName) + " does not exist")
+			}
+			return nil
+		})
+	})
+}
+
 func (b *boltChangesAggregator) Close() error {
 	return b.db.Close()
 }
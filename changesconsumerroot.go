@@ -0,0 +1,172 @@
+package reactivetools
+
+import (
+	"context"
+	"fmt"
+	"github.com/iddqdeika/rrr"
+	"github.com/iddqdeika/rrr/helpful"
+	"io"
+)
+
+const (
+	// раздел конфига с обработчиком изменений:
+	// "changes_processor": {"type": "sql_simple", "converter": "int", "conn_string": "...", ...}
+	// остальные ключи раздела читаются конструктором выбранного обработчика.
+	ChangesProcessorConfigKey = "changes_processor"
+
+	changesProcessorTypeConfigName      = "type"
+	changesProcessorConverterConfigName = "converter"
+)
+
+// тип обработчика изменений в конфиге
+type ChangesProcessorType string
+
+var ChangesProcessorTypes = struct {
+	// запись в таблицу sql (NewSimpleSqlChangesSaver)
+	SqlSimple ChangesProcessorType
+	// запись в sql пользовательским обработчиком (NewCustomSqlChangesSaver)
+	SqlCustom ChangesProcessorType
+	// аггрегация в bolt (NewBoltChangesAggregator)
+	Bolt ChangesProcessorType
+	// вывод изменений в stdout (NewStubChangesSaver)
+	Stub ChangesProcessorType
+}{
+	SqlSimple: "sql_simple",
+	SqlCustom: "sql_custom",
+	Bolt:      "bolt",
+	Stub:      "stub",
+}
+
+// конвертеры значений для sql_simple по названию в конфиге
+var changeValueConvertersByName = map[string]ChangeValueConverter{
+	"default": ChangeValueConverters.Default,
+	"int":     ChangeValueConverters.Int,
+}
+
+// компоненты корня обработки изменений, которые нельзя задать конфигом.
+type ChangesConsumerRootOptions struct {
+	// перехватчики изменений, передаются провайдеру
+	Interceptors []ChangesInterceptor
+	// конвертер значения для sql_simple. если не задан - берется из конфига (converter: default, int)
+	Converter ChangeValueConverter
+	// фабрика обработчика для sql_custom
+	SqlProcessorFabric SqlSaverProcessorFabric
+}
+
+// собирает корень композиции сервиса обработки изменений из кафка.
+// обработчик изменений выбирается конфигом (раздел changes_processor), провайдер, публикатор "мертвых" изменений
+// и статистики собираются как в NewKafkaChangesConsumerService.
+// корень потом достаточно выполнить через rrr паттерн, чтобы получить готовое приложение.
+func NewKafkaChangesConsumerRoot(opts ChangesConsumerRootOptions) (rrr.Root, error) {
+	for _, i := range opts.Interceptors {
+		if i == nil {
+			return nil, fmt.Errorf("must be not-nil ChangesInterceptor")
+		}
+	}
+	return &kafkaChangesConsumerRoot{
+		opts: opts,
+	}, nil
+}
+
+type kafkaChangesConsumerRoot struct {
+	opts ChangesConsumerRootOptions
+
+	l    helpful.Logger
+	proc ChangesProcessor
+	s    Service
+}
+
+// регистрация компонент.
+// выбираем реализации и инстанциируем здесь.
+func (r *kafkaChangesConsumerRoot) Register() []error {
+
+	// конфиг
+	cfg, err := LoadConfigFromEnvironment()
+	// если ошибка конфига, то дальше нет смысла идти
+	if err != nil {
+		return []error{err}
+	}
+	// логгер
+	r.l = loggerFromConfig(cfg)
+	r.l.Infof("logger initialized")
+	defer r.l.Infof("register finished")
+
+	// обработчик изменений
+	r.proc, err = changesProcessorFromConfig(cfg, componentLogger(r.l, LogComponentProcessor), r.opts)
+	if err != nil {
+		return []error{err}
+	}
+
+	// конструктор сервиса
+	r.s, err = NewKafkaChangesConsumerService(cfg, r.l, r.proc, r.opts.Interceptors...)
+	if err != nil {
+		// сервис не собран - обработчик больше не нужен
+		errs := []error{err}
+		if err := r.Release(); err != nil {
+			errs = append(errs, err)
+		}
+		r.proc = nil
+		return errs
+	}
+	return nil
+}
+
+// исполнение логики приложения с помощью компонент, определенных на этапе Register
+func (r *kafkaChangesConsumerRoot) Resolve(ctx context.Context) error {
+	r.l.Infof("root resolve started")
+	defer r.l.Infof("root resolve finished")
+
+	//исполняем
+	return r.s.Run(ctx)
+}
+
+// высвобождаем ресурсы: ресурсы сервиса (группу потребителей) и базу или хранилище обработчика
+func (r *kafkaChangesConsumerRoot) Release() error {
+	var errs []error
+	if c, ok := r.s.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("cant close changes consumer service: %v", err))
+		}
+	}
+	if c, ok := r.proc.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("cant close changes processor: %v", err))
+		}
+	}
+	return composeErrors(errs)
+}
+
+// инстанциирует обработчик изменений по типу из конфига
+func changesProcessorFromConfig(cfg helpful.Config, l helpful.Logger, opts ChangesConsumerRootOptions) (ChangesProcessor, error) {
+	if !cfg.Contains(ChangesProcessorConfigKey) {
+		return nil, fmt.Errorf("config must contain %v", ChangesProcessorConfigKey)
+	}
+	pc := cfg.Child(ChangesProcessorConfigKey)
+	pt, err := pc.GetString(changesProcessorTypeConfigName)
+	if err != nil {
+		return nil, err
+	}
+	switch ChangesProcessorType(pt) {
+	case ChangesProcessorTypes.SqlSimple:
+		c := opts.Converter
+		if c == nil && pc.Contains(changesProcessorConverterConfigName) {
+			name, err := pc.GetString(changesProcessorConverterConfigName)
+			if err != nil {
+				return nil, err
+			}
+			var ok bool
+			c, ok = changeValueConvertersByName[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown change value converter %v", name)
+			}
+		}
+		return NewSimpleSqlChangesSaver(pc, l, c)
+	case ChangesProcessorTypes.SqlCustom:
+		return NewCustomSqlChangesSaver(pc, l, opts.SqlProcessorFabric)
+	case ChangesProcessorTypes.Bolt:
+		return NewBoltChangesAggregator(pc, l)
+	case ChangesProcessorTypes.Stub:
+		return NewStubChangesSaver(), nil
+	}
+	return nil, fmt.Errorf("unknown changes processor type %v", pt)
+}
@@ -0,0 +1,72 @@
+package reactivetools
+
+import (
+	"encoding/json"
+	"github.com/iddqdeika/rrr/helpful"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func processorConfig(t *testing.T, dir string, section map[string]interface{}) helpful.Config {
+	data, err := json.Marshal(map[string]interface{}{ChangesProcessorConfigKey: section})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.json")
+	err = ioutil.WriteFile(path, data, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := helpful.NewJsonCfg(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestChangesProcessorFromConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "changes_processor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l := helpful.DefaultLogger.WithLevel(helpful.LogNone)
+
+	p, err := changesProcessorFromConfig(processorConfig(t, dir, map[string]interface{}{"type": "stub"}), l, ChangesConsumerRootOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.(stubSaver); !ok {
+		t.Errorf("expected stub saver, got %T", p)
+	}
+
+	p, err = changesProcessorFromConfig(processorConfig(t, dir, map[string]interface{}{
+		"type":              "bolt",
+		"bolt_storage_path": filepath.Join(dir, "changes.db"),
+	}), l, ChangesConsumerRootOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, ok := p.(io.Closer)
+	if !ok {
+		t.Fatalf("bolt aggregator must be closable")
+	}
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, section := range []map[string]interface{}{
+		{"type": "unknown"},
+		{"type": "sql_custom", "conn_string": "sqlserver://localhost"},
+		{"type": "sql_simple", "converter": "float"},
+	} {
+		_, err = changesProcessorFromConfig(processorConfig(t, dir, section), l, ChangesConsumerRootOptions{})
+		if err == nil {
+			t.Errorf("expected error for %v", section)
+		}
+	}
+}
@@ -3,11 +3,92 @@ package reactivetools
 import (
 	"context"
 	"fmt"
+	"github.com/iddqdeika/reactivetools/statistic"
+	"github.com/iddqdeika/rrr"
 	"github.com/iddqdeika/rrr/helpful"
+	"io"
+	"sync"
 	"time"
 )
 
+const (
+	ChangesProviderConfigKey = "changes_provider"
+)
+
+// обязательные ключи конфига NewKafkaChangesConsumerService
+var kafkaChangesConsumerServiceRequiredKeys = []string{
+	"parallelism",
+	configKey(ChangesProviderConfigKey, "changes_topic_name"),
+	configKey(ChangesProviderConfigKey, "target_event_name"),
+	configKey(ChangesProviderConfigKey, "target_object_type"),
+	configKey(ChangesProviderConfigKey, kafkaConfigKey),
+	configKey(StatisticServiceConfigKey, "port"),
+}
+
+// инстанциирует сервис обработки изменений, инициализируя провайдер изменений из конфига (раздел changes_provider).
+// если заданы - собирает и публикатор "мертвых" изменений (dead_letter_publisher), и отправщик статистик (statistic_sender).
+// статистики и проверки здоровья провайдера, сервиса и обработчика отдаются сервисом статистики (раздел statistics).
+func NewKafkaChangesConsumerService(cfg helpful.Config, l helpful.Logger, s ChangesProcessor,
+	interceptors ...ChangesInterceptor) (Service, error) {
+
+	if cfg == nil {
+		return nil, fmt.Errorf("must be not-nil Config")
+	}
+	if l == nil {
+		return nil, fmt.Errorf("must be not-nil Logger")
+	}
+	if s == nil {
+		return nil, fmt.Errorf("must be not-nil ChangesProcessor")
+	}
+	err := RequireConfigKeys(cfg, kafkaChangesConsumerServiceRequiredKeys...)
+	if err != nil {
+		return nil, err
+	}
+
+	// соберем провайдера
+	p, err := NewChangesProvider(cfg.Child(ChangesProviderConfigKey), componentLogger(l, LogComponentProvider), interceptors...)
+	if err != nil {
+		return nil, err
+	}
+
+	// если задан - соберем публикатор "мертвых" изменений
+	dl, err := deadLetterPublisherFromConfig(cfg, componentLogger(l, LogComponentDeadLetter))
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := newConsumer(cfg, componentLogger(l, LogComponentService), p, s, dl)
+	if err != nil {
+		return nil, err
+	}
+	if pc, ok := p.(io.Closer); ok {
+		c.closers = append(c.closers, pc)
+	}
+	c.services, err = newStatisticServices(cfg, l, c, c)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
 func NewChangesConsumerService(cfg helpful.Config, l helpful.Logger, p ChangesProvider, s ChangesProcessor) (Service, error) {
+	return NewChangesConsumerServiceWithDeadLetter(cfg, l, p, s, nil)
+}
+
+// инстанциирует сервис обработки изменений с публикатором "мертвых" изменений.
+// изменение, которое не удалось обработать за отведенные политикой повторов (retry_policy) попытки,
+// публикуется в dl и подтверждается. если политика ограничивает попытки, то dl обязателен.
+func NewChangesConsumerServiceWithDeadLetter(cfg helpful.Config, l helpful.Logger,
+	p ChangesProvider, s ChangesProcessor, dl DeadLetterPublisher) (Service, error) {
+	c, err := newConsumer(cfg, l, p, s, dl)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func newConsumer(cfg helpful.Config, l helpful.Logger,
+	p ChangesProvider, s ChangesProcessor, dl DeadLetterPublisher) (*consumer, error) {
 
 	if cfg == nil {
 		return nil, fmt.Errorf("must be not-nil config")
@@ -26,15 +107,37 @@ func NewChangesConsumerService(cfg helpful.Config, l helpful.Logger, p ChangesPr
 	if err != nil {
 		return nil, err
 	}
+	retry, err := retryPolicyFromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	err = requireDeadLetterPublisher(retry, dl)
+	if err != nil {
+		return nil, err
+	}
+	drainTimeout, err := drainTimeoutFromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	noProgress, err := noProgressTimeoutFromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
 
 	c := &consumer{
-		l:             l,
-		prov:          p,
-		proc:          s,
-		balancer:      make(chan struct{}, parallelism),
-		processing:    make(chan ChangeEvent, parallelism),
-		acknowledging: make(chan ChangeEvent, parallelism),
+		l:            l,
+		prov:         p,
+		proc:         s,
+		retry:        retry,
+		deadLetters:  dl,
+		drainTimeout: drainTimeout,
+		commits:      providerCommitManager(p, l),
+		balancer:     make(chan struct{}, parallelism),
+		stats:        newChangesStatistics(),
 	}
+	c.progress = newProgressTracker("changes", noProgress, func() bool {
+		return len(c.commits.pending()) > 0
+	})
 
 	return c, nil
 }
@@ -44,96 +147,157 @@ type consumer struct {
 	prov ChangesProvider
 	proc ChangesProcessor
 
-	balancer      chan struct{}
-	processing    chan ChangeEvent
-	acknowledging chan ChangeEvent
+	retry       RetryPolicy
+	deadLetters DeadLetterPublisher
+
+	// таймаут плавной остановки, 0 - остановка без ожидания
+	drainTimeout time.Duration
+	inFlight     sync.WaitGroup
+
+	commits  *commitManager
+	balancer chan struct{}
+
+	progress *progressTracker
+	stats    *changesStatistics
+
+	// ресурсы компонент (группа потребителей провайдера), закрываются после остановки сервиса
+	closers []io.Closer
+
+	services []rrr.Service
+}
+
+// закрывает ресурсы компонент. вызывается после остановки сервиса (Release рута).
+func (c *consumer) Close() error {
+	return closeAll(c.closers)
+}
+
+// статистики провайдера (если он их предоставляет), самого сервиса, подтверждений и обработчика (если он их предоставляет)
+func (c *consumer) Statistics() ([]statistic.Statistic, error) {
+	ps := statistic.NewCompositeProvider()
+	if sp, ok := c.prov.(statistic.StatisticProvider); ok {
+		ps.AddNamed(LogComponentProvider, sp)
+	}
+	ps.AddNamed(LogComponentService, c.stats).AddNamed(statisticComponentCommits, c.commits)
+	if sp, ok := c.proc.(statistic.StatisticProvider); ok {
+		ps.AddNamed(LogComponentProcessor, sp)
+	}
+	return ps.Statistics()
+}
+
+// проверки здоровья провайдера, обработчика (например, доступность базы) и отсутствия прогресса
+func (c *consumer) HealthChecks() []statistic.HealthCheck {
+	return componentHealthChecks(c.prov, c.proc, c.deadLetters, c.progress)
 }
 
 func (c *consumer) Run(ctx context.Context) error {
-	go c.handleProcessing(ctx)
-	go c.handleAcknowledging(ctx)
+	services := []rrr.Service{&serviceSurrogate{callback: c.run}}
+	// провайдер, умеющий работать с контекстом, запускаем вместе с сервисом
+	if s, ok := c.prov.(rrr.Service); ok {
+		services = append(services, s)
+	}
+	services = append(services, c.services...)
+	if len(services) == 1 {
+		return c.run(ctx)
+	}
+	errs := rrr.RunServices(ctx, services...)
+	return rrr.ComposeErrors("ChangesConsumerService", errs...)
+}
+
+func (c *consumer) run(ctx context.Context) error {
+	pctx, cancel := pipelineContext(ctx, c.drainTimeout)
+	defer cancel()
 	c.l.Infof("service started")
+	c.receive(ctx, pctx)
+	c.drain()
+	return nil
+}
+
+// получает изменения до закрытия ctx или канала провайдера. pctx - контекст обработки.
+func (c *consumer) receive(ctx, pctx context.Context) {
 	for {
 		select {
 		case <-ctx.Done():
-			return nil
+			return
 		case e, opened := <-c.prov.ChangesChan():
 			if !opened {
 				c.l.Infof("provider's order chan was closed, finishing")
-				return nil
+				return
 			}
-			c.l.Infof("got event %v for %v(%v)", e.EventName(), e.ObjectType(), e.ObjectIdentifier())
-			c.dispatch(ctx, e)
+			logDebugf(withLogFields(c.l, eventLogFields(e)), "got event %v for %v(%v)", e.EventName(), e.ObjectType(), e.ObjectIdentifier())
+			c.stats.received.Inc()
+			c.commits.track(e)
+			c.dispatch(ctx, pctx, e)
 		}
 	}
 }
 
-func (c *consumer) handleProcessing(ctx context.Context) {
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case e := <-c.processing:
-			<-e.Processed()
-			c.acknowledging <- e
-		}
+// плавная остановка: ждем завершения начатых изменений, не дольше таймаута, остальные - отклоняем.
+func (c *consumer) drain() {
+	if c.drainTimeout <= 0 {
+		return
 	}
-}
-
-func (c *consumer) handleAcknowledging(ctx context.Context) {
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case e := <-c.acknowledging:
-			e = lastOrDefaultChange(e, c.acknowledging)
-			for {
-				err := e.Ack() //удалить когда adapter сможет в паралеллизм
-				if err != nil {
-					c.l.Errorf("cant ack published order, waiting 100ms, err: %v", err)
-					time.Sleep(time.Millisecond * 100)
-				} else {
-					c.l.Infof("event %v for %v(%v) acked", e.EventName(), e.ObjectType(), e.ObjectIdentifier())
-					break
-				}
-			}
-		}
+	c.l.Infof("draining in-flight events, timeout: %v", c.drainTimeout)
+	if waitTimeout(&c.inFlight, c.drainTimeout) {
+		c.l.Infof("all in-flight events finished")
+	} else {
+		c.l.Errorf("drain timeout exceeded, unfinished events will be nacked")
 	}
+	c.commits.nackPending()
 }
 
-func (c *consumer) dispatch(ctx context.Context, e ChangeEvent) {
+// обработанные изменения подтверждает менеджер подтверждений - строго по порядку получения.
+// ctx - контекст получения изменений (ожидание свободного слота), pctx - контекст обработки.
+func (c *consumer) dispatch(ctx, pctx context.Context, e ChangeEvent) {
 	select {
 	case c.balancer <- struct{}{}:
-		c.processing <- e
+		c.inFlight.Add(1)
+		c.stats.inFlight.Add(1)
 		go func() {
-			c.l.Infof("event %v for %v(%v) dispatched", e.EventName(), e.ObjectType(), e.ObjectIdentifier())
-			c.process(e)
-			close(e.Processed())
+			defer c.inFlight.Done()
+			logDebugf(withLogFields(c.l, eventLogFields(e)), "event %v for %v(%v) dispatched", e.EventName(), e.ObjectType(), e.ObjectIdentifier())
+			started := time.Now()
+			ok := c.process(pctx, e)
+			c.stats.latency.ObserveSince(started)
+			c.stats.inFlight.Add(-1)
 			<-c.balancer
+			if !ok {
+				// контекст закрыт, изменение не обработано и не должно быть подтверждено
+				return
+			}
+			close(e.Processed())
+			c.commits.complete(pctx, e)
+			c.progress.touch()
 		}()
 	case <-ctx.Done():
 		return
 	}
 }
 
-func (c *consumer) process(e ChangeEvent) {
-	for {
+// обрабатывает изменение согласно политике повторов.
+// возвращает false, если обработка прервана закрытием контекста.
+func (c *consumer) process(ctx context.Context, e ChangeEvent) bool {
+	fields := eventLogFields(e)
+	attempts, err := c.retry.Do(ctx, func(attempt int) error {
+		if attempt > 1 {
+			c.stats.retries.Inc()
+		}
 		err := c.proc.Process(e)
-		if err == nil {
-			return
+		if err != nil {
+			c.stats.failed.Inc()
+			fields[LogFieldAttempt] = attempt
+			logWarnf(withLogFields(c.l, fields), "err during change event processing (attempt %v): %v", attempt, err)
 		}
-		c.l.Errorf("err during change event processing: %v", err)
-		time.Sleep(processRetryInterval)
+		return err
+	})
+	if err == nil {
+		c.stats.processed.Inc()
+		return true
 	}
-}
-
-func lastOrDefaultChange(o ChangeEvent, ch chan ChangeEvent) ChangeEvent {
-	for {
-		select {
-		case o = <-ch:
-			continue
-		default:
-			return o
-		}
+	if ctx.Err() != nil {
+		return false
 	}
+	// попытки кончились: отправляем изменение в dead letter, после чего оно будет подтверждено
+	fields[LogFieldAttempt] = attempts
+	withLogFields(c.l, fields).Errorf("event %v for %v(%v) failed after %v attempts: %v", e.EventName(), e.ObjectType(), e.ObjectIdentifier(), attempts, err)
+	return publishDeadLetter(ctx, c.l, c.deadLetters, c.retry, newChangeDeadLetter(e, attempts, err))
 }
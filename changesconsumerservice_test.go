@@ -1 +1,92 @@
 package reactivetools
+
+import (
+	"context"
+	"github.com/iddqdeika/rrr/helpful"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestChangesConsumerGracefulDrain(t *testing.T) {
+	logger := helpful.DefaultLogger.WithLevel(helpful.LogNone)
+
+	cfg, err := helpful.NewJsonCfg("config/changes_consumer_cfg_test.json")
+	if err != nil {
+		t.Fatalf("cant create config for test: %v", err)
+	}
+
+	provider, err := NewChangesProviderStub(4, 0)
+	if err != nil {
+		t.Fatalf("cant create stub changes provider: %v", err)
+	}
+	saver := &slowChangesSaver{delay: time.Millisecond * 300}
+
+	cs, err := NewChangesConsumerService(cfg, logger, provider, saver)
+	if err != nil {
+		t.Fatalf("cant create changes consumer: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- cs.Run(ctx)
+	}()
+	// даем изменениям начать обработку и останавливаем сервис
+	time.Sleep(time.Millisecond * 100)
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("consumer Run() method returned err: %v", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("consumer did not finish in time")
+	}
+	if processed := atomic.LoadInt64(&saver.processed); processed != 4 {
+		t.Fatalf("all in-flight events must be processed before Run() returns, processed: %v", processed)
+	}
+
+	stats := cs.(*consumer).stats
+	if stats.received.Get() != 4 || stats.processed.Get() != 4 || stats.inFlight.Get() != 0 || stats.latency.Count() != 4 {
+		t.Fatalf("incorrect consumer statistics: received %v, processed %v, in flight %v",
+			stats.received.Get(), stats.processed.Get(), stats.inFlight.Get())
+	}
+}
+
+type slowChangesSaver struct {
+	delay     time.Duration
+	processed int64
+}
+
+func (s *slowChangesSaver) Process(event ChangeEvent) error {
+	time.Sleep(s.delay)
+	atomic.AddInt64(&s.processed, 1)
+	return nil
+}
+
+// провайдер без статистик (реализации вне пакета не обязаны их предоставлять)
+type plainChangesProvider struct {
+	ch chan ChangeEvent
+}
+
+func (p *plainChangesProvider) ChangesChan() chan ChangeEvent {
+	return p.ch
+}
+
+func TestChangesConsumerWithoutProviderStatistics(t *testing.T) {
+	logger := helpful.DefaultLogger.WithLevel(helpful.LogNone)
+	cfg, err := helpful.NewJsonCfg("config/changes_consumer_cfg_test.json")
+	if err != nil {
+		t.Fatalf("cant create config for test: %v", err)
+	}
+	cs, err := NewChangesConsumerService(cfg, logger, &plainChangesProvider{ch: make(chan ChangeEvent)}, &slowChangesSaver{})
+	if err != nil {
+		t.Fatalf("cant create changes consumer: %v", err)
+	}
+	ss, err := cs.(*consumer).Statistics()
+	if err != nil || len(ss) == 0 {
+		t.Fatalf("consumer must give own statistics without provider ones, got %v (err: %v)", ss, err)
+	}
+}
@@ -1,11 +1,12 @@
 package reactivetools
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	adapter "github.com/iddqdeika/kafka-adapter"
+	"github.com/iddqdeika/reactivetools/statistic"
 	"github.com/iddqdeika/rrr/helpful"
-	"time"
 )
 
 const (
@@ -34,6 +35,10 @@ func NewChangesProvider(config helpful.Config, logger helpful.Logger,
 	if err != nil {
 		return nil, err
 	}
+	kafka, err := kafkaSettingsFromConfig(config, true)
+	if err != nil {
+		return nil, err
+	}
 	q, err := adapter.FromConfig(config, logger)
 	if err != nil {
 		return nil, err
@@ -43,12 +48,21 @@ func NewChangesProvider(config helpful.Config, logger helpful.Logger,
 	if err != nil {
 		return nil, err
 	}
-	q.ReaderRegister(orderTopic)
+	malformed, err := newMalformedHandler(config, q, logger, deadLetterSourceChangeEvent)
+	if err != nil {
+		return nil, err
+	}
 
+	subject := fmt.Sprintf("event \"%v\" (object type: %v)", ten, tot)
 	p := &changesProvider{
+		malformed:        malformed,
+		lag:              &consumerLag{kafka: kafka, topic: orderTopic, subject: subject},
+		consumption:      newConsumptionTracker(),
+		commits:          newCommitManager(logger),
+		stats:            newChangesProviderStatistics(),
 		targetEventName:  ten,
 		targetObjectType: tot,
-		q:                q,
+		consumer:         newKafkaConsumer(kafka, orderTopic, logger),
 		l:                logger,
 		orderTopicName:   orderTopic,
 		ch:               make(chan ChangeEvent, channelBuffer),
@@ -59,90 +73,198 @@ func NewChangesProvider(config helpful.Config, logger helpful.Logger,
 		}
 		p.interceptors = append(p.interceptors, interceptor)
 	}
-	go p.run()
 	return p, nil
 }
 
+// провайдер изменений из кафка.
+// чтение идет только пока запущен Run (провайдер - rrr.Service), сервис обработки изменений запускает его сам.
+
 type changesProvider struct {
 	targetObjectType string
 	targetEventName  string
+	malformed        *malformedHandler
+	lag              *consumerLag
+	consumption      *consumptionTracker
+	stats            *changesProviderStatistics
+	// все прочитанные сообщения регистрируются здесь в порядке чтения (см. committingProvider)
+	commits  *commitManager
+	consumer *kafkaConsumer
 
-	q              *adapter.Queue
 	l              helpful.Logger
 	orderTopicName string
 	ch             chan ChangeEvent
 	interceptors   []ChangesInterceptor
 }
 
-func (p *changesProvider) run() {
+// читает изменения до закрытия контекста.
+// по завершении закрывает канал изменений, так что запускать можно только один раз.
+// группа потребителей закрывается не здесь, а в Close (см. kafkaConsumer).
+func (p *changesProvider) Run(ctx context.Context) error {
+	defer close(p.ch)
+	p.l.Infof("changes provider for topic %v started", p.orderTopicName)
+	defer p.l.Infof("changes provider for topic %v finished", p.orderTopicName)
 	for {
-		p.iteration()
+		ok, err := p.iteration(ctx)
+		if err != nil {
+			p.l.Errorf("changes provider for topic %v stopped: %v", p.orderTopicName, err)
+			return err
+		}
+		if !ok {
+			return nil
+		}
 	}
 }
 
-func (p *changesProvider) iteration() {
+// возвращает false, если контекст закрыт и чтение пора заканчивать.
+// ошибка означает, что провайдер должен остановиться (например, политика некорректных сообщений stop).
+func (p *changesProvider) iteration(ctx context.Context) (bool, error) {
 	// берем месседж
-	msg, err := p.q.Get(p.orderTopicName)
+	msg, err := p.consumer.get(ctx)
 	if err != nil {
+		if ctx.Err() != nil {
+			return false, nil
+		}
 		p.l.Errorf("cant get msg from topic %v, err: %v", p.orderTopicName, err)
-		time.Sleep(intervalWhenCantGetMsg)
-		return
+		return sleepCtx(ctx, intervalWhenCantGetMsg), nil
 	}
+	p.stats.received.Inc()
 	cem := &ChangeEventMessage{}
 	err = json.Unmarshal(msg.Data(), cem)
 	if err != nil {
-		p.l.Errorf("cant parse msg from topic %v, skipping, err: %v", p.orderTopicName, err)
-		return
+		p.stats.malformed.Inc()
+		handled, err := p.malformed.handle(ctx, p.orderTopicName, msg, err)
+		if handled {
+			p.commits.skip(ctx, msg)
+		}
+		return ctx.Err() == nil, err
 	}
 
 	// проверяем, что тип объекта и ивент нужные
 	if !(cem.ObjectType == p.targetObjectType && cem.EventName == p.targetEventName) {
-		err := msg.Ack()
-		if err != nil {
-			p.l.Errorf("cant ack skipped msg, err: %v", err)
-		}
-		return
+		p.stats.filtered.Inc()
+		p.commits.skip(ctx, msg)
+		return true, nil
 	}
 	var event ChangeEvent
-	event = &changeEvent{
-		en:        cem.EventName,
-		qm:        msg,
-		change:    *cem,
-		processed: make(chan struct{}),
+	md := newMessageMetadata(msg.msg, cem.Metadata)
+	ce := &changeEvent{
+		en:            cem.EventName,
+		qm:            msg,
+		change:        *cem,
+		md:            md,
+		correlationID: correlationID(md, ""),
+		trace:         traceContextFromMetadata(md),
+		processed:     make(chan struct{}),
+		onAck:         p.consumption.received(md),
 	}
+	event = ce
 	for _, interceptor := range p.interceptors {
 		ev, err := interceptor.Intercept(event)
 		if err != nil {
+			p.stats.rejected.Inc()
 			p.l.Infof("interceptor rejected event %v for entity(%v): %v with message: %v",
 				event.EventName(), event.ObjectType(), event.ObjectIdentifier(), err)
-			err := msg.Ack()
-			if err != nil {
-				p.l.Errorf("cant ack skipped msg, err: %v", err)
-			}
-			return
+			p.commits.skip(ctx, ce)
+			return true, nil
 		}
 		event = ev
 	}
+	// регистрируем до отправки в канал, чтобы следующие пропущенные сообщения не подтвердились раньше изменения.
+	// перехватчик может подменить изменение, тогда регистрируется то, что получит сервис.
+	p.commits.track(event)
 
-	p.ch <- event
+	select {
+	case p.ch <- event:
+		return true, nil
+	case <-ctx.Done():
+		// изменение не подтверждено и будет получено заново
+		return false, nil
+	}
 }
 
 func (p *changesProvider) ChangesChan() chan ChangeEvent {
 	return p.ch
 }
 
+func (p *changesProvider) commitManager() *commitManager {
+	return p.commits
+}
+
+// закрывает группу потребителей. вызывается после остановки сервиса, чтобы успели подтвердиться
+// изменения, завершенные при плавной остановке.
+func (p *changesProvider) Close() error {
+	return p.consumer.Close()
+}
+
+// статистики потребления топика изменений: лаг (по партициям и общий), возраст самого старого
+// необработанного изменения, скорость потребления и кол-во полученных, отфильтрованных и отклоненных изменений.
+// перехватчики, предоставляющие статистики, тоже их отдают.
+// недоступность лага (например, кафка) не скрывает остальные статистики: вместо лага отдается статистика-ошибка.
+func (p *changesProvider) Statistics() ([]statistic.Statistic, error) {
+	ss, err := statistic.NewCompositeProvider().AddNamed(statisticComponentConsumerLag, p.lag).Statistics()
+	if err != nil {
+		return nil, err
+	}
+	ss = append(ss, p.consumption.statistics(p.lag.subject, "change")...)
+	ps := statistic.NewCompositeProvider(p.stats)
+	for n, i := range p.interceptors {
+		if sp, ok := i.(statistic.StatisticProvider); ok {
+			ps.AddNamed(fmt.Sprintf("%v_%v", statisticComponentInterceptor, n), sp)
+		}
+	}
+	other, err := ps.Statistics()
+	if err != nil {
+		return nil, err
+	}
+	return append(ss, other...), nil
+}
+
+// доступность топика изменений
+func (p *changesProvider) HealthChecks() []statistic.HealthCheck {
+	return []statistic.HealthCheck{kafkaReaderHealthCheck(p.lag.kafka, p.orderTopicName)}
+}
+
 type ChangeEventMessage struct {
 	ObjectType       string `json:"object_type"`
 	ObjectIdentifier string `json:"object_identifier"`
 	EventName        string `json:"event_name"`
 	Data             string `json:"data"`
+	// необязательные метаданные (correlation_id, traceparent). заголовки сообщения кафка имеют приоритет.
+	Metadata map[string]string `json:"metadata,omitempty"`
 }
 
 type changeEvent struct {
 	en        string
-	qm        *adapter.Message
+	qm        queueMessage
 	change    ChangeEventMessage
 	processed chan struct{}
+
+	md            MessageMetadata
+	correlationID string
+	trace         TraceContext
+
+	// вызывается после успешного подтверждения
+	onAck func()
+}
+
+func (o *changeEvent) Metadata() MessageMetadata {
+	return o.md
+}
+
+func (o *changeEvent) CorrelationID() string {
+	return o.correlationID
+}
+
+func (o *changeEvent) TraceContext() TraceContext {
+	return o.trace
+}
+
+func (o *changeEvent) Partition() int {
+	return o.md.Partition
+}
+
+func (o *changeEvent) Offset() int64 {
+	return o.md.Offset
 }
 
 func (o *changeEvent) Processed() chan struct{} {
@@ -166,7 +288,11 @@ func (o *changeEvent) Data() string {
 }
 
 func (o *changeEvent) Ack() error {
-	return o.qm.Ack()
+	err := o.qm.Ack()
+	if err == nil && o.onAck != nil {
+		o.onAck()
+	}
+	return err
 }
 
 func (o *changeEvent) Nack() error {
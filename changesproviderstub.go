@@ -1,6 +1,7 @@
 package reactivetools
 
 import (
+	"github.com/iddqdeika/reactivetools/statistic"
 	"strconv"
 	"time"
 )
@@ -19,6 +20,10 @@ func (s *stubChangesProvider) ChangesChan() chan ChangeEvent {
 	return s.ch
 }
 
+func (s *stubChangesProvider) Statistics() ([]statistic.Statistic, error) {
+	return nil, nil
+}
+
 func (s *stubChangesProvider) run(count int, interval time.Duration) {
 	for i := 0; i < count; i++ {
 		s.ch <- newStubChangeEvent("stubObject", strconv.Itoa(i), "stubEvent", "stubData")
@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"github.com/iddqdeika/reactivetools/statistic"
 	"github.com/iddqdeika/rrr/helpful"
 	"strconv"
 	"strings"
@@ -107,6 +108,16 @@ func (s *sqlSaver) Process(event ChangeEvent) error {
 	return s.p.Process(s.db, event, s.l)
 }
 
+// закрывает соединение с базой
+func (s *sqlSaver) Close() error {
+	return s.db.Close()
+}
+
+// доступность базы
+func (s *sqlSaver) HealthChecks() []statistic.HealthCheck {
+	return []statistic.HealthCheck{{Name: "sql", Kind: statistic.Readiness, Check: s.db.PingContext}}
+}
+
 func createDefaultProcessor(i targetInfo,
 	c ChangeValueConverter) SqlSaverProcessor {
 	return &defaultProcessor{
@@ -0,0 +1,52 @@
+package reactivetools
+
+import (
+	"github.com/iddqdeika/reactivetools/statistic"
+)
+
+// статистики провайдера изменений.
+func newChangesProviderStatistics() *changesProviderStatistics {
+	return &changesProviderStatistics{
+		received:  statistic.NewCounter("Changes received", `Кол-во сообщений, полученных из топика изменений.`),
+		filtered:  statistic.NewCounter("Changes filtered", `Кол-во изменений, пропущенных из-за другого типа объекта или ивента.`),
+		rejected:  statistic.NewCounter("Changes rejected by interceptors", `Кол-во изменений, отклоненных перехватчиками.`),
+		malformed: statistic.NewCounter("Malformed changes", `Кол-во сообщений с изменениями, которые не удалось разобрать.`),
+	}
+}
+
+type changesProviderStatistics struct {
+	received  *statistic.Counter
+	filtered  *statistic.Counter
+	rejected  *statistic.Counter
+	malformed *statistic.Counter
+}
+
+func (s *changesProviderStatistics) Statistics() ([]statistic.Statistic, error) {
+	return []statistic.Statistic{s.received, s.filtered, s.rejected, s.malformed}, nil
+}
+
+// статистики сервиса обработки изменений.
+func newChangesStatistics() *changesStatistics {
+	return &changesStatistics{
+		received:  statistic.NewCounter("Changes dispatched", `Кол-во изменений, полученных сервисом от провайдера.`),
+		processed: statistic.NewCounter("Changes processed", `Кол-во успешно обработанных изменений.`),
+		failed:    statistic.NewCounter("Change processing errors", `Кол-во ошибок при обработке изменений (каждая попытка считается отдельно).`),
+		retries:   statistic.NewCounter("Change processing retries", `Кол-во повторных попыток обработки изменений.`),
+		inFlight:  statistic.NewGauge("Changes in flight", `Кол-во изменений, находящихся в обработке прямо сейчас.`),
+		latency: statistic.NewHistogram("Change processing latency seconds",
+			`Время обработки изменения (с учетом повторов), в секундах.`),
+	}
+}
+
+type changesStatistics struct {
+	received  *statistic.Counter
+	processed *statistic.Counter
+	failed    *statistic.Counter
+	retries   *statistic.Counter
+	inFlight  *statistic.Gauge
+	latency   *statistic.Histogram
+}
+
+func (s *changesStatistics) Statistics() ([]statistic.Statistic, error) {
+	return []statistic.Statistic{s.received, s.processed, s.failed, s.retries, s.inFlight, s.latency}, nil
+}
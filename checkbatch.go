@@ -0,0 +1,368 @@
+package reactivetools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/iddqdeika/reactivetools/statistic"
+	"github.com/iddqdeika/rrr/helpful"
+	"sync"
+	"time"
+)
+
+const (
+	// пакетная проверка:
+	// "batch": {"max_size": 100, "linger_in_ms": 50, "checks": {"<check_name>": {"max_size": 10, "linger_in_ms": 200}}}
+	BatchConfigKey = "batch"
+
+	defaultBatchMaxSize = 1
+)
+
+// функция для пакетной обработки заказов на проверку.
+// получает заказы одной проверки (одного CheckName) и возвращает результаты в том же порядке.
+// ошибка функции означает, что не выполнен весь пакет - тогда повторяются все его заказы.
+// если не выполнена проверка отдельных заказов - ошибка возвращается в их результатах (Err),
+// и повторяются только они. требования к контексту и конкурентной безопасности те же, что и к CheckProvider.
+type BatchCheckProvider interface {
+	PerformBatchCheck(ctx context.Context, orders []CheckOrder) ([]BatchCheckResult, error)
+}
+
+// результат проверки одного заказа пакета.
+// Err - ошибка проверки заказа (заказ будет повторен), ErrNeedSkipResult - результат не публикуется.
+type BatchCheckResult struct {
+	Message string
+	Success bool
+	Err     error
+}
+
+// настройки накопления пакета: максимальный размер и время ожидания первого заказа пакета.
+// пакет отправляется на проверку, как только наберет MaxSize заказов или истечет Linger.
+type BatchSettings struct {
+	MaxSize int
+	Linger  time.Duration
+}
+
+// политика накопления пакетов. PerCheck - настройки отдельных проверок (по названию проверки).
+type BatchPolicy struct {
+	BatchSettings
+	PerCheck map[string]BatchSettings
+}
+
+// собирает политику пакетов из конфига.
+// настройки отдельных проверок читаются для переданных названий проверок (в разделе checks).
+func NewBatchPolicy(cfg helpful.Config, checkNames ...string) (BatchPolicy, error) {
+	if cfg == nil {
+		return BatchPolicy{}, fmt.Errorf("must be not-nil Config")
+	}
+	s, err := batchSettingsFromConfig(cfg, BatchSettings{MaxSize: defaultBatchMaxSize})
+	if err != nil {
+		return BatchPolicy{}, err
+	}
+	p := BatchPolicy{BatchSettings: s, PerCheck: make(map[string]BatchSettings)}
+	if !cfg.Contains("checks") {
+		return p, nil
+	}
+	checks := cfg.Child("checks")
+	for _, cn := range checkNames {
+		if !checks.Contains(cn) {
+			continue
+		}
+		s, err := batchSettingsFromConfig(checks.Child(cn), p.BatchSettings)
+		if err != nil {
+			return BatchPolicy{}, fmt.Errorf("cant get batch settings for check %v: %v", cn, err)
+		}
+		p.PerCheck[cn] = s
+	}
+	return p, nil
+}
+
+func batchSettingsFromConfig(cfg helpful.Config, def BatchSettings) (BatchSettings, error) {
+	size, err := optionalInt(cfg, "max_size", def.MaxSize)
+	if err != nil {
+		return BatchSettings{}, err
+	}
+	ms, err := optionalInt(cfg, "linger_in_ms", int(def.Linger/time.Millisecond))
+	if err != nil {
+		return BatchSettings{}, err
+	}
+	s := BatchSettings{MaxSize: size, Linger: time.Duration(ms) * time.Millisecond}
+	return s, s.validate()
+}
+
+func (s BatchSettings) validate() error {
+	if s.MaxSize < 1 {
+		return fmt.Errorf("max_size must be positive")
+	}
+	if s.Linger < 0 {
+		return fmt.Errorf("linger_in_ms must not be negative")
+	}
+	if s.MaxSize > 1 && s.Linger == 0 {
+		return fmt.Errorf("linger_in_ms must be positive if max_size is greater than 1")
+	}
+	return nil
+}
+
+// настройки для данной проверки
+func (p BatchPolicy) settings(checkName string) BatchSettings {
+	if s, ok := p.PerCheck[checkName]; ok {
+		return s
+	}
+	return p.BatchSettings
+}
+
+// проверяет настройки проверки против параллелизма сервиса и таймаута проверки (0 - без таймаута).
+// каждый заказ пакета занимает слот сервиса, так что пакет больше параллелизма никогда не наберется,
+// а заказ, ждущий пакет дольше таймаута, не будет проверен никогда.
+func (p BatchPolicy) validateFor(checkName string, parallelism int, timeout time.Duration) error {
+	s := p.settings(checkName)
+	if s.MaxSize > parallelism {
+		return fmt.Errorf("max_size (%v) for check %v must not be greater than parallelism (%v)", s.MaxSize, checkName, parallelism)
+	}
+	if timeout > 0 && s.Linger >= timeout {
+		return fmt.Errorf("linger_in_ms (%v) for check %v must be less than check timeout (%v)", s.Linger, checkName, timeout)
+	}
+	return nil
+}
+
+// собирает пакетный процессор с политикой из раздела batch (если он задан, иначе - пакеты по одному заказу).
+// политика проверяется против параллелизма сервиса и таймаутов проверок (check_timeout) того же конфига.
+func batchProcessorFromConfig(cfg helpful.Config, l helpful.Logger, p BatchCheckProvider,
+	checkNames ...string) (CheckOrderProcessor, error) {
+
+	policy := BatchPolicy{BatchSettings: BatchSettings{MaxSize: defaultBatchMaxSize}}
+	if cfg.Contains(BatchConfigKey) {
+		var err error
+		policy, err = NewBatchPolicy(cfg.Child(BatchConfigKey), checkNames...)
+		if err != nil {
+			return nil, err
+		}
+		err = validateBatchPolicy(cfg, policy, checkNames...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return NewBatchCheckOrderProcessor(p, policy, l)
+}
+
+// проверяет политику пакетов против параллелизма и таймаутов проверок из конфига сервиса
+func validateBatchPolicy(cfg helpful.Config, policy BatchPolicy, checkNames ...string) error {
+	parallelism, err := cfg.GetInt("parallelism")
+	if err != nil {
+		return err
+	}
+	var timeouts CheckTimeoutPolicy
+	if cfg.Contains(CheckTimeoutConfigKey) {
+		timeouts, err = NewCheckTimeoutPolicy(cfg.Child(CheckTimeoutConfigKey), checkNames...)
+		if err != nil {
+			return err
+		}
+	}
+	for _, cn := range checkNames {
+		err := policy.validateFor(cn, parallelism, timeouts.timeout(cn))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// инстанциирует процессор, накапливающий заказы в пакеты по названию проверки.
+// Process каждого заказа ждет выполнения пакета, в который попал заказ, и возвращает результат именно этого заказа,
+// так что сервис повторяет только заказы, которые не удалось проверить.
+// пакет не может быть больше параллелизма сервиса (parallelism), т.к. каждый заказ пакета занимает слот.
+// процессор реализует statistic.StatisticProvider (кол-во и размеры пакетов, кол-во ошибок заказов).
+func NewBatchCheckOrderProcessor(p BatchCheckProvider, policy BatchPolicy, l helpful.Logger) (CheckOrderProcessor, error) {
+	if p == nil {
+		return nil, fmt.Errorf("must be not-nil BatchCheckProvider")
+	}
+	if l == nil {
+		return nil, fmt.Errorf("must be not-nil Logger")
+	}
+	err := policy.validate()
+	if err != nil {
+		return nil, err
+	}
+	for cn, s := range policy.PerCheck {
+		err := s.validate()
+		if err != nil {
+			return nil, fmt.Errorf("invalid batch settings for check %v: %v", cn, err)
+		}
+	}
+	return &batchProcessor{
+		p:       p,
+		policy:  policy,
+		l:       l,
+		pending: make(map[string]*pendingBatch),
+		batches: statistic.NewCounter("Check batches", `Кол-во выполненных пакетов проверок.`),
+		sizes: statistic.NewHistogram("Check batch size", `Размеры выполненных пакетов проверок.`,
+			1, 2, 5, 10, 20, 50, 100, 200, 500),
+		failed: statistic.NewCounter("Batch check failed orders", `Кол-во заказов, которые не удалось проверить в пакете.`),
+	}, nil
+}
+
+type batchProcessor struct {
+	p      BatchCheckProvider
+	policy BatchPolicy
+	l      helpful.Logger
+
+	m       sync.Mutex
+	pending map[string]*pendingBatch
+
+	batches *statistic.Counter
+	sizes   *statistic.Histogram
+	failed  *statistic.Counter
+}
+
+// накапливаемый пакет одной проверки
+type pendingBatch struct {
+	checkName string
+	orders    []CheckOrder
+	ctxs      []context.Context
+	timer     *time.Timer
+
+	// закрывается после выполнения пакета, после этого orders, results и err не меняются
+	done    chan struct{}
+	results []BatchCheckResult
+	err     error
+}
+
+func (p *batchProcessor) Process(ctx context.Context, o CheckOrder) error {
+	b := p.add(ctx, o)
+	select {
+	case <-b.done:
+	case <-ctx.Done():
+		// заказ, еще не отправленный на проверку, убираем из пакета, чтобы его повтор не проверялся дважды
+		p.remove(b, o)
+		return ctx.Err()
+	}
+	if b.err != nil {
+		p.failed.Inc()
+		return fmt.Errorf("batch of %v checks %v failed: %w", len(b.orders), b.checkName, b.err)
+	}
+	res := b.results[b.index(o)]
+	if errors.Is(res.Err, ErrNeedSkipResult) {
+		skipResult(o)
+		return nil
+	}
+	if res.Err != nil {
+		p.failed.Inc()
+		return res.Err
+	}
+	return forwardResult(ctx, o, newOrderResult(o, res.Message, res.Success))
+}
+
+// добавляет заказ в накапливаемый пакет его проверки
+func (p *batchProcessor) add(ctx context.Context, o CheckOrder) *pendingBatch {
+	s := p.policy.settings(o.CheckName())
+	p.m.Lock()
+	defer p.m.Unlock()
+	b, ok := p.pending[o.CheckName()]
+	if !ok {
+		b = &pendingBatch{checkName: o.CheckName(), done: make(chan struct{})}
+		p.pending[o.CheckName()] = b
+		if s.MaxSize > 1 {
+			b.timer = time.AfterFunc(s.Linger, func() {
+				p.flush(b)
+			})
+		}
+	}
+	b.orders = append(b.orders, o)
+	b.ctxs = append(b.ctxs, ctx)
+	if len(b.orders) >= s.MaxSize {
+		p.detach(b)
+		go p.execute(b)
+	}
+	return b
+}
+
+// убирает заказ из накапливаемого пакета. пакет, уже отправленный на проверку, не меняется.
+// опустевший пакет не отправляется.
+func (p *batchProcessor) remove(b *pendingBatch, o CheckOrder) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.pending[b.checkName] != b {
+		return
+	}
+	i := b.index(o)
+	b.orders = append(b.orders[:i], b.orders[i+1:]...)
+	b.ctxs = append(b.ctxs[:i], b.ctxs[i+1:]...)
+	if len(b.orders) == 0 {
+		p.detach(b)
+	}
+}
+
+// номер заказа в пакете
+func (b *pendingBatch) index(o CheckOrder) int {
+	for i, bo := range b.orders {
+		if bo == o {
+			return i
+		}
+	}
+	return -1
+}
+
+// пакет больше не принимает заказы. вызывается под мьютексом.
+func (p *batchProcessor) detach(b *pendingBatch) bool {
+	if p.pending[b.checkName] != b {
+		return false
+	}
+	delete(p.pending, b.checkName)
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	return true
+}
+
+// отправка пакета по истечении времени ожидания
+func (p *batchProcessor) flush(b *pendingBatch) {
+	p.m.Lock()
+	detached := p.detach(b)
+	p.m.Unlock()
+	if detached {
+		p.execute(b)
+	}
+}
+
+func (p *batchProcessor) execute(b *pendingBatch) {
+	defer close(b.done)
+	ctx, cancel := batchContext(b.ctxs)
+	defer cancel()
+
+	p.batches.Inc()
+	p.sizes.Observe(float64(len(b.orders)))
+	results, err := p.p.PerformBatchCheck(ctx, b.orders)
+	if err == nil && len(results) != len(b.orders) {
+		err = fmt.Errorf("got %v results for %v orders", len(results), len(b.orders))
+	}
+	if err != nil {
+		p.l.Errorf("batch of %v checks %v failed: %v", len(b.orders), b.checkName, err)
+		b.err = err
+		return
+	}
+	b.results = results
+}
+
+// контекст пакета закрывается, когда закрыты контексты всех его заказов
+func batchContext(ctxs []context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for _, c := range ctxs {
+			select {
+			case <-c.Done():
+			case <-ctx.Done():
+				return
+			}
+		}
+		cancel()
+	}()
+	return ctx, cancel
+}
+
+func (p *batchProcessor) Statistics() ([]statistic.Statistic, error) {
+	return []statistic.Statistic{p.batches, p.sizes, p.failed}, nil
+}
+
+// проверки здоровья, которые предоставляет сама функция проверки (если предоставляет)
+func (p *batchProcessor) HealthChecks() []statistic.HealthCheck {
+	return componentHealthChecks(p.p)
+}
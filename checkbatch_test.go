@@ -0,0 +1,194 @@
+package reactivetools
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/iddqdeika/rrr/helpful"
+	"sync"
+	"testing"
+	"time"
+)
+
+// пакетная проверка: нечетные оффсеты не проверяются, размеры пакетов запоминаются
+type stubBatchCheckProvider struct {
+	m     sync.Mutex
+	sizes []int
+	err   error
+}
+
+func (p *stubBatchCheckProvider) PerformBatchCheck(ctx context.Context, orders []CheckOrder) ([]BatchCheckResult, error) {
+	p.m.Lock()
+	p.sizes = append(p.sizes, len(orders))
+	p.m.Unlock()
+	if p.err != nil {
+		return nil, p.err
+	}
+	res := make([]BatchCheckResult, len(orders))
+	for i, o := range orders {
+		if o.(OffsetCarrier).Offset()%2 == 1 {
+			res[i] = BatchCheckResult{Err: errors.New("odd")}
+			continue
+		}
+		res[i] = BatchCheckResult{Message: "ok", Success: true}
+	}
+	return res, nil
+}
+
+func (p *stubBatchCheckProvider) batchSizes() []int {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return append([]int(nil), p.sizes...)
+}
+
+func processConcurrently(proc CheckOrderProcessor, orders []CheckOrder) []error {
+	errs := make([]error, len(orders))
+	wg := sync.WaitGroup{}
+	for i, o := range orders {
+		wg.Add(1)
+		go func(i int, o CheckOrder) {
+			defer wg.Done()
+			errs[i] = proc.Process(context.Background(), o)
+		}(i, o)
+	}
+	wg.Wait()
+	return errs
+}
+
+func TestBatchCheckOrderProcessor(t *testing.T) {
+	bp := &stubBatchCheckProvider{}
+	proc, err := NewBatchCheckOrderProcessor(bp, BatchPolicy{
+		BatchSettings: BatchSettings{MaxSize: 1},
+		PerCheck:      map[string]BatchSettings{"stub_check_name": {MaxSize: 4, Linger: time.Millisecond * 50}},
+	}, helpful.DefaultLogger.WithLevel(helpful.LogNone))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 4 заказа - пакет отправляется сразу по размеру
+	orders := make([]CheckOrder, 4)
+	for i := range orders {
+		orders[i] = newStubCheckOrder(int64(i), nil)
+	}
+	started := time.Now()
+	errs := processConcurrently(proc, orders)
+	if time.Since(started) > time.Millisecond*40 {
+		t.Errorf("full batch must not wait for linger")
+	}
+	for i, o := range orders {
+		if i%2 == 1 {
+			if errs[i] == nil {
+				t.Errorf("order %v must fail", i)
+			}
+			continue
+		}
+		if errs[i] != nil {
+			t.Fatalf("order %v failed: %v", i, errs[i])
+		}
+		r := <-o.Result()
+		if !r.CheckSuccess() || r.ResultMessage() != "ok" {
+			t.Errorf("unexpected result of order %v: %+v", i, r)
+		}
+	}
+
+	// 2 заказа - пакет отправляется по истечении linger
+	started = time.Now()
+	errs = processConcurrently(proc, orders[:2])
+	if time.Since(started) < time.Millisecond*50 {
+		t.Errorf("partial batch must wait for linger")
+	}
+	if errs[0] != nil || errs[1] == nil {
+		t.Errorf("unexpected errors %v", errs)
+	}
+	<-orders[0].Result()
+	sizes := bp.batchSizes()
+	if len(sizes) != 2 || sizes[0] != 4 || sizes[1] != 2 {
+		t.Errorf("unexpected batch sizes %v", sizes)
+	}
+
+	// ошибка пакета - ошибка всех его заказов
+	bp.err = errors.New("unavailable")
+	errs = processConcurrently(proc, orders)
+	for i, err := range errs {
+		if !errors.Is(err, bp.err) {
+			t.Errorf("order %v: expected batch error, got %v", i, err)
+		}
+	}
+}
+
+func TestNewBatchPolicy(t *testing.T) {
+	values := make(map[string]interface{})
+	err := json.Unmarshal([]byte(`{"max_size": 10, "linger_in_ms": 20,
+		"checks": {"a": {"max_size": 2}, "b": {"max_size": 5, "linger_in_ms": 0}}}`), &values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := newFileConfig(values, nil)
+	p, err := NewBatchPolicy(cfg, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.settings("a") != (BatchSettings{MaxSize: 2, Linger: time.Millisecond * 20}) ||
+		p.settings("c") != (BatchSettings{MaxSize: 10, Linger: time.Millisecond * 20}) {
+		t.Errorf("unexpected policy %+v", p)
+	}
+	_, err = NewBatchPolicy(cfg, "b")
+	if err == nil {
+		t.Errorf("batch without linger must be invalid")
+	}
+}
+
+func TestBatchProcessorRemovesAbandonedOrders(t *testing.T) {
+	bp := &stubBatchCheckProvider{}
+	proc, err := NewBatchCheckOrderProcessor(bp, BatchPolicy{
+		BatchSettings: BatchSettings{MaxSize: 4, Linger: time.Millisecond * 100},
+	}, helpful.DefaultLogger.WithLevel(helpful.LogNone))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// заказ, брошенный во время ожидания пакета (таймаут), из пакета убирается
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	abandoned := newStubCheckOrder(0, nil)
+	if err := proc.Process(ctx, abandoned); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	o := newStubCheckOrder(2, nil)
+	errs := processConcurrently(proc, []CheckOrder{o})
+	if errs[0] != nil {
+		t.Fatalf("unexpected error %v", errs[0])
+	}
+	<-o.Result()
+	if sizes := bp.batchSizes(); len(sizes) != 1 || sizes[0] != 1 {
+		t.Errorf("abandoned order must not be checked, batch sizes %v", sizes)
+	}
+
+	// опустевший пакет не отправляется
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	_ = proc.Process(ctx, abandoned)
+	time.Sleep(time.Millisecond * 150)
+	if sizes := bp.batchSizes(); len(sizes) != 1 {
+		t.Errorf("empty batch must not be executed, batch sizes %v", sizes)
+	}
+}
+
+func TestBatchPolicyLimits(t *testing.T) {
+	p := BatchPolicy{
+		BatchSettings: BatchSettings{MaxSize: 4, Linger: time.Millisecond * 50},
+		PerCheck:      map[string]BatchSettings{"a": {MaxSize: 10, Linger: time.Millisecond * 50}},
+	}
+	if err := p.validateFor("b", 4, time.Second); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := p.validateFor("b", 4, 0); err != nil {
+		t.Errorf("linger without check timeout must be valid, got %v", err)
+	}
+	if err := p.validateFor("a", 4, time.Second); err == nil {
+		t.Errorf("batch greater than parallelism must be invalid")
+	}
+	if err := p.validateFor("b", 4, time.Millisecond*50); err == nil {
+		t.Errorf("linger not less than check timeout must be invalid")
+	}
+}
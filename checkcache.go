@@ -0,0 +1,398 @@
+package reactivetools
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/iddqdeika/reactivetools/statistic"
+	"github.com/iddqdeika/rrr/helpful"
+	bolt "go.etcd.io/bbolt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// кэш результатов проверки:
+	// "result_cache": {"ttl_in_secs": 600, "storage": "memory", "max_entries": 10000, "revision_header": "revision"}
+	// или "storage": "bolt" с "bolt_storage_path": "/data/results.db".
+	// файл bolt может быть тем же, что у агрегатора изменений (NewBoltChangesAggregator) того же процесса:
+	// дескриптор файла будет общим, а результаты хранятся в отдельном бакете.
+	ResultCacheConfigKey = "result_cache"
+
+	ResultCacheStorageMemory = "memory"
+	ResultCacheStorageBolt   = "bolt"
+
+	defaultResultCacheMaxEntries     = 10000
+	defaultResultCacheRevisionHeader = "revision"
+)
+
+var resultCacheBucketName = []byte("check_results")
+
+// хранилище кэша результатов. отсутствующий или устаревший результат - ok=false.
+type resultCache interface {
+	get(key string) (cachedResult, bool, error)
+	set(key string, r cachedResult, expires time.Time) error
+}
+
+// закэшированный результат: все, что не зависит от конкретного заказа
+type cachedResult struct {
+	Message    string            `json:"message"`
+	Success    bool              `json:"success"`
+	Severity   Severity          `json:"severity,omitempty"`
+	Findings   []Finding         `json:"findings,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Duration   time.Duration     `json:"duration"`
+}
+
+func newCachedResult(r CheckResult) cachedResult {
+	c := cachedResult{Message: r.ResultMessage(), Success: r.CheckSuccess()}
+	if dr, ok := r.(DetailedCheckResult); ok {
+		c.Severity = dr.Severity()
+		c.Findings = dr.Findings()
+		c.Attributes = dr.Attributes()
+		c.Duration = dr.Duration()
+	}
+	return c
+}
+
+// результат для данного заказа: идентификаторы, корреляция и трассировка берутся из заказа
+func (c cachedResult) orderResult(o CheckOrder) *checkResult {
+	r := newOrderResult(o, c.Message, c.Success)
+	r.severity = c.Severity
+	r.findings = c.Findings
+	r.attributes = c.Attributes
+	r.duration = c.Duration
+	return r
+}
+
+// хранилище и настройки кэша результатов. хранилище общее для всех проверок сервиса (маршрутов).
+type resultCacheConfig struct {
+	cache          resultCache
+	ttl            time.Duration
+	revisionHeader string
+}
+
+// собирает кэш результатов из раздела result_cache конфига. без раздела - nil.
+func resultCacheFromConfig(cfg helpful.Config) (*resultCacheConfig, error) {
+	if !cfg.Contains(ResultCacheConfigKey) {
+		return nil, nil
+	}
+	cc := cfg.Child(ResultCacheConfigKey)
+	ttl, err := cc.GetInt("ttl_in_secs")
+	if err != nil {
+		return nil, err
+	}
+	if ttl <= 0 {
+		return nil, fmt.Errorf("ttl_in_secs must be positive")
+	}
+	revisionHeader := defaultResultCacheRevisionHeader
+	if cc.Contains("revision_header") {
+		revisionHeader, err = cc.GetString("revision_header")
+		if err != nil {
+			return nil, err
+		}
+	}
+	storage := ResultCacheStorageMemory
+	if cc.Contains("storage") {
+		storage, err = cc.GetString("storage")
+		if err != nil {
+			return nil, err
+		}
+	}
+	var cache resultCache
+	switch storage {
+	case ResultCacheStorageMemory:
+		size, err := optionalInt(cc, "max_entries", defaultResultCacheMaxEntries)
+		if err != nil {
+			return nil, err
+		}
+		if size < 1 {
+			return nil, fmt.Errorf("max_entries must be positive")
+		}
+		cache = newLruResultCache(size)
+	case ResultCacheStorageBolt:
+		path, err := cc.GetString("bolt_storage_path")
+		if err != nil {
+			return nil, err
+		}
+		cache, err = newBoltResultCache(path)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown result cache storage %v", storage)
+	}
+	return &resultCacheConfig{cache: cache, ttl: time.Duration(ttl) * time.Second, revisionHeader: revisionHeader}, nil
+}
+
+// оборачивает процессор кэширующим. без кэша (nil) процессор возвращается как есть.
+// subject - что проверяет процессор (для названий статистик), может быть пустым.
+func (c *resultCacheConfig) wrap(proc CheckOrderProcessor, l helpful.Logger, subject string) CheckOrderProcessor {
+	if c == nil {
+		return proc
+	}
+	return newCachingProcessor(proc, c.cache, c.ttl, c.revisionHeader, l, subject)
+}
+
+// закрывает хранилище кэша, если оно этого требует. вызывается после остановки сервиса.
+func (c *resultCacheConfig) Close() error {
+	if cl, ok := c.cache.(io.Closer); ok {
+		return cl.Close()
+	}
+	return nil
+}
+
+// инстанциирует процессор, отдающий закэшированный результат, если он есть и не устарел.
+// ключ кэша - тип объекта, идентификатор, проверка и ревизия объекта из заголовка revisionHeader метаданных заказа
+// (если заказ их предоставляет и заголовок задан). результат из кэша возвращается как обычный результат заказа,
+// так что он публикуется и заказ подтверждается как обычно. пропущенные результаты и результаты "timed out"
+// не кэшируются, поэтому кэширующий процессор оборачивает ограничитель частоты и процессор с таймаутами:
+// результат из кэша не ждет ни того, ни другого.
+func newCachingProcessor(proc CheckOrderProcessor, cache resultCache, ttl time.Duration,
+	revisionHeader string, l helpful.Logger, subject string) *cachingProcessor {
+	suffix := ""
+	if subject != "" {
+		suffix = " for " + subject
+	}
+	return &cachingProcessor{
+		proc:           proc,
+		cache:          cache,
+		ttl:            ttl,
+		revisionHeader: strings.ToLower(revisionHeader),
+		l:              l,
+		hits:           statistic.NewCounter("Result cache hits"+suffix, `Кол-во заказов, результат которых взят из кэша.`),
+		misses:         statistic.NewCounter("Result cache misses"+suffix, `Кол-во заказов, результата которых не было в кэше.`),
+		errors:         statistic.NewCounter("Result cache errors"+suffix, `Кол-во ошибок чтения и записи кэша результатов.`),
+	}
+}
+
+type cachingProcessor struct {
+	proc           CheckOrderProcessor
+	cache          resultCache
+	ttl            time.Duration
+	revisionHeader string
+	l              helpful.Logger
+
+	hits   *statistic.Counter
+	misses *statistic.Counter
+	errors *statistic.Counter
+}
+
+func (p *cachingProcessor) Process(ctx context.Context, o CheckOrder) error {
+	key := p.key(o)
+	cached, ok, err := p.cache.get(key)
+	if err != nil {
+		p.errors.Inc()
+		p.l.Errorf("cant get cached result: %v", err)
+	}
+	if ok {
+		p.hits.Inc()
+		return forwardResult(ctx, o, cached.orderResult(o))
+	}
+	p.misses.Inc()
+
+	// результат перехватываем, чтобы положить в кэш
+	po := newTimeoutOrder(o)
+	err = p.proc.Process(ctx, po)
+	if err != nil {
+		return err
+	}
+	var r CheckResult
+	select {
+	case r = <-po.result:
+	default:
+		return fmt.Errorf("processor returned without result")
+	}
+	if r == nil {
+		skipResult(o)
+		return nil
+	}
+	if isTimedOutResult(r) {
+		return forwardResult(ctx, o, r)
+	}
+	err = p.cache.set(key, newCachedResult(r), time.Now().Add(p.ttl))
+	if err != nil {
+		p.errors.Inc()
+		p.l.Errorf("cant cache result: %v", err)
+	}
+	return forwardResult(ctx, o, r)
+}
+
+func (p *cachingProcessor) key(o CheckOrder) string {
+	revision := ""
+	if mc, ok := o.(MetadataCarrier); ok && p.revisionHeader != "" {
+		revision = mc.Metadata().Headers[p.revisionHeader]
+	}
+	return strings.Join([]string{o.ObjectType(), o.ObjectIdentifier(), o.CheckName(), revision}, "\x00")
+}
+
+// статистики кэша и обернутого процессора (если он их предоставляет)
+func (p *cachingProcessor) Statistics() ([]statistic.Statistic, error) {
+	res := []statistic.Statistic{p.hits, p.misses, p.errors}
+	if sp, ok := p.proc.(statistic.StatisticProvider); ok {
+		ps, err := sp.Statistics()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, ps...)
+	}
+	return res, nil
+}
+
+func (p *cachingProcessor) HealthChecks() []statistic.HealthCheck {
+	return componentHealthChecks(p.proc)
+}
+
+func (p *cachingProcessor) forget(o CheckOrder) {
+	forgetOrder(p.proc, o)
+}
+
+// кэш в памяти: не больше size записей, при переполнении вытесняются давно не использованные
+func newLruResultCache(size int) *lruResultCache {
+	return &lruResultCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+type lruResultCache struct {
+	size int
+
+	m       sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type lruEntry struct {
+	key     string
+	result  cachedResult
+	expires time.Time
+}
+
+func (c *lruResultCache) get(key string) (cachedResult, bool, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return cachedResult{}, false, nil
+	}
+	e := el.Value.(*lruEntry)
+	if time.Now().After(e.expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return cachedResult{}, false, nil
+	}
+	c.order.MoveToFront(el)
+	return e.result, true, nil
+}
+
+func (c *lruResultCache) set(key string, r cachedResult, expires time.Time) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if el, ok := c.entries[key]; ok {
+		el.Value = &lruEntry{key: key, result: r, expires: expires}
+		c.order.MoveToFront(el)
+		return nil
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, result: r, expires: expires})
+	for c.order.Len() > c.size {
+		el := c.order.Back()
+		c.order.Remove(el)
+		delete(c.entries, el.Value.(*lruEntry).key)
+	}
+	return nil
+}
+
+// кэш в файле bolt: переживает перезапуск сервиса.
+// устаревшие записи удаляются при чтении и при открытии файла.
+func newBoltResultCache(path string) (*boltResultCache, error) {
+	db, err := openSharedBolt(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &boltResultCache{db: db}
+	err = c.purge()
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+type boltResultCache struct {
+	db *sharedBolt
+}
+
+type boltCacheEntry struct {
+	Result  cachedResult `json:"result"`
+	Expires time.Time    `json:"expires"`
+}
+
+// создает бакет и удаляет устаревшие записи
+func (c *boltResultCache) purge() error {
+	now := time.Now()
+	return c.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(resultCacheBucketName)
+		if err != nil {
+			return err
+		}
+		var expired [][]byte
+		err = b.ForEach(func(k, v []byte) error {
+			var e boltCacheEntry
+			if json.Unmarshal(v, &e) != nil || now.After(e.Expires) {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			err = b.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (c *boltResultCache) get(key string) (cachedResult, bool, error) {
+	var data []byte
+	err := c.db.View(func(tx *bolt.Tx) error {
+		data = append(data, tx.Bucket(resultCacheBucketName).Get([]byte(key))...)
+		return nil
+	})
+	if err != nil || data == nil {
+		return cachedResult{}, false, err
+	}
+	var e boltCacheEntry
+	err = json.Unmarshal(data, &e)
+	if err != nil {
+		return cachedResult{}, false, fmt.Errorf("cant unmarshal cached result: %v", err)
+	}
+	if time.Now().After(e.Expires) {
+		return cachedResult{}, false, c.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(resultCacheBucketName).Delete([]byte(key))
+		})
+	}
+	return e.Result, true, nil
+}
+
+func (c *boltResultCache) set(key string, r cachedResult, expires time.Time) error {
+	data, err := json.Marshal(boltCacheEntry{Result: r, Expires: expires})
+	if err != nil {
+		return err
+	}
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(resultCacheBucketName).Put([]byte(key), data)
+	})
+}
+
+func (c *boltResultCache) Close() error {
+	return c.db.Close()
+}
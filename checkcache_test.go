@@ -0,0 +1,199 @@
+package reactivetools
+
+import (
+	"context"
+	"errors"
+	"github.com/iddqdeika/rrr/helpful"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// проверка, считающая вызовы
+type countingCheckProvider struct {
+	calls int32
+}
+
+func (p *countingCheckProvider) PerformCheck(ctx context.Context, o CheckOrder) (string, bool, error) {
+	atomic.AddInt32(&p.calls, 1)
+	return "checked " + o.ObjectIdentifier(), true, nil
+}
+
+func revisionOrder(id, revision string) *checkOrder {
+	return &checkOrder{
+		ot:     "product",
+		oid:    id,
+		cn:     "images",
+		md:     MessageMetadata{Headers: map[string]string{"revision": revision}, Partition: unknownPartition, Offset: -1},
+		result: make(chan CheckResult, 1),
+	}
+}
+
+func TestCachingProcessor(t *testing.T) {
+	cp := &countingCheckProvider{}
+	inner, err := NewCheckOrderProcessor(cp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proc := newCachingProcessor(inner, newLruResultCache(2), time.Millisecond*100, "Revision",
+		helpful.DefaultLogger.WithLevel(helpful.LogNone), "")
+
+	process := func(o *checkOrder) CheckResult {
+		err := proc.Process(context.Background(), o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return <-o.Result()
+	}
+	process(revisionOrder("1", "a"))
+	r := process(revisionOrder("1", "a"))
+	if r.ResultMessage() != "checked 1" || !r.CheckSuccess() || r.ObjectIdentifier() != "1" {
+		t.Errorf("unexpected cached result %+v", r)
+	}
+	if cp.calls != 1 || proc.hits.Get() != 1 || proc.misses.Get() != 1 {
+		t.Errorf("second order must be served from cache, calls: %v, hits: %v", cp.calls, proc.hits.Get())
+	}
+
+	// другая ревизия - другой ключ
+	process(revisionOrder("1", "b"))
+	// переполнение вытесняет давно не использованную запись (1/a)
+	process(revisionOrder("2", "a"))
+	process(revisionOrder("1", "a"))
+	if cp.calls != 4 {
+		t.Errorf("expected 4 checks, got %v", cp.calls)
+	}
+
+	// устаревшая запись не используется
+	time.Sleep(time.Millisecond * 150)
+	process(revisionOrder("1", "a"))
+	if cp.calls != 5 {
+		t.Errorf("expired result must not be used, checks: %v", cp.calls)
+	}
+}
+
+func TestBoltResultCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resultcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "results.db")
+
+	c, err := newBoltResultCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := cachedResult{Message: "ok", Success: true, Findings: []Finding{{Code: "c1"}}}
+	err = c.set("fresh", res, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.set("stale", res, time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// кэш переживает переоткрытие файла
+	c, err = newBoltResultCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	got, ok, err := c.get("fresh")
+	if err != nil || !ok || got.Message != "ok" || len(got.Findings) != 1 {
+		t.Errorf("unexpected cached result %+v (ok: %v, err: %v)", got, ok, err)
+	}
+	_, ok, err = c.get("stale")
+	if err != nil || ok {
+		t.Errorf("stale result must not be returned (ok: %v, err: %v)", ok, err)
+	}
+}
+
+func TestBoltResultCacheSharesAggregatorFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resultcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "main.db")
+
+	// агрегатор и кэш одного процесса работают с одним файлом, каждый в своем бакете
+	agg, err := NewBoltChangesAggregator(newFileConfig(map[string]interface{}{"bolt_storage_path": path}, nil),
+		helpful.DefaultLogger.WithLevel(helpful.LogNone))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := newBoltResultCache(path)
+	if err != nil {
+		t.Fatalf("cache must share aggregator's file: %v", err)
+	}
+	err = c.set("key", cachedResult{Message: "ok"}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = agg.(*boltChangesAggregator).Set("object", "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// закрытие кэша не закрывает файл агрегатора
+	err = (&resultCacheConfig{cache: c}).Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = agg.(*boltChangesAggregator).Set("object", "data")
+	if err != nil {
+		t.Fatalf("aggregator must keep working after cache is closed: %v", err)
+	}
+	err = agg.(*boltChangesAggregator).Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sharedBolts.dbs[c.db.path]; ok {
+		t.Fatal("file must be closed after all users closed it")
+	}
+}
+
+func TestCachingProcessorSkipsTimedOutResults(t *testing.T) {
+	inner, err := NewCheckOrderProcessor(&hangingCheckProvider{delay: time.Millisecond * 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	timeouts, err := NewTimeoutCheckOrderProcessor(inner, CheckTimeoutPolicy{
+		Timeout:            time.Millisecond * 10,
+		PublishResultAfter: 2,
+	}, helpful.DefaultLogger.WithLevel(helpful.LogNone))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proc := newCachingProcessor(timeouts, newLruResultCache(10), time.Minute, "",
+		helpful.DefaultLogger.WithLevel(helpful.LogNone), "")
+
+	// таймауты считаются по исходному заказу, хотя процессор с таймаутами получает заказ-посредник кэша
+	o := revisionOrder("1", "")
+	if err := proc.Process(context.Background(), o); !errors.Is(err, ErrCheckTimeout) {
+		t.Fatalf("expected ErrCheckTimeout, got %v", err)
+	}
+	if err := proc.Process(context.Background(), o); err != nil {
+		t.Fatalf("expected timed out result, got err: %v", err)
+	}
+	if r := <-o.Result(); !isTimedOutResult(r) {
+		t.Fatalf("expected timed out result, got %+v", r)
+	}
+	forgetOrder(proc, o)
+
+	// результат "timed out" не кэшируется
+	o = revisionOrder("1", "")
+	if err := proc.Process(context.Background(), o); !errors.Is(err, ErrCheckTimeout) {
+		t.Fatalf("timed out result must not be cached, got %v", err)
+	}
+	if proc.hits.Get() != 0 {
+		t.Fatalf("unexpected cache hits: %v", proc.hits.Get())
+	}
+}
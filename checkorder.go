@@ -1,25 +1,62 @@
 package reactivetools
 
-import adapter "github.com/iddqdeika/kafka-adapter"
-
-func newCheckOrder(checkName, objectType, objectIdentifier string, msg *adapter.Message) CheckOrder {
+func newCheckOrder(om OrderMessage, msg *kafkaMessage) *checkOrder {
+	md := newMessageMetadata(msg.msg, om.Metadata)
 	return &checkOrder{
-		cn:        checkName,
-		qm:        msg,
-		ot:        objectType,
-		oid:       objectIdentifier,
-		result:    make(chan CheckResult),
-		published: make(chan struct{}),
+		cn:            om.CheckName,
+		qm:            msg,
+		ot:            om.ObjectType,
+		oid:           om.ObjectIdentifier,
+		orderID:       om.OrderID,
+		md:            md,
+		correlationID: correlationID(md, om.OrderID),
+		trace:         traceContextFromMetadata(md),
+		result:        make(chan CheckResult),
+		published:     make(chan struct{}),
 	}
 }
 
 type checkOrder struct {
 	cn        string
-	qm        *adapter.Message
+	qm        queueMessage
 	ot        string
 	oid       string
+	orderID   string
 	result    chan CheckResult
 	published chan struct{}
+
+	md            MessageMetadata
+	correlationID string
+	trace         TraceContext
+
+	// вызывается после успешного подтверждения
+	onAck func()
+}
+
+// идентификатор заказа из конверта, пустой для сообщений без конверта
+func (o *checkOrder) OrderID() string {
+	return o.orderID
+}
+
+func (o *checkOrder) Metadata() MessageMetadata {
+	return o.md
+}
+
+func (o *checkOrder) CorrelationID() string {
+	return o.correlationID
+}
+
+func (o *checkOrder) TraceContext() TraceContext {
+	return o.trace
+}
+
+// положение в очереди (у заказов, собранных не из кафка, партиция -1)
+func (o *checkOrder) Partition() int {
+	return o.md.Partition
+}
+
+func (o *checkOrder) Offset() int64 {
+	return o.md.Offset
 }
 
 func (o *checkOrder) ObjectType() string {
@@ -43,7 +80,11 @@ func (o *checkOrder) Result() chan CheckResult {
 }
 
 func (o *checkOrder) Ack() error {
-	return o.qm.Ack()
+	err := o.qm.Ack()
+	if err == nil && o.onAck != nil {
+		o.onAck()
+	}
+	return err
 }
 
 func (o *checkOrder) Nack() error {
@@ -3,6 +3,8 @@ package reactivetools
 import (
 	"context"
 	"fmt"
+	"github.com/iddqdeika/reactivetools/statistic"
+	"time"
 )
 
 var ErrNeedSkipResult = fmt.Errorf("need skip result")
@@ -17,10 +19,22 @@ func NewCheckOrderProcessor(p CheckProvider) (CheckOrderProcessor, error) {
 	}, nil
 }
 
+// инстанциирует новый процессор по данной функции для обработки заказов на проверку с подробным результатом.
+func NewDetailedCheckOrderProcessor(p DetailedCheckProvider) (CheckOrderProcessor, error) {
+	if p == nil {
+		return nil, fmt.Errorf("must be not-nil DetailedCheckProvider")
+	}
+	return &checkOrderProcessor{
+		dp: p,
+	}, nil
+}
+
 // процессов заказов на проверку.
 // выполняет саму проверку.
+// задан либо p, либо dp.
 type checkOrderProcessor struct {
-	p CheckProvider
+	p  CheckProvider
+	dp DetailedCheckProvider
 }
 
 func (c *checkOrderProcessor) Process(ctx context.Context, o CheckOrder) error {
@@ -28,7 +42,8 @@ func (c *checkOrderProcessor) Process(ctx context.Context, o CheckOrder) error {
 }
 
 func (c *checkOrderProcessor) process(ctx context.Context, o CheckOrder) error {
-	msg, success, err := c.p.PerformCheck(ctx, o)
+	started := time.Now()
+	r, err := c.perform(ctx, o)
 	if err == ErrNeedSkipResult {
 		skipResult(o)
 		return nil
@@ -36,12 +51,41 @@ func (c *checkOrderProcessor) process(ctx context.Context, o CheckOrder) error {
 	if err != nil {
 		return err
 	}
-	setResult(o, msg, success)
+	if c.dp != nil {
+		// длительность - часть подробного результата, результаты CheckProvider остаются прежнего вида
+		r.duration = time.Since(started)
+	}
+	o.Result() <- r
 	return nil
 }
 
+func (c *checkOrderProcessor) perform(ctx context.Context, o CheckOrder) (*checkResult, error) {
+	if c.dp != nil {
+		d, err := c.dp.PerformDetailedCheck(ctx, o)
+		if err != nil {
+			return nil, err
+		}
+		r := newOrderResult(o, "", false)
+		r.setDetails(d)
+		return r, nil
+	}
+	msg, success, err := c.p.PerformCheck(ctx, o)
+	if err != nil {
+		return nil, err
+	}
+	return newOrderResult(o, msg, success), nil
+}
+
+// проверки здоровья, которые предоставляет сама функция проверки (если предоставляет)
+func (c *checkOrderProcessor) HealthChecks() []statistic.HealthCheck {
+	if c.dp != nil {
+		return componentHealthChecks(c.dp)
+	}
+	return componentHealthChecks(c.p)
+}
+
 func setResult(o CheckOrder, msg string, success bool) {
-	o.Result() <- NewCheckResult(o.ObjectType(), o.ObjectIdentifier(), o.CheckName(), msg, success)
+	o.Result() <- newOrderResult(o, msg, success)
 }
 
 func skipResult(o CheckOrder) {
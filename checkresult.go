@@ -1,5 +1,45 @@
 package reactivetools
 
+import "time"
+
+// важность результата проверки
+type Severity string
+
+const (
+	SeverityInfo    Severity = "info"
+	SeverityWarning Severity = "warning"
+	SeverityError   Severity = "error"
+)
+
+// отдельное замечание проверки.
+// Field - путь к полю объекта (например, "attributes.weight"), Code - машиночитаемый код замечания.
+type Finding struct {
+	Field    string   `json:"field,omitempty"`
+	Code     string   `json:"code,omitempty"`
+	Message  string   `json:"message,omitempty"`
+	Severity Severity `json:"severity,omitempty"`
+}
+
+// подробности выполненной проверки, возвращаемые DetailedCheckProvider.
+// если Severity не задана, то она определяется по Success: info для пройденной проверки, error - для не пройденной.
+type CheckDetails struct {
+	Message    string
+	Success    bool
+	Severity   Severity
+	Findings   []Finding
+	Attributes map[string]string
+}
+
+func (d CheckDetails) severity() Severity {
+	if d.Severity != "" {
+		return d.Severity
+	}
+	if d.Success {
+		return SeverityInfo
+	}
+	return SeverityError
+}
+
 func NewCheckResult(objectType, objectID, checkTypeName, result string, success bool) CheckResult {
 	return &checkResult{
 		ot:  objectType,
@@ -10,12 +50,78 @@ func NewCheckResult(objectType, objectID, checkTypeName, result string, success
 	}
 }
 
+// инстанциирует подробный результат проверки
+func NewDetailedCheckResult(objectType, objectID, checkTypeName string, d CheckDetails, duration time.Duration) DetailedCheckResult {
+	r := &checkResult{
+		ot:  objectType,
+		oid: objectID,
+		cn:  checkTypeName,
+	}
+	r.setDetails(d)
+	r.duration = duration
+	return r
+}
+
+// результат проверки данного заказа.
+// если заказ знает свой идентификатор (пришел в конверте), то он переносится в результат.
+// идентификатор корреляции и контекст трассировки заказа тоже переносятся в результат.
+func newOrderResult(o CheckOrder, result string, success bool) *checkResult {
+	r := &checkResult{
+		ot:  o.ObjectType(),
+		oid: o.ObjectIdentifier(),
+		cn:  o.CheckName(),
+		rm:  result,
+		cs:  success,
+	}
+	if oi, ok := o.(orderIdentified); ok {
+		r.orderID = oi.OrderID()
+	}
+	if mc, ok := o.(MetadataCarrier); ok {
+		r.correlationID = mc.CorrelationID()
+		r.trace = mc.TraceContext().NewChild()
+	}
+	return r
+}
+
 type checkResult struct {
-	ot  string
-	oid string
-	cn  string
-	rm  string
-	cs  bool
+	ot      string
+	oid     string
+	cn      string
+	rm      string
+	cs      bool
+	orderID string
+
+	correlationID string
+	trace         TraceContext
+
+	severity   Severity
+	findings   []Finding
+	duration   time.Duration
+	attributes map[string]string
+
+	// результат "timed out" процессора с таймаутами, а не самой проверки
+	timedOut bool
+}
+
+func (c *checkResult) setDetails(d CheckDetails) {
+	c.rm = d.Message
+	c.cs = d.Success
+	c.severity = d.severity()
+	c.findings = d.Findings
+	c.attributes = d.Attributes
+}
+
+func (c *checkResult) OrderID() string {
+	return c.orderID
+}
+
+func (c *checkResult) CorrelationID() string {
+	return c.correlationID
+}
+
+// контекст трассировки результата: trace-id заказа с новым parent-id
+func (c *checkResult) TraceContext() TraceContext {
+	return c.trace
 }
 
 func (c *checkResult) ObjectType() string {
@@ -37,3 +143,20 @@ func (c *checkResult) ResultMessage() string {
 func (c *checkResult) CheckSuccess() bool {
 	return c.cs
 }
+
+// для результатов CheckProvider важность не задается
+func (c *checkResult) Severity() Severity {
+	return c.severity
+}
+
+func (c *checkResult) Findings() []Finding {
+	return c.findings
+}
+
+func (c *checkResult) Duration() time.Duration {
+	return c.duration
+}
+
+func (c *checkResult) Attributes() map[string]string {
+	return c.attributes
+}
@@ -0,0 +1,466 @@
+package reactivetools
+
+import (
+	"context"
+	"fmt"
+	"github.com/iddqdeika/reactivetools/statistic"
+	"github.com/iddqdeika/rrr"
+	"github.com/iddqdeika/rrr/helpful"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// в этом разделе конфига можно переопределить настройки отдельного маршрута:
+	// "routes": {"<object_type>": {"<check_name>": {"parallelism": 4}}}
+	RoutesConfigKey = "routes"
+
+	// очередь маршрута: сколько его заказов маршрутизатор передает сверх параллелизма маршрута,
+	// не дожидаясь их обработки: "route_queue_size": 1000.
+	// пока маршрут не берет заказы (например, разомкнут его предохранитель), они копятся в его очереди,
+	// а остальные маршруты получают свои. чтение приостанавливается для всех, только когда очередь заполнена.
+	RouteQueueSizeConfigKey = "route_queue_size"
+
+	defaultRouteQueueSize = 1000
+)
+
+// маршрут проверки.
+// заказ попадает в маршрут, если совпадают тип объекта и название проверки.
+type CheckRoute struct {
+	ObjectType string
+	CheckName  string
+}
+
+func (r CheckRoute) String() string {
+	return r.ObjectType + "/" + r.CheckName
+}
+
+func (r CheckRoute) description() string {
+	return fmt.Sprintf("\"%v\" (object type: %v)", r.CheckName, r.ObjectType)
+}
+
+// обязательные ключи конфига NewKafkaRoutingCheckService
+var kafkaRoutingCheckServiceRequiredKeys = []string{
+	"parallelism",
+	configKey(CheckOrderProviderConfigKey, ConfigOrderTopicNameKey),
+	configKey(CheckOrderProviderConfigKey, kafkaConfigKey),
+	configKey(CheckResultPublisherConfigKey, ConfigResultsTopicNameKey),
+	configKey(CheckResultPublisherConfigKey, kafkaConfigKey),
+	configKey(StatisticServiceConfigKey, "port"),
+}
+
+// инстанциирует сервис, выполняющий сразу несколько проверок в одном процессе.
+// заказы читаются из одного топика (одной группой потребителей) и направляются в CheckProvider
+// по типу объекта и названию проверки. заказы, для которых маршрут не задан - пропускаются.
+// у каждого маршрута свой параллелизм (по умолчанию - общий parallelism из конфига) и свои статистики.
+func NewKafkaRoutingCheckService(cfg helpful.Config, l helpful.Logger, providers map[CheckRoute]CheckProvider) (CheckService, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("must be not-nil Config")
+	}
+	if l == nil {
+		return nil, fmt.Errorf("must be not-nil Logger")
+	}
+	if len(providers) == 0 {
+		return nil, fmt.Errorf("must be at least one CheckProvider")
+	}
+	err := RequireConfigKeys(cfg, kafkaRoutingCheckServiceRequiredKeys...)
+	if err != nil {
+		return nil, err
+	}
+
+	checkNames := make([]string, 0, len(providers))
+	for r := range providers {
+		checkNames = append(checkNames, r.CheckName)
+	}
+	// ограничители частоты общие для всех маршрутов, так что именованный ограничитель разделяется между проверками
+	limits, err := rateLimitsFromConfig(cfg, checkNames...)
+	if err != nil {
+		return nil, err
+	}
+
+	// хранилище кэша результатов общее для всех маршрутов
+	cache, err := resultCacheFromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	routes := make([]CheckRoute, 0, len(providers))
+	processors := make(map[CheckRoute]CheckOrderProcessor, len(providers))
+	breakers := make(map[CheckRoute]*circuitBreaker)
+	for r, p := range providers {
+		proc, err := NewCheckOrderProcessor(p)
+		if err != nil {
+			return nil, fmt.Errorf("cant create processor for route %v: %v", r, err)
+		}
+		proc, err = timeoutProcessorFromConfig(cfg, componentLogger(l, LogComponentProcessor), proc, r.CheckName)
+		if err != nil {
+			return nil, fmt.Errorf("cant create processor for route %v: %v", r, err)
+		}
+		proc = limits.wrap(proc, r.CheckName)
+		proc = cache.wrap(proc, componentLogger(l, LogComponentProcessor), "check "+r.description())
+		// у каждого маршрута свой предохранитель. пока он разомкнут, заказы маршрута копятся в его очереди
+		// (route_queue_size), а остальные маршруты продолжают получать заказы.
+		cb, err := circuitBreakerFromConfig(cfg, "processor of check "+r.description(), componentLogger(l, LogComponentProcessor))
+		if err != nil {
+			return nil, err
+		}
+		if cb != nil {
+			proc = &breakerProcessor{proc: proc, cb: cb}
+			breakers[r] = cb
+		}
+		routes = append(routes, r)
+		processors[r] = proc
+	}
+
+	// соберем провайдера
+	prov, err := NewKafkaRoutingOrderProvider(cfg.Child(CheckOrderProviderConfigKey), componentLogger(l, LogComponentProvider), routes...)
+	if err != nil {
+		return nil, err
+	}
+
+	// соберем паблишер
+	pub, err := NewKafkaResultPublisher(cfg.Child(CheckResultPublisherConfigKey), componentLogger(l, LogComponentPublisher))
+	if err != nil {
+		return nil, err
+	}
+	pub, pubBreaker, err := publisherFromConfig(cfg, componentLogger(l, LogComponentPublisher), pub)
+	if err != nil {
+		return nil, err
+	}
+
+	// если задан - соберем публикатор "мертвых" заказов
+	dl, err := deadLetterPublisherFromConfig(cfg, componentLogger(l, LogComponentDeadLetter))
+	if err != nil {
+		return nil, err
+	}
+
+	rs, err := newRoutingCheckService(cfg, componentLogger(l, LogComponentService), prov, processors, pub, dl)
+	if err != nil {
+		return nil, err
+	}
+	// предохранитель публикатора общий, поэтому приостанавливает весь маршрутизатор, а не отдельные маршруты
+	rs.breakers = circuitBreakers(pubBreaker)
+	if cache != nil {
+		rs.closers = append(rs.closers, cache)
+	}
+	if c, ok := pub.(io.Closer); ok {
+		rs.closers = append(rs.closers, c)
+	}
+	if c, ok := prov.(io.Closer); ok {
+		rs.closers = append(rs.closers, c)
+	}
+	for r, cb := range breakers {
+		rs.routes[r].service.breakers = circuitBreakers(cb)
+	}
+	limiters := make(map[string]*adaptiveLimiter)
+	for _, r := range rs.routes {
+		for name, cl := range r.service.concurrencyLimiters() {
+			limiters[name] = cl
+		}
+	}
+	rs.services, err = newStatisticServices(cfg, l, rs, rs, concurrencyEndpoints(limiters)...)
+	if err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+// инстанциирует маршрутизирующий сервис проверки с данными компонентами.
+// процессоры задаются по маршрутам, паблишер общий.
+func NewRoutingCheckService(cfg helpful.Config, l helpful.Logger,
+	prov CheckOrderProvider, processors map[CheckRoute]CheckOrderProcessor,
+	pub CheckResultPublisher, services ...rrr.Service) (CheckService, error) {
+
+	rs, err := newRoutingCheckService(cfg, l, prov, processors, pub, nil)
+	if err != nil {
+		return nil, err
+	}
+	rs.services = services
+	return rs, nil
+}
+
+func newRoutingCheckService(cfg helpful.Config, l helpful.Logger,
+	prov CheckOrderProvider, processors map[CheckRoute]CheckOrderProcessor,
+	pub CheckResultPublisher, dl DeadLetterPublisher) (*routingCheckService, error) {
+
+	if cfg == nil {
+		return nil, fmt.Errorf("must be not-nil config")
+	}
+	if l == nil {
+		return nil, fmt.Errorf("must be not-nil logger")
+	}
+	if prov == nil {
+		return nil, fmt.Errorf("must be not-nil provider")
+	}
+	if len(processors) == 0 {
+		return nil, fmt.Errorf("must be at least one processor")
+	}
+	if pub == nil {
+		return nil, fmt.Errorf("must be not-nil publisher")
+	}
+
+	parallelism, err := cfg.GetInt("parallelism")
+	if err != nil {
+		return nil, err
+	}
+	drainTimeout, err := drainTimeoutFromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	queueSize, err := optionalInt(cfg, RouteQueueSizeConfigKey, defaultRouteQueueSize)
+	if err != nil {
+		return nil, err
+	}
+	if queueSize < 0 {
+		return nil, fmt.Errorf("%v must not be negative", RouteQueueSizeConfigKey)
+	}
+
+	rs := &routingCheckService{
+		l:            l,
+		provider:     prov,
+		publisher:    pub,
+		routes:       make(map[CheckRoute]*checkRoute, len(processors)),
+		skipped:      statistic.NewCounter("Orders skipped", `Кол-во заказов, для которых не задан маршрут.`),
+		commits:      providerCommitManager(prov, l),
+		drainTimeout: drainTimeout,
+	}
+	for r, proc := range processors {
+		if proc == nil {
+			return nil, fmt.Errorf("must be not-nil processor for route %v", r)
+		}
+		p, err := routeParallelism(cfg, r, parallelism)
+		if err != nil {
+			return nil, fmt.Errorf("cant get parallelism for route %v: %v", r, err)
+		}
+		subject := "check " + r.description()
+		rp := &routeOrderProvider{ch: make(chan CheckOrder, p+queueSize), subject: subject}
+		route := &checkRoute{
+			route:    r,
+			provider: rp,
+			service:  newCheckService(l, rp, proc, pub, p, subject),
+		}
+		err = route.service.configure(cfg)
+		if err != nil {
+			return nil, err
+		}
+		err = requireDeadLetterPublisher(route.service.retry, dl)
+		if err != nil {
+			return nil, err
+		}
+		route.service.deadLetters = dl
+		route.service.commits = rs.commits
+		route.service.tracksOrders = false
+		rp.stats = route.service
+		rs.routes[r] = route
+	}
+	return rs, nil
+}
+
+// параллелизм маршрута.
+// если для маршрута он не задан в разделе routes, то используется общий.
+func routeParallelism(cfg helpful.Config, r CheckRoute, def int) (int, error) {
+	if !cfg.Contains(RoutesConfigKey) {
+		return def, nil
+	}
+	routes := cfg.Child(RoutesConfigKey)
+	if !routes.Contains(r.ObjectType) {
+		return def, nil
+	}
+	objectType := routes.Child(r.ObjectType)
+	if !objectType.Contains(r.CheckName) {
+		return def, nil
+	}
+	rc := objectType.Child(r.CheckName)
+	if !rc.Contains("parallelism") {
+		return def, nil
+	}
+	p, err := rc.GetInt("parallelism")
+	if err != nil {
+		return 0, err
+	}
+	if p < 1 {
+		return 0, fmt.Errorf("parallelism must be positive")
+	}
+	return p, nil
+}
+
+// маршрутизирующий сервис проверки.
+// берет заказы из общего провайдера и раздает их сервисам проверки отдельных маршрутов.
+type routingCheckService struct {
+	l helpful.Logger
+
+	provider  CheckOrderProvider
+	publisher CheckResultPublisher
+	routes    map[CheckRoute]*checkRoute
+	skipped   *statistic.Counter
+
+	// общий для всех маршрутов менеджер подтверждений:
+	// оффсет не будет подтвержден, пока не завершены все более ранние заказы всех маршрутов
+	commits *commitManager
+
+	drainTimeout time.Duration
+
+	// общие предохранители (публикатора): пока какой-либо из них разомкнут, новые заказы не получаются
+	breakers []*circuitBreaker
+	// ресурсы компонент (файлы кэша результатов и outbox, группа потребителей), закрываются после остановки сервиса
+	closers []io.Closer
+
+	services []rrr.Service
+}
+
+type checkRoute struct {
+	route    CheckRoute
+	provider *routeOrderProvider
+	service  *checkService
+}
+
+func (s *routingCheckService) Run(ctx context.Context) error {
+	var services []rrr.Service
+	services = append(services, &serviceSurrogate{callback: s.run})
+	// провайдер и публикатор (например, outbox), умеющие работать с контекстом, запускаем вместе с сервисом
+	if ps, ok := s.provider.(rrr.Service); ok {
+		services = append(services, ps)
+	}
+	if ps, ok := s.publisher.(rrr.Service); ok {
+		services = append(services, ps)
+	}
+	services = append(services, s.services...)
+	errs := rrr.RunServices(ctx, services...)
+	return rrr.ComposeErrors("RoutingCheckService", errs...)
+}
+
+func (s *routingCheckService) run(ctx context.Context) error {
+	// при плавной остановке маршруты сами дожидаются своих заказов после закрытия их каналов
+	rctx, cancel := pipelineContext(ctx, s.drainTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, r := range s.sortedRoutes() {
+		wg.Add(1)
+		go func(r *checkRoute) {
+			defer wg.Done()
+			r.service.run(rctx)
+		}(r)
+	}
+
+	s.l.Infof("routing service started with %v routes", len(s.routes))
+	s.receive(ctx)
+
+	// закрываем каналы маршрутов, чтобы их сервисы тоже завершились
+	for _, r := range s.routes {
+		close(r.provider.ch)
+	}
+	if s.drainTimeout > 0 {
+		wg.Wait()
+		s.commits.nackPending()
+	}
+	return nil
+}
+
+func (s *routingCheckService) receive(ctx context.Context) {
+	for {
+		if !waitCircuitBreakers(ctx, s.l, s.breakers) {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case o, opened := <-s.provider.OrderChan():
+			if !opened {
+				s.l.Infof("provider's order chan was closed, finishing")
+				return
+			}
+			s.commits.track(o)
+			s.route(ctx, o)
+		}
+	}
+}
+
+func (s *routingCheckService) route(ctx context.Context, o CheckOrder) {
+	r, ok := s.routes[CheckRoute{ObjectType: o.ObjectType(), CheckName: o.CheckName()}]
+	if !ok {
+		s.skipped.Inc()
+		s.commits.complete(ctx, o)
+		return
+	}
+	select {
+	case r.provider.ch <- o:
+		return
+	default:
+	}
+	// очередь маршрута заполнена: пока маршрут не возьмет заказ, остальные маршруты ждут вместе с ним
+	logWarnf(s.l, "queue of route %v is full, consumption paused", r.route)
+	select {
+	case r.provider.ch <- o:
+	case <-ctx.Done():
+	}
+}
+
+func (s *routingCheckService) sortedRoutes() []*checkRoute {
+	res := make([]*checkRoute, 0, len(s.routes))
+	for _, r := range s.routes {
+		res = append(res, r)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].route.String() < res[j].route.String()
+	})
+	return res
+}
+
+// закрывает ресурсы компонент. вызывается после остановки сервиса (Release рута).
+func (s *routingCheckService) Close() error {
+	return closeAll(s.closers)
+}
+
+// статистики провайдера, всех маршрутов (с меткой маршрута), общего публикатора и подтверждений
+func (s *routingCheckService) Statistics() ([]statistic.Statistic, error) {
+	ps := statistic.NewCompositeProvider().AddNamed(LogComponentProvider, s.provider)
+	for _, r := range s.sortedRoutes() {
+		ps.Add(statistic.NewCompositeProvider(r.provider).
+			WithLabels(map[string]string{statisticLabelRoute: r.route.String()}))
+	}
+	if sp, ok := s.publisher.(statistic.StatisticProvider); ok {
+		ps.AddNamed(LogComponentPublisher, sp)
+	}
+	for _, cb := range s.breakers {
+		ps.AddNamed(statisticComponentCircuitBreaker, cb)
+	}
+	ps.AddNamed(statisticComponentCommits, s.commits)
+	ss, err := ps.Statistics()
+	if err != nil {
+		return nil, err
+	}
+	return append(ss, s.skipped), nil
+}
+
+// проверки здоровья общего провайдера и компонент всех маршрутов
+func (s *routingCheckService) HealthChecks() []statistic.HealthCheck {
+	res := componentHealthChecks(s.provider)
+	for _, r := range s.sortedRoutes() {
+		res = append(res, r.service.HealthChecks()...)
+	}
+	return res
+}
+
+// провайдер заказов отдельного маршрута.
+// получает заказы от маршрутизирующего сервиса, канал - очередь маршрута.
+type routeOrderProvider struct {
+	ch      chan CheckOrder
+	subject string
+	stats   statistic.StatisticProvider
+}
+
+func (p *routeOrderProvider) OrderChan() chan CheckOrder {
+	return p.ch
+}
+
+// статистики сервиса маршрута и размер его очереди
+func (p *routeOrderProvider) Statistics() ([]statistic.Statistic, error) {
+	ss, err := p.stats.Statistics()
+	if err != nil {
+		return nil, err
+	}
+	return append(ss, statistic.NewGaugeValue("Orders queued for "+p.subject,
+		`Кол-во заказов маршрута, переданных маршрутизатором, но еще не взятых в обработку.`, float64(len(p.ch)))), nil
+}
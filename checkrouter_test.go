@@ -0,0 +1,225 @@
+package reactivetools
+
+import (
+	"context"
+	"errors"
+	"github.com/iddqdeika/rrr/helpful"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// заказ заглушки для данного маршрута
+type routedStubOrder struct {
+	*stubCheckOrder
+	route CheckRoute
+}
+
+func newRoutedStubOrder(offset int64, r CheckRoute, ack func(offset int64)) CheckOrder {
+	return &routedStubOrder{stubCheckOrder: newStubCheckOrder(offset, ack).(*stubCheckOrder), route: r}
+}
+
+func (o *routedStubOrder) ObjectType() string {
+	return o.route.ObjectType
+}
+
+func (o *routedStubOrder) CheckName() string {
+	return o.route.CheckName
+}
+
+// проверка, запоминающая оффсеты проверенных заказов
+type recordingCheckProvider struct {
+	delay time.Duration
+
+	m       sync.Mutex
+	checked []int64
+}
+
+func (p *recordingCheckProvider) PerformCheck(ctx context.Context, o CheckOrder) (msg string, success bool, err error) {
+	select {
+	case <-ctx.Done():
+		return "", false, ctx.Err()
+	case <-time.After(p.delay):
+	}
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.checked = append(p.checked, o.(OffsetCarrier).Offset())
+	return "recorded", true, nil
+}
+
+func (p *recordingCheckProvider) checkedOffsets() []int64 {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return append([]int64(nil), p.checked...)
+}
+
+func newTestRoutingService(t *testing.T, prov CheckOrderProvider, processors map[CheckRoute]CheckOrderProcessor) *routingCheckService {
+	cfg, err := helpful.NewJsonCfg("config/routing_service_cfg_test.json")
+	if err != nil {
+		t.Fatalf("cant create config for test: %v", err)
+	}
+	rs, err := newRoutingCheckService(cfg, helpful.DefaultLogger.WithLevel(helpful.LogNone), prov, processors, NewStubResultPublisher(), nil)
+	if err != nil {
+		t.Fatalf("cant create routing service: %v", err)
+	}
+	return rs
+}
+
+func waitOffsets(t *testing.T, what string, get func() []int64, count int) []int64 {
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		offsets := get()
+		if len(offsets) >= count {
+			return offsets
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %v %v orders, got %v", count, what, offsets)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+// ждет подтверждения оффсета last. оффсеты должны подтверждаться по возрастанию.
+func waitAcked(t *testing.T, prov *stubOrderProvider, last int64) {
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		acked := prov.ackedOffsets()
+		if len(acked) > 0 && acked[len(acked)-1] == last {
+			for i := 1; i < len(acked); i++ {
+				if acked[i] <= acked[i-1] {
+					t.Fatalf("offsets must be acked in increasing order, got %v", acked)
+				}
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("offset %v was not acked in time, acked: %v", last, acked)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestRoutingServiceRouteWithOpenBreaker(t *testing.T) {
+	l := helpful.DefaultLogger.WithLevel(helpful.LogNone)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	blocked := CheckRoute{ObjectType: "product", CheckName: "images"}
+	flowing := CheckRoute{ObjectType: "product", CheckName: "prices"}
+
+	// предохранитель маршрута blocked разомкнут надолго: его заказы ждут в процессоре и в очереди маршрута
+	cb := newCircuitBreaker("processor", CircuitBreakerSettings{
+		FailureThreshold: 1,
+		OpenTimeout:      time.Hour,
+		HalfOpenProbes:   1,
+	}, l)
+	blockedProc := &breakerProcessor{proc: &errorProcessor{err: errors.New("unavailable")}, cb: cb}
+	if err := blockedProc.Process(ctx, newStubCheckOrder(0, nil)); err == nil || cb.currentState() != CircuitOpen {
+		t.Fatalf("expected open breaker, got %v, %v", err, cb.currentState())
+	}
+	checks := &recordingCheckProvider{}
+	flowingProc, err := NewCheckOrderProcessor(checks)
+	if err != nil {
+		t.Fatalf("cant create check order processor: %v", err)
+	}
+
+	// заказы blocked занимают слот маршрута (parallelism 1), ожидающий слота заказ в сервисе маршрута
+	// и его канал (parallelism + route_queue_size 2)
+	prov := &stubOrderProvider{ch: make(chan CheckOrder, 10)}
+	for i := 0; i < 5; i++ {
+		prov.ch <- newRoutedStubOrder(int64(i), blocked, prov.ack)
+	}
+	for i := 5; i < 10; i++ {
+		prov.ch <- newRoutedStubOrder(int64(i), flowing, prov.ack)
+	}
+
+	rs := newTestRoutingService(t, prov, map[CheckRoute]CheckOrderProcessor{blocked: blockedProc, flowing: flowingProc})
+	go rs.run(ctx)
+
+	checked := waitOffsets(t, "checked", checks.checkedOffsets, 5)
+	for _, offset := range checked {
+		if offset < 5 {
+			t.Fatalf("orders of blocked route must not be checked, got %v", checked)
+		}
+	}
+	// подтверждения ждут заказов маршрута blocked, предшествующих в партиции
+	if acked := prov.ackedOffsets(); len(acked) != 0 {
+		t.Fatalf("orders must not be acked before earlier orders of blocked route, acked: %v", acked)
+	}
+}
+
+func TestRoutingServiceRoutesOrders(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	images := CheckRoute{ObjectType: "product", CheckName: "images"}
+	prices := CheckRoute{ObjectType: "product", CheckName: "prices"}
+	// та же проверка для другого типа объектов - маршрут не задан
+	unrouted := CheckRoute{ObjectType: "category", CheckName: "images"}
+
+	imageChecks, priceChecks := &recordingCheckProvider{}, &recordingCheckProvider{}
+	imagesProc, err := NewCheckOrderProcessor(imageChecks)
+	if err != nil {
+		t.Fatalf("cant create check order processor: %v", err)
+	}
+	pricesProc, err := NewCheckOrderProcessor(priceChecks)
+	if err != nil {
+		t.Fatalf("cant create check order processor: %v", err)
+	}
+
+	prov := &stubOrderProvider{ch: make(chan CheckOrder, 6)}
+	for i, r := range []CheckRoute{images, prices, unrouted, images, prices, unrouted} {
+		prov.ch <- newRoutedStubOrder(int64(i), r, prov.ack)
+	}
+	close(prov.ch)
+
+	rs := newTestRoutingService(t, prov, map[CheckRoute]CheckOrderProcessor{images: imagesProc, prices: pricesProc})
+	go rs.run(ctx)
+
+	// незамаршрутизированные заказы подтверждаются без обработки
+	waitAcked(t, prov, 5)
+	if checked := imageChecks.checkedOffsets(); !reflect.DeepEqual(checked, []int64{0, 3}) {
+		t.Errorf("expected orders 0 and 3 to be checked by images route, got %v", checked)
+	}
+	if checked := priceChecks.checkedOffsets(); !reflect.DeepEqual(checked, []int64{1, 4}) {
+		t.Errorf("expected orders 1 and 4 to be checked by prices route, got %v", checked)
+	}
+	if rs.skipped.Get() != 2 {
+		t.Errorf("expected 2 skipped orders, got %v", rs.skipped.Get())
+	}
+}
+
+func TestRoutingServiceOrderedAcks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	slow := CheckRoute{ObjectType: "product", CheckName: "images"}
+	fast := CheckRoute{ObjectType: "product", CheckName: "prices"}
+	slowChecks, fastChecks := &recordingCheckProvider{delay: time.Millisecond * 100}, &recordingCheckProvider{}
+	slowProc, err := NewCheckOrderProcessor(slowChecks)
+	if err != nil {
+		t.Fatalf("cant create check order processor: %v", err)
+	}
+	fastProc, err := NewCheckOrderProcessor(fastChecks)
+	if err != nil {
+		t.Fatalf("cant create check order processor: %v", err)
+	}
+
+	// первый заказ обрабатывается медленным маршрутом, следующие - быстрым, последний не маршрутизирован
+	prov := &stubOrderProvider{ch: make(chan CheckOrder, 6)}
+	prov.ch <- newRoutedStubOrder(0, slow, prov.ack)
+	for i := 1; i < 5; i++ {
+		prov.ch <- newRoutedStubOrder(int64(i), fast, prov.ack)
+	}
+	prov.ch <- newRoutedStubOrder(5, CheckRoute{ObjectType: "category", CheckName: "images"}, prov.ack)
+
+	rs := newTestRoutingService(t, prov, map[CheckRoute]CheckOrderProcessor{slow: slowProc, fast: fastProc})
+	go rs.run(ctx)
+
+	waitOffsets(t, "checked", fastChecks.checkedOffsets, 4)
+	if acked := prov.ackedOffsets(); len(acked) != 0 {
+		t.Fatalf("orders of fast route must not be acked before earlier order of slow route, acked: %v", acked)
+	}
+	waitAcked(t, prov, 5)
+}
@@ -2,17 +2,24 @@ package reactivetools
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	kafkaadapt "github.com/iddqdeika/kafka-adapter"
 	"github.com/iddqdeika/reactivetools/statistic"
 	"github.com/iddqdeika/rrr"
 	"github.com/iddqdeika/rrr/helpful"
+	"io"
+	"sync"
 	"time"
 )
 
 const (
 	processRetryInterval = time.Second * 5
 
+	// если задан, то сервис останавливается плавно: перестает брать новые заказы,
+	// дожидается завершения начатых (не дольше таймаута), а незавершенные - отклоняет (Nack)
+	DrainTimeoutConfigKey = "drain_timeout_in_secs"
+
 	CheckOrderProviderConfigKey   = "check_order_provider"
 	CheckResultPublisherConfigKey = "check_result_publisher"
 	StatisticServiceConfigKey     = "statistics"
@@ -32,22 +39,198 @@ func NewKafkaCheckService(cfg helpful.Config, l helpful.Logger, p CheckProvider)
 	if p == nil {
 		return nil, fmt.Errorf("must be not-nil CheckProvider")
 	}
+	return newKafkaCheckService(cfg, l, func(string) (CheckOrderProcessor, error) {
+		return NewCheckOrderProcessor(p)
+	})
+}
+
+// инстанциирует сервис проверки с пакетной функцией-обработчиком.
+// заказы накапливаются в пакеты согласно разделу batch конфига (max_size, linger_in_ms, в том числе по проверкам),
+// без него каждый заказ проверяется отдельным пакетом. в остальном - как NewKafkaCheckService.
+func NewKafkaBatchCheckService(cfg helpful.Config, l helpful.Logger, p BatchCheckProvider) (CheckService, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("must be not-nil Config")
+	}
+	if l == nil {
+		return nil, fmt.Errorf("must be not-nil Logger")
+	}
+	if p == nil {
+		return nil, fmt.Errorf("must be not-nil BatchCheckProvider")
+	}
+	return newKafkaCheckService(cfg, l, func(checkName string) (CheckOrderProcessor, error) {
+		return batchProcessorFromConfig(cfg, componentLogger(l, LogComponentProcessor), p, checkName)
+	})
+}
+
+// собирает сервис проверки из конфига. newProcessor собирает процессор для проверки с данным названием.
+func newKafkaCheckService(cfg helpful.Config, l helpful.Logger,
+	newProcessor func(checkName string) (CheckOrderProcessor, error)) (CheckService, error) {
+
+	err := ValidateKafkaCheckServiceConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	checkName, err := cfg.Child(CheckOrderProviderConfigKey).GetString(ConfigCheckNameKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// соберем процессор с данной функцией-обработчиком
+	proc, err := newProcessor(checkName)
+	if err != nil {
+		return nil, err
+	}
+	// если задан - результаты берутся из кэша
+	cache, err := resultCacheFromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
 
 	// соберем провайдера
-	prov, err := NewKafkaOrderProvider(cfg.Child(CheckOrderProviderConfigKey), l)
+	prov, err := NewKafkaOrderProvider(cfg.Child(CheckOrderProviderConfigKey), componentLogger(l, LogComponentProvider))
+	if err != nil {
+		return nil, err
+	}
+
+	// если задан - ограничим время проверки
+	proc, err = timeoutProcessorFromConfig(cfg, componentLogger(l, LogComponentProcessor), proc, checkName)
+	if err != nil {
+		return nil, err
+	}
+	// если задано - ограничим частоту проверок (снаружи таймаута, чтобы ожидание не превращалось в таймаут)
+	limits, err := rateLimitsFromConfig(cfg, checkName)
+	if err != nil {
+		return nil, err
+	}
+	proc = limits.wrap(proc, checkName)
+	// кэш снаружи ограничителя и таймаута: результат из кэша не ждет разрешения и не расходует токен
+	proc = cache.wrap(proc, componentLogger(l, LogComponentProcessor), "")
+	// если задан - предохранитель функции проверки (снаружи таймаута, чтобы таймауты считались ошибками)
+	procBreaker, err := circuitBreakerFromConfig(cfg, "processor", componentLogger(l, LogComponentProcessor))
+	if err != nil {
+		return nil, err
+	}
+	if procBreaker != nil {
+		proc = &breakerProcessor{proc: proc, cb: procBreaker}
+	}
+
+	// соберем паблишер
+	pub, err := NewKafkaResultPublisher(cfg.Child(CheckResultPublisherConfigKey), componentLogger(l, LogComponentPublisher))
+	if err != nil {
+		return nil, err
+	}
+	pub, pubBreaker, err := publisherFromConfig(cfg, componentLogger(l, LogComponentPublisher), pub)
+	if err != nil {
+		return nil, err
+	}
+
+	// если задан - соберем публикатор "мертвых" заказов
+	dl, err := deadLetterPublisherFromConfig(cfg, componentLogger(l, LogComponentDeadLetter))
+	if err != nil {
+		return nil, err
+	}
+
+	// собираем сам сервис
+	parallelism, err := cfg.GetInt("parallelism")
+	if err != nil {
+		return nil, err
+	}
+	cs := newCheckService(componentLogger(l, LogComponentService), prov, proc, pub, parallelism, "")
+	err = cs.configure(cfg)
 	if err != nil {
 		return nil, err
 	}
+	cs.deadLetters = dl
+	cs.breakers = circuitBreakers(procBreaker, pubBreaker)
+	if cache != nil {
+		cs.closers = append(cs.closers, cache)
+	}
+	if c, ok := pub.(io.Closer); ok {
+		cs.closers = append(cs.closers, c)
+	}
+	if c, ok := prov.(io.Closer); ok {
+		cs.closers = append(cs.closers, c)
+	}
 
+	// статистики отдаем и по провайдеру, и по самому сервису
+	cs.services, err = newStatisticServices(cfg, l, statistic.NewCompositeProvider().
+		AddNamed(LogComponentProvider, prov).AddNamed(LogComponentService, cs), cs,
+		concurrencyEndpoints(cs.concurrencyLimiters())...)
+	if err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+// оборачивает публикатор результатов согласно конфигу: предохранитель (если задан) и локальный outbox (если задан).
+// предохранитель стоит между outbox и кафка: пока он разомкнут, публикатор сразу возвращает ErrCircuitOpen
+// (а не ждет, как процессор), и повторяет публикацию сервис или ретранслятор outbox.
+// без outbox разомкнутый предохранитель приостанавливает получение заказов (результаты некуда деть).
+// outbox же принимает результаты и при недоступной кафка, поэтому с ним получение не приостанавливается (pauses = false),
+// а ретранслятор отправит накопленное после замыкания предохранителя.
+func publisherFromConfig(cfg helpful.Config, l helpful.Logger, pub CheckResultPublisher) (CheckResultPublisher, *circuitBreaker, error) {
+	cb, err := circuitBreakerFromConfig(cfg, "publisher", l)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cb != nil {
+		pub = &breakerPublisher{pub: pub, cb: cb}
+	}
+	// если задан - результаты сначала сохраняются в локальный outbox
+	pub, err = outboxFromConfig(cfg, l, pub)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, ok := pub.(*ResultOutbox); ok && cb != nil {
+		// результаты копятся в outbox, заказы подтверждаются - приостанавливать получение незачем
+		cb.pauses = false
+	}
+	return pub, cb, nil
+}
+
+// закрывает все ресурсы, даже если какие-то из них закрыть не удалось
+func closeAll(closers []io.Closer) error {
+	var errs []error
+	for _, c := range closers {
+		err := c.Close()
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return composeErrors(errs)
+}
+
+// заданные (не nil) предохранители
+func circuitBreakers(cbs ...*circuitBreaker) []*circuitBreaker {
+	var res []*circuitBreaker
+	for _, cb := range cbs {
+		if cb != nil {
+			res = append(res, cb)
+		}
+	}
+	return res
+}
+
+// собирает сервисы статистики: http сервис и, если в конфиге есть указание кафки, отправщик статистик.
+// http сервис отдает и проверки здоровья (/healthz, /readyz) данного hp, и дополнительные методы endpoints.
+func newStatisticServices(cfg helpful.Config, l helpful.Logger, sp statistic.StatisticProvider,
+	hp statistic.HealthCheckProvider, endpoints ...statistic.Endpoint) ([]rrr.Service, error) {
 	var services []rrr.Service
 
+	// статистики помечаются метками сервиса и экземпляра (host, instance_id)
+	labels, err := statistic.LabelsFromConfig(cfg.Child(StatisticServiceConfigKey))
+	if err != nil {
+		return nil, err
+	}
+	sp = statistic.NewCompositeProvider(sp).WithLabels(labels)
+
 	// если в конфиге есть указание кафки и отправщика статистик - то инициализируем отправку статистик туда
 	if cfg.Contains("statistic_sender") {
 		adapt, err := kafkaadapt.FromConfig(cfg.Child("statistic_sender"), l)
 		if err != nil {
 			return nil, err
 		}
-		sender, err := statistic.NewStatisticSender(l, cfg.Child("statistic_sender"), prov, adapt)
+		sender, err := statistic.NewStatisticSender(l, cfg.Child("statistic_sender"), sp, adapt)
 		if err != nil {
 			return nil, err
 		}
@@ -55,32 +238,28 @@ func NewKafkaCheckService(cfg helpful.Config, l helpful.Logger, p CheckProvider)
 	}
 
 	// статистик сервис
-	stats, err := statistic.NewStatisticService(cfg.Child(StatisticServiceConfigKey), prov, l)
+	endpoints = append(statistic.HealthEndpoints(hp), endpoints...)
+	stats, err := statistic.NewStatisticService(cfg.Child(StatisticServiceConfigKey), sp, l, endpoints...)
 	if err != nil {
 		return nil, err
 	}
 	services = append(services, stats)
-
-	// соберем процессор с данной функцией-обработчиком
-	proc, err := NewCheckOrderProcessor(p)
-	if err != nil {
-		return nil, err
-	}
-
-	// соберем паблишер
-	pub, err := NewKafkaResultPublisher(cfg.Child(CheckResultPublisherConfigKey), l)
-	if err != nil {
-		return nil, err
-	}
-
-	// собираем сам сервис
-	return NewCheckService(cfg, l, prov, proc, pub, services...)
+	return services, nil
 }
 
 // инстанциирует сервис проверки с данными компонентами.
 func NewCheckService(cfg helpful.Config, l helpful.Logger,
 	prov CheckOrderProvider, proc CheckOrderProcessor,
 	pub CheckResultPublisher, services ...rrr.Service) (CheckService, error) {
+	return NewCheckServiceWithDeadLetter(cfg, l, prov, proc, pub, nil, services...)
+}
+
+// инстанциирует сервис проверки с данными компонентами и публикатором "мертвых" заказов.
+// заказ, обработку которого не удалось завершить за отведенные политикой повторов (retry_policy) попытки,
+// публикуется в dl и подтверждается. если политика ограничивает попытки, то dl обязателен.
+func NewCheckServiceWithDeadLetter(cfg helpful.Config, l helpful.Logger,
+	prov CheckOrderProvider, proc CheckOrderProcessor,
+	pub CheckResultPublisher, dl DeadLetterPublisher, services ...rrr.Service) (CheckService, error) {
 
 	if cfg == nil {
 		return nil, fmt.Errorf("must be not-nil config")
@@ -103,20 +282,84 @@ func NewCheckService(cfg helpful.Config, l helpful.Logger,
 		return nil, err
 	}
 
-	cs := &checkService{
-		l:             l,
-		provider:      prov,
-		processor:     proc,
-		publisher:     pub,
-		services:      services,
-		balancer:      make(chan struct{}, parallelism),
-		processing:    make(chan CheckOrder, parallelism),
-		publishing:    make(chan CheckOrder, parallelism),
-		acknowledging: make(chan CheckOrder, parallelism),
+	cs := newCheckService(l, prov, proc, pub, parallelism, "")
+	err = cs.configure(cfg)
+	if err != nil {
+		return nil, err
+	}
+	err = requireDeadLetterPublisher(cs.retry, dl)
+	if err != nil {
+		return nil, err
 	}
+	cs.deadLetters = dl
+	cs.services = services
 	return cs, nil
 }
 
+// subject - описание того, что проверяет сервис (для статистик), может быть пустым.
+func newCheckService(l helpful.Logger, prov CheckOrderProvider, proc CheckOrderProcessor,
+	pub CheckResultPublisher, parallelism int, subject string) *checkService {
+	c := &checkService{
+		l:            l,
+		provider:     prov,
+		processor:    proc,
+		publisher:    pub,
+		stats:        newCheckStatistics(subject),
+		name:         subject,
+		retry:        DefaultRetryPolicy(),
+		commits:      providerCommitManager(prov, l),
+		tracksOrders: true,
+		balancer:     make(chan struct{}, parallelism),
+		processing:   make(chan CheckOrder, parallelism),
+	}
+	c.progress = newProgressTracker(c.subject(), 0, func() bool {
+		return c.stats.inFlight.Get() > 0
+	})
+	return c
+}
+
+// настройки сервиса из конфига, не зависящие от компонент: политика повторов, плавная остановка, контроль прогресса,
+// схлопывание повторных заказов, адаптивный параллелизм.
+func (c *checkService) configure(cfg helpful.Config) error {
+	retry, err := retryPolicyFromConfig(cfg)
+	if err != nil {
+		return err
+	}
+	drainTimeout, err := drainTimeoutFromConfig(cfg)
+	if err != nil {
+		return err
+	}
+	noProgress, err := noProgressTimeoutFromConfig(cfg)
+	if err != nil {
+		return err
+	}
+	dedup, err := dedupFromConfig(cfg)
+	if err != nil {
+		return err
+	}
+	concurrency, err := adaptiveLimiterFromConfig(cfg, cap(c.balancer), c.subject())
+	if err != nil {
+		return err
+	}
+	c.retry = retry
+	c.dedup = dedup
+	c.concurrency = concurrency
+	c.drainTimeout = drainTimeout
+	c.progress.timeout = noProgress
+	return nil
+}
+
+func drainTimeoutFromConfig(cfg helpful.Config) (time.Duration, error) {
+	secs, err := optionalInt(cfg, DrainTimeoutConfigKey, 0)
+	if err != nil {
+		return 0, err
+	}
+	if secs < 0 {
+		return 0, fmt.Errorf("%v must not be negative", DrainTimeoutConfigKey)
+	}
+	return time.Duration(secs) * time.Second, nil
+}
+
 type checkService struct {
 	l helpful.Logger
 
@@ -125,22 +368,99 @@ type checkService struct {
 	publisher CheckResultPublisher
 
 	services []rrr.Service
+	stats    *checkStatistics
+
+	retry       RetryPolicy
+	deadLetters DeadLetterPublisher
+
+	// схлопывание повторных заказов, nil - выключено
+	dedup *orderDeduplicator
+
+	// таймаут плавной остановки, 0 - остановка без ожидания
+	drainTimeout time.Duration
+	inFlight     sync.WaitGroup
 
-	balancer      chan struct{}
-	processing    chan CheckOrder
-	publishing    chan CheckOrder
-	acknowledging chan CheckOrder
+	// менеджер подтверждений может быть общим для нескольких сервисов (например, маршрутов),
+	// тогда заказы в нем регистрирует владелец, а не сам сервис (tracksOrders = false)
+	commits      *commitManager
+	tracksOrders bool
+
+	name     string
+	progress *progressTracker
+
+	balancer   chan struct{}
+	processing chan CheckOrder
+	// адаптивный предел параллелизма в пределах balancer, nil - параллелизм постоянный
+	concurrency *adaptiveLimiter
+	// предохранители: пока какой-либо из них разомкнут, новые заказы не получаются
+	breakers []*circuitBreaker
+	// ресурсы компонент (файлы кэша результатов и outbox, группа потребителей), закрываются после остановки сервиса
+	closers []io.Closer
 }
 
 func (c *checkService) Run(ctx context.Context) error {
 	// соберем сервисы для запуска (помимо самого сервиса проверок надо запустить, например, статистику, если она задана)
 	var services []rrr.Service
 	services = append(services, &serviceSurrogate{callback: c.run})
+	// провайдер и публикатор (например, outbox), умеющие работать с контекстом, запускаем вместе с сервисом
+	if s, ok := c.provider.(rrr.Service); ok {
+		services = append(services, s)
+	}
+	if s, ok := c.publisher.(rrr.Service); ok {
+		services = append(services, s)
+	}
 	services = append(services, c.services...)
 	errs := rrr.RunServices(ctx, services...)
 	return rrr.ComposeErrors("CheckService", errs...)
 }
 
+// закрывает ресурсы компонент. вызывается после остановки сервиса (Release рута).
+func (c *checkService) Close() error {
+	return closeAll(c.closers)
+}
+
+// статистики сервиса, процессора (если он их предоставляет) и подтверждений
+func (c *checkService) Statistics() ([]statistic.Statistic, error) {
+	ps := statistic.NewCompositeProvider().AddNamed(LogComponentService, c.stats)
+	if sp, ok := c.processor.(statistic.StatisticProvider); ok {
+		ps.AddNamed(LogComponentProcessor, sp)
+	}
+	if c.concurrency != nil {
+		ps.AddNamed(statisticComponentConcurrency, c.concurrency)
+	}
+	for _, cb := range c.breakers {
+		ps.AddNamed(statisticComponentCircuitBreaker, cb)
+	}
+	// общие менеджер подтверждений и публикатор учитывает их владелец
+	if c.tracksOrders {
+		ps.AddNamed(statisticComponentCommits, c.commits)
+		if sp, ok := c.publisher.(statistic.StatisticProvider); ok {
+			ps.AddNamed(LogComponentPublisher, sp)
+		}
+	}
+	return ps.Statistics()
+}
+
+// проверки здоровья компонент сервиса и отсутствия прогресса
+func (c *checkService) HealthChecks() []statistic.HealthCheck {
+	return componentHealthChecks(c.provider, c.processor, c.publisher, c.deadLetters, c.progress)
+}
+
+// адаптивные ограничители параллелизма по названию сервиса (для http метода)
+func (c *checkService) concurrencyLimiters() map[string]*adaptiveLimiter {
+	if c.concurrency == nil {
+		return nil
+	}
+	return map[string]*adaptiveLimiter{c.subject(): c.concurrency}
+}
+
+func (c *checkService) subject() string {
+	if c.name == "" {
+		return "orders"
+	}
+	return c.name
+}
+
 type serviceSurrogate struct {
 	callback func(ctx context.Context) error
 }
@@ -150,119 +470,212 @@ func (s *serviceSurrogate) Run(ctx context.Context) error {
 }
 
 func (c *checkService) run(ctx context.Context) error {
-	go c.handleProcessing(ctx)
-	go c.handlePublishing(ctx)
-	go c.handleAcknowledging(ctx)
+	pctx, cancel := pipelineContext(ctx, c.drainTimeout)
+	defer cancel()
+	go c.handleProcessing(pctx)
 	c.l.Infof("service started")
+	c.receive(ctx, pctx)
+	c.drain()
+	return nil
+}
+
+// контекст обработки.
+// при плавной остановке обработка должна пережить закрытие ctx, поэтому контекст от него не наследуется
+// и закрывается только по окончании плавной остановки.
+func pipelineContext(ctx context.Context, drainTimeout time.Duration) (context.Context, context.CancelFunc) {
+	if drainTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithCancel(context.Background())
+}
+
+// получает заказы до закрытия ctx или канала провайдера. pctx - контекст обработки.
+func (c *checkService) receive(ctx, pctx context.Context) {
 	for {
+		if !waitCircuitBreakers(ctx, c.l, c.breakers) {
+			return
+		}
 		select {
 		case <-ctx.Done():
-			return nil
+			return
 		case o, opened := <-c.provider.OrderChan():
 			if !opened {
 				c.l.Infof("provider's order chan was closed, finishing")
-				return nil
+				return
+			}
+			logDebugf(withLogFields(c.l, orderLogFields(o)), "got order %v for item %v", o.CheckName(), o.ObjectIdentifier())
+			c.stats.received.Inc()
+			if c.tracksOrders {
+				c.commits.track(o)
 			}
-			c.l.Infof("got order %v for item %v", o.CheckName(), o.ObjectIdentifier())
-			c.dispatch(ctx, o)
+			if c.dedup != nil && !c.dedup.admit(o) {
+				logDebugf(withLogFields(c.l, orderLogFields(o)), "order %v for item %v superseded by an earlier one", o.CheckName(), o.ObjectIdentifier())
+				c.stats.deduplicated.Inc()
+				continue
+			}
+			c.dispatch(ctx, pctx, o)
 		}
 	}
 }
 
-//берем из процессинга, ждем Result кладем в publishing публикуем результаты и закрываем Published
-func (c *checkService) handleProcessing(ctx context.Context) {
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case o := <-c.processing:
-			c.publishing <- o
-			go func() {
-				defer close(o.Published())
-				res := <-o.Result()
-				c.publish(res)
-				c.l.Infof("order %v for item %v published", o.CheckName(), o.ObjectIdentifier())
-			}()
-		}
+// плавная остановка: ждем завершения начатых заказов, не дольше таймаута.
+// все, что осталось неподтвержденным (не успело завершиться или не было начато) - отклоняем.
+func (c *checkService) drain() {
+	if c.drainTimeout <= 0 {
+		return
+	}
+	c.l.Infof("draining in-flight orders, timeout: %v", c.drainTimeout)
+	if waitTimeout(&c.inFlight, c.drainTimeout) {
+		c.l.Infof("all in-flight orders finished")
+	} else {
+		c.l.Errorf("drain timeout exceeded, unfinished orders will be nacked")
+	}
+	if c.tracksOrders {
+		c.commits.nackPending()
 	}
 }
 
-//берем из publishing, ждём закрытия Published и кладём в acknowledging
-func (c *checkService) handlePublishing(ctx context.Context) {
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case o := <-c.publishing:
-			<-o.Published()
-			c.acknowledging <- o
-		}
+// ждет группу не дольше таймаута. возвращает false, если таймаут истек.
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-done:
+		return true
+	case <-t.C:
+		return false
 	}
 }
 
-func (c *checkService) handleAcknowledging(ctx context.Context) {
+//берем из процессинга, ждем Result, публикуем результаты, закрываем Published и отдаем заказ на подтверждение.
+//заказы завершаются в любом порядке, менеджер подтверждений сам подтвердит их по порядку.
+func (c *checkService) handleProcessing(ctx context.Context) {
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case o := <-c.acknowledging:
-			o = lastOrDefaultOrder(o, c.acknowledging)
-			for {
-				err := o.Ack() //удалить когда adapter сможет в паралеллизм
-				if err != nil {
-					c.l.Errorf("cant ack published order, waiting 100ms, err: %v", err)
-					time.Sleep(time.Millisecond * 100)
-				} else {
-					break
+		case o := <-c.processing:
+			go func() {
+				defer c.inFlight.Done()
+				var res CheckResult
+				select {
+				case res = <-o.Result():
+				case <-ctx.Done():
+					return
 				}
-			}
+				if !c.publish(ctx, res) {
+					// остановка: заказ не подтверждается и будет получен снова
+					return
+				}
+				withLogFields(c.l, orderLogFields(o)).Infof("order %v for item %v published", o.CheckName(), o.ObjectIdentifier())
+				close(o.Published())
+				c.commits.complete(ctx, o)
+				c.completeSuperseded(ctx, o)
+				c.progress.touch()
+			}()
 		}
 	}
 }
 
-func lastOrDefaultOrder(o CheckOrder, ch chan CheckOrder) CheckOrder {
-	for {
-		select {
-		case o = <-ch:
-			continue
-		default:
-			return o
-		}
+// заказы, схлопнутые в опубликованный заказ o, завершаются вместе с ним
+func (c *checkService) completeSuperseded(ctx context.Context, o CheckOrder) {
+	if c.dedup == nil {
+		return
+	}
+	for _, s := range c.dedup.release(o) {
+		close(s.Published())
+		c.commits.complete(ctx, s)
 	}
 }
 
-func (c *checkService) publish(res CheckResult) {
-	for {
+// публикует результат, повторяя попытки с интервалами политики повторов до закрытия контекста.
+// ограничения попыток политики не учитываются: результат нельзя потерять, подтвердив заказ.
+// возвращает false, если результат так и не опубликован.
+func (c *checkService) publish(ctx context.Context, res CheckResult) bool {
+	// результат пропущен - публиковать нечего
+	if res == nil {
+		return true
+	}
+	defer c.stats.publishLatency.ObserveSince(time.Now())
+	retry := c.retry
+	retry.MaxAttempts = 0
+	retry.MaxElapsedTime = 0
+	_, err := retry.Do(ctx, func(attempt int) error {
 		err := c.publisher.PublishCheckResult(res)
-		if err == nil {
-			return
+		if errors.Is(err, ErrCircuitOpen) {
+			// о размыкании пишет сам предохранитель
+			logDebugf(c.l, "cant publish check result (attempt %v): %v", attempt, err)
+		} else if err != nil {
+			c.l.Errorf("cant publish check result (attempt %v): %v", attempt, err)
 		}
-		c.l.Errorf("cant publish check result: %v", err)
-	}
+		return err
+	})
+	return err == nil
 }
 
 //отправляем в очередь процессинга и запускаем процесс.
-func (c *checkService) dispatch(ctx context.Context, o CheckOrder) {
+//ctx - контекст получения заказов (ожидание свободного слота), pctx - контекст обработки.
+func (c *checkService) dispatch(ctx, pctx context.Context, o CheckOrder) {
+	if c.concurrency != nil && !c.concurrency.acquire(ctx) {
+		return
+	}
 	select {
 	case c.balancer <- struct{}{}:
+		c.inFlight.Add(1)
 		c.processing <- o
+		c.stats.inFlight.Add(1)
 		go func() {
-			c.l.Infof("order %v for item %v dispatched", o.CheckName(), o.ObjectIdentifier())
-			c.process(ctx, o)
+			logDebugf(withLogFields(c.l, orderLogFields(o)), "order %v for item %v dispatched", o.CheckName(), o.ObjectIdentifier())
+			c.process(pctx, o)
+			forgetOrder(c.processor, o)
+			c.stats.inFlight.Add(-1)
 			<-c.balancer
+			if c.concurrency != nil {
+				c.concurrency.release()
+			}
 		}()
 	case <-ctx.Done():
-		return
+		if c.concurrency != nil {
+			c.concurrency.release()
+		}
 	}
 }
 
 func (c *checkService) process(ctx context.Context, o CheckOrder) {
-	for {
+	fields := orderLogFields(o)
+	attempts, err := c.retry.Do(ctx, func(attempt int) error {
+		if attempt > 1 {
+			c.stats.retries.Inc()
+		}
+		started := time.Now()
 		err := c.processor.Process(ctx, o)
-		if err == nil {
-			return
+		if c.concurrency != nil && ctx.Err() == nil {
+			c.concurrency.observe(time.Since(started), err)
 		}
-		c.l.Errorf("err during check order processing: %v", err)
-		time.Sleep(processRetryInterval)
+		if err != nil {
+			c.stats.failed.Inc()
+			fields[LogFieldAttempt] = attempt
+			logWarnf(withLogFields(c.l, fields), "err during check order processing (attempt %v): %v", attempt, err)
+		}
+		return err
+	})
+	if err == nil {
+		c.stats.processed.Inc()
+		return
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	// попытки кончились: отправляем заказ в dead letter и пропускаем результат, чтобы заказ подтвердился
+	fields[LogFieldAttempt] = attempts
+	withLogFields(c.l, fields).Errorf("order %v for item %v failed after %v attempts: %v", o.CheckName(), o.ObjectIdentifier(), attempts, err)
+	if !publishDeadLetter(ctx, c.l, c.deadLetters, c.retry, newOrderDeadLetter(o, attempts, err)) {
+		return
 	}
+	skipResult(o)
 }
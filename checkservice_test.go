@@ -2,7 +2,9 @@ package reactivetools
 
 import (
 	"context"
+	"github.com/iddqdeika/reactivetools/statistic"
 	"github.com/iddqdeika/rrr/helpful"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -34,3 +36,189 @@ func TestNewCheckService(t *testing.T) {
 		t.Fatalf("checkService Run() method returned err: %v", err)
 	}
 }
+
+func TestCheckServiceOrderedAcks(t *testing.T) {
+	logger := helpful.DefaultLogger.WithLevel(helpful.LogNone)
+	const count = 20
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	provider := newStubOrderProvider(ctx, count, 0)
+
+	// более поздние заказы обрабатываются быстрее ранних
+	processor, err := NewCheckOrderProcessor(&delayCheckProvider{delay: func(o CheckOrder) time.Duration {
+		return time.Duration(count-o.(OffsetCarrier).Offset()) * time.Millisecond * 5
+	}})
+	if err != nil {
+		t.Fatalf("cant create check order processor: %v", err)
+	}
+
+	cs := newCheckService(logger, provider, processor, NewStubResultPublisher(), count, "")
+	go cs.run(ctx)
+
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		acked := provider.ackedOffsets()
+		if len(acked) > 0 && acked[len(acked)-1] == count-1 {
+			for i := 1; i < len(acked); i++ {
+				if acked[i] <= acked[i-1] {
+					t.Fatalf("offsets must be acked in increasing order, got %v", acked)
+				}
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("not all orders were acked in time, acked: %v", acked)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+type delayCheckProvider struct {
+	delay func(o CheckOrder) time.Duration
+}
+
+func (p *delayCheckProvider) PerformCheck(ctx context.Context, o CheckOrder) (msg string, success bool, err error) {
+	select {
+	case <-ctx.Done():
+		return "", false, ctx.Err()
+	case <-time.After(p.delay(o)):
+		return "delayed_result_msg", true, nil
+	}
+}
+
+func TestProgressTracker(t *testing.T) {
+	busy := false
+	pt := newProgressTracker("orders", time.Millisecond*20, func() bool { return busy })
+	time.Sleep(time.Millisecond * 30)
+	if err := pt.check(context.Background()); err != nil {
+		t.Fatalf("idle pipeline must be healthy, got %v", err)
+	}
+	busy = true
+	time.Sleep(time.Millisecond * 30)
+	if err := pt.check(context.Background()); err == nil {
+		t.Fatalf("busy pipeline without progress must be unhealthy")
+	}
+	pt.touch()
+	if err := pt.check(context.Background()); err != nil {
+		t.Fatalf("pipeline must be healthy after progress, got %v", err)
+	}
+}
+
+func TestCheckServiceDedup(t *testing.T) {
+	logger := helpful.DefaultLogger.WithLevel(helpful.LogNone)
+	const count = 10
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// все заказы заглушки - на одну проверку одного объекта
+	provider := newStubOrderProvider(ctx, count, 0)
+	processor, err := NewCheckOrderProcessor(&delayCheckProvider{delay: func(o CheckOrder) time.Duration {
+		return time.Millisecond * 100
+	}})
+	if err != nil {
+		t.Fatalf("cant create check order processor: %v", err)
+	}
+
+	cs := newCheckService(logger, provider, processor, NewStubResultPublisher(), count, "")
+	cs.dedup = newOrderDeduplicator(time.Second, count)
+	go cs.run(ctx)
+
+	time.Sleep(time.Millisecond * 50)
+	if acked := provider.ackedOffsets(); len(acked) != 0 {
+		t.Fatalf("superseded orders must not be acked before survivor is published, acked: %v", acked)
+	}
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		acked := provider.ackedOffsets()
+		if len(acked) > 0 && acked[len(acked)-1] == count-1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("not all orders were acked in time, acked: %v", acked)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if cs.stats.processed.Get() != 1 || cs.stats.deduplicated.Get() != count-1 {
+		t.Errorf("expected 1 processed and %v deduplicated orders, got %v and %v",
+			count-1, cs.stats.processed.Get(), cs.stats.deduplicated.Get())
+	}
+}
+
+func TestOrderDeduplicatorCap(t *testing.T) {
+	d := newOrderDeduplicator(time.Minute, 2)
+	orders := make([]CheckOrder, 4)
+	for i := range orders {
+		orders[i] = newStubCheckOrder(int64(i), nil)
+	}
+	admitted := make([]bool, len(orders))
+	for i, o := range orders {
+		admitted[i] = d.admit(o)
+	}
+	// третий присоединенный заказ превысил бы предел - он становится новым выжившим
+	if !admitted[0] || admitted[1] || admitted[2] || !admitted[3] {
+		t.Fatalf("unexpected admissions %v", admitted)
+	}
+	if superseded := d.release(orders[0]); len(superseded) != 2 {
+		t.Fatalf("expected 2 superseded orders, got %v", len(superseded))
+	}
+	if superseded := d.release(orders[3]); len(superseded) != 0 {
+		t.Fatalf("expected no superseded orders, got %v", len(superseded))
+	}
+}
+
+// провайдер, регистрирующий заказы в своем менеджере подтверждений (как провайдер кафка)
+type committingStubProvider struct {
+	ch      chan CheckOrder
+	commits *commitManager
+}
+
+func (p *committingStubProvider) OrderChan() chan CheckOrder {
+	return p.ch
+}
+
+func (p *committingStubProvider) Statistics() ([]statistic.Statistic, error) {
+	return nil, nil
+}
+
+func (p *committingStubProvider) commitManager() *commitManager {
+	return p.commits
+}
+
+func TestCheckServiceSkippedBehindUnfinished(t *testing.T) {
+	logger := helpful.DefaultLogger.WithLevel(helpful.LogNone)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	acks := &stubOrderProvider{}
+	provider := &committingStubProvider{ch: make(chan CheckOrder, 1), commits: newCommitManager(logger)}
+	order := newStubCheckOrder(0, acks.ack)
+	provider.commits.track(order)
+	provider.ch <- order
+	// следующее сообщение провайдер пропускает, пока заказ еще не обработан
+	provider.commits.skip(ctx, newStubCheckOrder(1, acks.ack))
+	if acked := acks.ackedOffsets(); len(acked) != 0 {
+		t.Fatalf("skipped message must not be acked before unfinished order, acked: %v", acked)
+	}
+
+	processor, err := NewCheckOrderProcessor(&delayCheckProvider{delay: func(o CheckOrder) time.Duration {
+		return time.Millisecond * 50
+	}})
+	if err != nil {
+		t.Fatalf("cant create check order processor: %v", err)
+	}
+	cs := newCheckService(logger, provider, processor, NewStubResultPublisher(), 1, "")
+	go cs.run(ctx)
+
+	deadline := time.Now().Add(time.Second * 5)
+	for len(acks.ackedOffsets()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("order was not acked in time")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	// коммит оффсета пропущенного сообщения подтверждает и заказ
+	if acked := acks.ackedOffsets(); !reflect.DeepEqual(acked, []int64{1}) {
+		t.Fatalf("expected offset 1 to be acked after order completion, got %v", acked)
+	}
+}
@@ -6,11 +6,14 @@ import (
 	"fmt"
 	"github.com/iddqdeika/rrr"
 	"github.com/iddqdeika/rrr/helpful"
+	"io"
+	"os"
 	"strings"
 )
 
 const (
-	// название файла конфига, который будет читаться рутом при регистрации.
+	// название файла конфига, который будет читаться рутом при регистрации,
+	// если путь не задан флагом -config или переменной окружения CONFIG_PATH.
 	checkServiceJsonConfigFileName = "config.json"
 )
 
@@ -29,6 +32,8 @@ type kafkaCheckServiceRoot struct {
 	l helpful.Logger
 	p CheckProviderFabric
 	s CheckService
+
+	dryRun bool
 }
 
 // регистрация компонент.
@@ -36,26 +41,25 @@ type kafkaCheckServiceRoot struct {
 func (r *kafkaCheckServiceRoot) Register() []error {
 
 	// конфиг
-	cfg, err := helpful.NewJsonCfg(checkServiceJsonConfigFileName)
+	cfg, err := LoadConfigFromEnvironment()
 	// если ошибка конфига, то дальше нет смысла идти
 	if err != nil {
 		return []error{err}
 	}
 	// логгер
-	r.l = helpful.DefaultLogger.WithLevel(helpful.LogInfo)
-	if cfg.Contains("log") {
-		lvl, _ := cfg.Child("log").GetString("level")
-		switch lvl {
-		case "error":
-			r.l = helpful.DefaultLogger.WithLevel(helpful.LogError)
-		case "info":
-		default:
-			r.l = helpful.DefaultLogger.WithLevel(helpful.LogInfo)
-		}
-	}
+	r.l = loggerFromConfig(cfg)
 	r.l.Infof("logger initialized")
 	defer r.l.Infof("register finished")
 
+	// проверяем конфиг целиком до того, как что-то создавать в кафка
+	err = ValidateKafkaCheckServiceConfig(cfg)
+	if err != nil {
+		if ve, ok := err.(*ConfigValidationError); ok {
+			return ve.Errors()
+		}
+		return []error{err}
+	}
+
 	// сбор ошибок
 	var errs []error
 	e := func(err error) {
@@ -65,11 +69,24 @@ func (r *kafkaCheckServiceRoot) Register() []error {
 	}
 
 	// дергаем фабрику провайдера
-	p, err := r.p.New(cfg.Child("check_logic_provider"), r.l)
+	p, err := r.p.New(cfg.Child("check_logic_provider"), componentLogger(r.l, LogComponentProcessor))
 	e(err)
 
-	// конструктор сервиса
-	r.s, err = NewKafkaCheckService(cfg, r.l, p)
+	// в режиме проверки собираем только то, что не требует кафка
+	r.dryRun = IsDryRun()
+	if r.dryRun {
+		if p != nil {
+			e(dryRunKafkaCheckService(cfg, componentLogger(r.l, LogComponentProcessor), p))
+		}
+		return errs
+	}
+
+	// конструктор сервиса. если функция проверки умеет проверять пакетами - используем пакетный сервис
+	if bp, ok := p.(BatchCheckProvider); ok {
+		r.s, err = NewKafkaBatchCheckService(cfg, r.l, bp)
+	} else {
+		r.s, err = NewKafkaCheckService(cfg, r.l, p)
+	}
 	e(err)
 
 	return errs
@@ -80,15 +97,35 @@ func (r *kafkaCheckServiceRoot) Resolve(ctx context.Context) error {
 	r.l.Infof("root resolve started")
 	defer r.l.Infof("root resolve finished")
 
+	if r.dryRun {
+		r.l.Infof("dry run: config is valid, components built")
+		return nil
+	}
+
 	//исполняем
 	return r.s.Run(ctx)
 }
 
-// высвобождаем ресурсы перед завершением работы, если надо
+// высвобождаем ресурсы перед завершением работы: сервис к этому моменту остановлен,
+// так что его файлы (кэш результатов, outbox) можно закрыть
 func (r *kafkaCheckServiceRoot) Release() error {
+	if c, ok := r.s.(io.Closer); ok {
+		return c.Close()
+	}
 	return nil
 }
 
+// логгер из раздела log конфига (см. NewLoggerFromConfig), пишет в stderr.
+// при ошибке в разделе log - логгер по умолчанию (info, текстовый формат).
+func loggerFromConfig(cfg helpful.Config) helpful.Logger {
+	l, err := NewLoggerFromConfig(cfg, os.Stderr)
+	if err != nil {
+		l = NewStructuredLogger(os.Stderr, LogLevelInfo, LogFormatText)
+		l.Errorf("invalid log config, using defaults: %v", err)
+	}
+	return l
+}
+
 //собрать список ошибок в одну.
 func composeErrors(errs []error) error {
 	if len(errs) == 0 {
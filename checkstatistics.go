@@ -0,0 +1,57 @@
+package reactivetools
+
+import (
+	"fmt"
+	"github.com/iddqdeika/reactivetools/statistic"
+)
+
+// названия компонент для метки component статистик (помимо LogComponent*).
+// по ним же отличаются статистики-ошибки провайдеров статистик.
+const (
+	statisticComponentCommits        = "commits"
+	statisticComponentConcurrency    = "concurrency"
+	statisticComponentCircuitBreaker = "circuit_breaker"
+	statisticComponentConsumerLag    = "consumer_lag"
+	statisticComponentInterceptor    = "interceptor"
+
+	// метка маршрута у статистик маршрутизатора
+	statisticLabelRoute = "route"
+)
+
+// статистики сервиса проверки.
+// subject дописывается к названию каждой статистики, чтобы отличать маршруты друг от друга.
+func newCheckStatistics(subject string) *checkStatistics {
+	name := func(n string) string {
+		if subject == "" {
+			return n
+		}
+		return fmt.Sprintf("%v for %v", n, subject)
+	}
+	return &checkStatistics{
+		received:  statistic.NewCounter(name("Orders received"), `Кол-во полученных заказов на проверку.`),
+		processed: statistic.NewCounter(name("Orders processed"), `Кол-во успешно обработанных заказов на проверку.`),
+		failed:    statistic.NewCounter(name("Order processing errors"), `Кол-во ошибок при обработке заказов (каждая попытка считается отдельно).`),
+		retries:   statistic.NewCounter(name("Order processing retries"), `Кол-во повторных попыток обработки заказов.`),
+		inFlight:  statistic.NewGauge(name("Orders in flight"), `Кол-во заказов, находящихся в обработке прямо сейчас.`),
+		deduplicated: statistic.NewCounter(name("Orders deduplicated"),
+			`Кол-во заказов, схлопнутых с более ранним заказом на ту же проверку того же объекта.`),
+		publishLatency: statistic.NewHistogram(name("Result publish latency seconds"),
+			`Время публикации результата проверки (с учетом повторов), в секундах.`),
+	}
+}
+
+type checkStatistics struct {
+	received  *statistic.Counter
+	processed *statistic.Counter
+	failed    *statistic.Counter
+	retries   *statistic.Counter
+	inFlight  *statistic.Gauge
+
+	deduplicated *statistic.Counter
+
+	publishLatency *statistic.Histogram
+}
+
+func (s *checkStatistics) Statistics() ([]statistic.Statistic, error) {
+	return []statistic.Statistic{s.received, s.processed, s.failed, s.retries, s.inFlight, s.deduplicated, s.publishLatency}, nil
+}
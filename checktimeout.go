@@ -0,0 +1,406 @@
+package reactivetools
+
+import (
+	"context"
+	"fmt"
+	"github.com/iddqdeika/reactivetools/statistic"
+	"github.com/iddqdeika/rrr/helpful"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// таймаут проверки одного заказа:
+	// "check_timeout": {"timeout_in_ms": 30000, "publish_result_after": 3, "checks": {"<check_name>": {"timeout_in_ms": 5000}}}
+	CheckTimeoutConfigKey = "check_timeout"
+
+	timedOutAttribute = "timed_out"
+)
+
+// ошибка процессора, если проверка не уложилась в таймаут.
+// сравнивать надо через errors.Is, т.к. ошибка дополняется названием проверки.
+var ErrCheckTimeout = fmt.Errorf("check timed out")
+
+// политика таймаутов проверки.
+// Timeout - общий таймаут одной попытки, PerCheck - таймауты отдельных проверок (по названию проверки).
+// нулевой таймаут - без ограничения.
+// если задан PublishResultAfter, то после стольких таймаутов подряд для одного заказа публикуется
+// не пройденный результат с пометкой timed_out, и заказ больше не повторяется.
+type CheckTimeoutPolicy struct {
+	Timeout            time.Duration
+	PerCheck           map[string]time.Duration
+	PublishResultAfter int
+}
+
+// собирает политику таймаутов из конфига.
+// таймауты отдельных проверок читаются для переданных названий проверок (в разделе checks).
+func NewCheckTimeoutPolicy(cfg helpful.Config, checkNames ...string) (CheckTimeoutPolicy, error) {
+	if cfg == nil {
+		return CheckTimeoutPolicy{}, fmt.Errorf("must be not-nil Config")
+	}
+	timeout, err := timeoutFromConfig(cfg)
+	if err != nil {
+		return CheckTimeoutPolicy{}, err
+	}
+	after, err := optionalInt(cfg, "publish_result_after", 0)
+	if err != nil {
+		return CheckTimeoutPolicy{}, err
+	}
+	if after < 0 {
+		return CheckTimeoutPolicy{}, fmt.Errorf("publish_result_after must not be negative")
+	}
+	p := CheckTimeoutPolicy{
+		Timeout:            timeout,
+		PerCheck:           make(map[string]time.Duration),
+		PublishResultAfter: after,
+	}
+	if !cfg.Contains("checks") {
+		return p, nil
+	}
+	checks := cfg.Child("checks")
+	for _, cn := range checkNames {
+		if !checks.Contains(cn) {
+			continue
+		}
+		t, err := timeoutFromConfig(checks.Child(cn))
+		if err != nil {
+			return CheckTimeoutPolicy{}, fmt.Errorf("cant get timeout for check %v: %v", cn, err)
+		}
+		p.PerCheck[cn] = t
+	}
+	return p, nil
+}
+
+func timeoutFromConfig(cfg helpful.Config) (time.Duration, error) {
+	ms, err := optionalInt(cfg, "timeout_in_ms", 0)
+	if err != nil {
+		return 0, err
+	}
+	if ms < 0 {
+		return 0, fmt.Errorf("timeout_in_ms must not be negative")
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// таймаут для данной проверки
+func (p CheckTimeoutPolicy) timeout(checkName string) time.Duration {
+	if t, ok := p.PerCheck[checkName]; ok {
+		return t
+	}
+	return p.Timeout
+}
+
+// оборачивает процессор, если в конфиге задан раздел check_timeout.
+func timeoutProcessorFromConfig(cfg helpful.Config, l helpful.Logger, proc CheckOrderProcessor,
+	checkNames ...string) (CheckOrderProcessor, error) {
+
+	if !cfg.Contains(CheckTimeoutConfigKey) {
+		return proc, nil
+	}
+	policy, err := NewCheckTimeoutPolicy(cfg.Child(CheckTimeoutConfigKey), checkNames...)
+	if err != nil {
+		return nil, err
+	}
+	return NewTimeoutCheckOrderProcessor(proc, policy, l)
+}
+
+// инстанциирует процессор, ограничивающий время проверки заказа согласно политике.
+// проверка исполняется с контекстом, закрывающимся по таймауту. если она не завершилась вовремя
+// (в том числе если игнорирует контекст), то процессор возвращает ErrCheckTimeout, не дожидаясь ее,
+// а ее запоздалый результат отбрасывается.
+// брошенная попытка продолжает занимать слот сервиса: следующая попытка того же заказа начинается,
+// а слот освобождается (forget), только после ее завершения. так параллелизм сервиса не превышается.
+// процессор реализует statistic.StatisticProvider (кол-во таймаутов, в том числе по проверкам,
+// и брошенных, но еще не завершившихся попыток).
+func NewTimeoutCheckOrderProcessor(proc CheckOrderProcessor, policy CheckTimeoutPolicy, l helpful.Logger) (CheckOrderProcessor, error) {
+	if proc == nil {
+		return nil, fmt.Errorf("must be not-nil CheckOrderProcessor")
+	}
+	if l == nil {
+		return nil, fmt.Errorf("must be not-nil Logger")
+	}
+	return &timeoutProcessor{
+		proc:     proc,
+		policy:   policy,
+		l:        l,
+		timeouts: statistic.NewCounter("Check timeouts", `Кол-во попыток проверки, не уложившихся в таймаут.`),
+		timedOut: statistic.NewCounter("Timed out results", `Кол-во опубликованных результатов "timed out".`),
+		abandonedRunning: statistic.NewGauge("Abandoned check attempts running",
+			`Кол-во попыток проверки, брошенных по таймауту или остановке, но еще не завершившихся (занимают слоты сервиса).`),
+		byCheck:   make(map[string]*statistic.Counter),
+		attempts:  make(map[CheckOrder]int),
+		abandoned: make(map[CheckOrder]chan struct{}),
+	}, nil
+}
+
+type timeoutProcessor struct {
+	proc   CheckOrderProcessor
+	policy CheckTimeoutPolicy
+	l      helpful.Logger
+
+	timeouts         *statistic.Counter
+	timedOut         *statistic.Counter
+	abandonedRunning *statistic.Gauge
+
+	m        sync.Mutex
+	byCheck  map[string]*statistic.Counter
+	attempts map[CheckOrder]int
+	// брошенные, но еще не завершившиеся попытки (закрываемый по завершении канал) по заказам
+	abandoned map[CheckOrder]chan struct{}
+}
+
+func (p *timeoutProcessor) Process(ctx context.Context, o CheckOrder) error {
+	timeout := p.policy.timeout(o.CheckName())
+	if timeout <= 0 {
+		return p.proc.Process(ctx, o)
+	}
+	// предыдущая брошенная попытка все еще занимает слот
+	err := p.waitAbandoned(ctx, o)
+	if err != nil {
+		return err
+	}
+	tctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// проверка пишет результат в заказ-посредник, чтобы запоздавший результат не попал в заказ
+	to := newTimeoutOrder(o)
+	errs := make(chan error, 1)
+	done := make(chan struct{})
+	go func() {
+		errs <- p.proc.Process(tctx, to)
+		p.finished(o, done)
+	}()
+	defer p.abandon(o, done)
+
+	select {
+	case r := <-to.result:
+		p.resetTimeouts(o)
+		return forwardResult(ctx, o, r)
+	case err := <-errs:
+		if err == nil {
+			p.resetTimeouts(o)
+			// результат записывается до возврата из процессора, так что он уже в канале
+			select {
+			case r := <-to.result:
+				return forwardResult(ctx, o, r)
+			default:
+				return nil
+			}
+		}
+		if tctx.Err() == nil || ctx.Err() != nil {
+			p.resetTimeouts(o)
+			return err
+		}
+	case <-tctx.Done():
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	return p.timedOutAttempt(ctx, o, timeout)
+}
+
+// учитывает таймаут и, если их набралось достаточно, публикует результат "timed out".
+func (p *timeoutProcessor) timedOutAttempt(ctx context.Context, o CheckOrder, timeout time.Duration) error {
+	p.timeouts.Inc()
+	attempts := p.registerTimeout(o)
+	if p.policy.PublishResultAfter <= 0 || attempts < p.policy.PublishResultAfter {
+		return fmt.Errorf("%w: %v for item %v (attempt %v, timeout %v)", ErrCheckTimeout, o.CheckName(), o.ObjectIdentifier(), attempts, timeout)
+	}
+	p.resetTimeouts(o)
+	p.timedOut.Inc()
+	p.l.Errorf("check %v for item %v timed out %v times, publishing timed out result", o.CheckName(), o.ObjectIdentifier(), attempts)
+	r := newOrderResult(o, "", false)
+	r.setDetails(CheckDetails{
+		Message:    fmt.Sprintf("check timed out %v times (timeout %v)", attempts, timeout),
+		Severity:   SeverityError,
+		Attributes: map[string]string{timedOutAttribute: strconv.Itoa(attempts)},
+	})
+	r.duration = timeout
+	r.timedOut = true
+	return forwardResult(ctx, o, r)
+}
+
+// результат "timed out", опубликованный процессором с таймаутами (не кэшируется)
+func isTimedOutResult(r CheckResult) bool {
+	cr, ok := r.(*checkResult)
+	return ok && cr.timedOut
+}
+
+// исходный заказ. обертки процессоров (например, кэш) передают внутрь заказ-посредник,
+// а forget сервис вызывает для исходного заказа, поэтому состояние заказа хранится по исходному.
+func originalOrder(o CheckOrder) CheckOrder {
+	for {
+		to, ok := o.(*timeoutOrder)
+		if !ok {
+			return o
+		}
+		o = to.CheckOrder
+	}
+}
+
+func (p *timeoutProcessor) registerTimeout(o CheckOrder) int {
+	p.m.Lock()
+	defer p.m.Unlock()
+	o = originalOrder(o)
+	c, ok := p.byCheck[o.CheckName()]
+	if !ok {
+		c = statistic.NewCounter("Check timeouts for "+o.CheckName(), `Кол-во попыток проверки, не уложившихся в таймаут.`)
+		p.byCheck[o.CheckName()] = c
+	}
+	c.Inc()
+	if p.policy.PublishResultAfter <= 0 {
+		return 0
+	}
+	// если заказ уйдет в dead letter раньше, чем наберется нужное кол-во таймаутов, или сервис остановится,
+	// то счетчик удалит сервис по окончании обработки заказа (forget)
+	p.attempts[o]++
+	return p.attempts[o]
+}
+
+// попытка, из которой Process возвращается раньше ее завершения (таймаут, остановка), считается брошенной
+func (p *timeoutProcessor) abandon(o CheckOrder, done chan struct{}) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	select {
+	case <-done:
+		return
+	default:
+	}
+	p.abandoned[originalOrder(o)] = done
+	p.abandonedRunning.Add(1)
+}
+
+// вызывается по завершении попытки, в том числе брошенной
+func (p *timeoutProcessor) finished(o CheckOrder, done chan struct{}) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	o = originalOrder(o)
+	if p.abandoned[o] == done {
+		delete(p.abandoned, o)
+		p.abandonedRunning.Add(-1)
+	}
+	close(done)
+}
+
+// ждет завершения брошенной попытки заказа, пока открыт контекст
+func (p *timeoutProcessor) waitAbandoned(ctx context.Context, o CheckOrder) error {
+	p.m.Lock()
+	done, ok := p.abandoned[originalOrder(o)]
+	p.m.Unlock()
+	if !ok {
+		return nil
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *timeoutProcessor) resetTimeouts(o CheckOrder) {
+	p.m.Lock()
+	delete(p.attempts, originalOrder(o))
+	p.m.Unlock()
+}
+
+// заказ обработан: слот сервиса освобождается только после завершения его брошенной попытки
+func (p *timeoutProcessor) forget(o CheckOrder) {
+	p.resetTimeouts(o)
+	_ = p.waitAbandoned(context.Background(), o)
+	forgetOrder(p.proc, o)
+}
+
+// процессор, хранящий состояние заказа между попытками обработки.
+// сервис вызывает forget, когда обработка заказа закончена (успешно, в dead letter или остановкой),
+// обертки процессоров передают вызов обернутому процессору.
+type orderForgetter interface {
+	forget(o CheckOrder)
+}
+
+func forgetOrder(proc CheckOrderProcessor, o CheckOrder) {
+	if f, ok := proc.(orderForgetter); ok {
+		f.forget(o)
+	}
+}
+
+// статистики таймаутов и обернутого процессора (если он их предоставляет)
+func (p *timeoutProcessor) Statistics() ([]statistic.Statistic, error) {
+	p.m.Lock()
+	res := []statistic.Statistic{p.timeouts, p.timedOut, p.abandonedRunning}
+	names := make([]string, 0, len(p.byCheck))
+	for cn := range p.byCheck {
+		names = append(names, cn)
+	}
+	sort.Strings(names)
+	for _, cn := range names {
+		res = append(res, p.byCheck[cn])
+	}
+	p.m.Unlock()
+	if sp, ok := p.proc.(statistic.StatisticProvider); ok {
+		ps, err := sp.Statistics()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, ps...)
+	}
+	return res, nil
+}
+
+func (p *timeoutProcessor) HealthChecks() []statistic.HealthCheck {
+	return componentHealthChecks(p.proc)
+}
+
+func forwardResult(ctx context.Context, o CheckOrder, r CheckResult) error {
+	select {
+	case o.Result() <- r:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// заказ-посредник с собственным каналом результата.
+// остальное, включая метаданные и идентификатор заказа, берется у исходного заказа.
+func newTimeoutOrder(o CheckOrder) *timeoutOrder {
+	return &timeoutOrder{CheckOrder: o, result: make(chan CheckResult, 1)}
+}
+
+type timeoutOrder struct {
+	CheckOrder
+	result chan CheckResult
+}
+
+func (o *timeoutOrder) Result() chan CheckResult {
+	return o.result
+}
+
+func (o *timeoutOrder) OrderID() string {
+	if oi, ok := o.CheckOrder.(orderIdentified); ok {
+		return oi.OrderID()
+	}
+	return ""
+}
+
+func (o *timeoutOrder) Metadata() MessageMetadata {
+	if mc, ok := o.CheckOrder.(MetadataCarrier); ok {
+		return mc.Metadata()
+	}
+	return MessageMetadata{Partition: unknownPartition, Offset: -1}
+}
+
+func (o *timeoutOrder) CorrelationID() string {
+	if mc, ok := o.CheckOrder.(MetadataCarrier); ok {
+		return mc.CorrelationID()
+	}
+	return ""
+}
+
+func (o *timeoutOrder) TraceContext() TraceContext {
+	if mc, ok := o.CheckOrder.(MetadataCarrier); ok {
+		return mc.TraceContext()
+	}
+	return TraceContext{}
+}
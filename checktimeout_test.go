@@ -0,0 +1,133 @@
+package reactivetools
+
+import (
+	"context"
+	"errors"
+	"github.com/iddqdeika/rrr/helpful"
+	"testing"
+	"time"
+)
+
+// проверка, игнорирующая контекст
+type hangingCheckProvider struct {
+	delay time.Duration
+}
+
+func (p *hangingCheckProvider) PerformCheck(ctx context.Context, o CheckOrder) (string, bool, error) {
+	time.Sleep(p.delay)
+	return "late", true, nil
+}
+
+func TestTimeoutCheckOrderProcessor(t *testing.T) {
+	inner, err := NewCheckOrderProcessor(&hangingCheckProvider{delay: time.Millisecond * 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proc, err := NewTimeoutCheckOrderProcessor(inner, CheckTimeoutPolicy{
+		Timeout:            time.Second,
+		PerCheck:           map[string]time.Duration{"stub_check_name": time.Millisecond * 20},
+		PublishResultAfter: 2,
+	}, helpful.DefaultLogger.WithLevel(helpful.LogNone))
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := newStubCheckOrder(0, nil)
+
+	started := time.Now()
+	err = proc.Process(context.Background(), o)
+	if !errors.Is(err, ErrCheckTimeout) {
+		t.Fatalf("expected ErrCheckTimeout, got %v", err)
+	}
+	if time.Since(started) > time.Millisecond*150 {
+		t.Fatalf("processor must not wait for hanging check")
+	}
+
+	// второй таймаут подряд - публикуется результат "timed out"
+	err = proc.Process(context.Background(), o)
+	if err != nil {
+		t.Fatalf("expected timed out result, got err: %v", err)
+	}
+	r, ok := (<-o.Result()).(DetailedCheckResult)
+	if !ok || r.CheckSuccess() || r.Attributes()[timedOutAttribute] != "2" {
+		t.Fatalf("incorrect timed out result: %+v", r)
+	}
+
+	// запоздавшие результаты не должны попасть в заказ
+	time.Sleep(time.Millisecond * 300)
+	select {
+	case r := <-o.Result():
+		t.Fatalf("late result must be dropped, got %+v", r)
+	default:
+	}
+
+	ss, err := proc.(*timeoutProcessor).Statistics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ss) != 4 || ss[0].Value() != "2" || ss[1].Value() != "1" || ss[2].Value() != "0" || ss[3].Value() != "2" {
+		t.Fatalf("incorrect timeout statistics")
+	}
+}
+
+func TestTimeoutProcessorForget(t *testing.T) {
+	inner, err := NewCheckOrderProcessor(&hangingCheckProvider{delay: time.Millisecond * 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proc, err := NewTimeoutCheckOrderProcessor(inner, CheckTimeoutPolicy{
+		Timeout:            time.Millisecond * 10,
+		PublishResultAfter: 3,
+	}, helpful.DefaultLogger.WithLevel(helpful.LogNone))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp := proc.(*timeoutProcessor)
+	// счетчик таймаутов заказа удаляется по окончании его обработки, даже если результат не опубликован
+	wrapped := &rateLimitProcessor{proc: proc, limiter: newTokenBucket("test", 1000, 10)}
+	o := newStubCheckOrder(0, nil)
+	if err := wrapped.Process(context.Background(), o); !errors.Is(err, ErrCheckTimeout) {
+		t.Fatalf("expected ErrCheckTimeout, got %v", err)
+	}
+	if len(tp.attempts) != 1 {
+		t.Fatalf("expected timed out attempt to be counted")
+	}
+	forgetOrder(wrapped, o)
+	if len(tp.attempts) != 0 {
+		t.Fatalf("forgotten order must not be kept, got %v", tp.attempts)
+	}
+}
+
+func TestTimeoutProcessorHoldsSlotForAbandonedAttempt(t *testing.T) {
+	inner, err := NewCheckOrderProcessor(&hangingCheckProvider{delay: time.Millisecond * 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proc, err := NewTimeoutCheckOrderProcessor(inner, CheckTimeoutPolicy{Timeout: time.Millisecond * 20},
+		helpful.DefaultLogger.WithLevel(helpful.LogNone))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp := proc.(*timeoutProcessor)
+	o := newStubCheckOrder(0, nil)
+	started := time.Now()
+	if err := proc.Process(context.Background(), o); !errors.Is(err, ErrCheckTimeout) {
+		t.Fatalf("expected ErrCheckTimeout, got %v", err)
+	}
+	if tp.abandonedRunning.Get() != 1 {
+		t.Fatalf("abandoned attempt must be counted as running, got %v", tp.abandonedRunning.Get())
+	}
+
+	// следующая попытка начинается только после завершения брошенной
+	if err := proc.Process(context.Background(), o); !errors.Is(err, ErrCheckTimeout) {
+		t.Fatalf("expected ErrCheckTimeout, got %v", err)
+	}
+	if time.Since(started) < time.Millisecond*200 {
+		t.Fatalf("next attempt must wait for abandoned one")
+	}
+
+	// сервис освобождает слот после forget: он ждет завершения брошенной попытки
+	forgetOrder(proc, o)
+	if time.Since(started) < time.Millisecond*400 || tp.abandonedRunning.Get() != 0 {
+		t.Fatalf("forget must wait for abandoned attempt, running: %v", tp.abandonedRunning.Get())
+	}
+}
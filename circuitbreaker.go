@@ -0,0 +1,331 @@
+package reactivetools
+
+import (
+	"context"
+	"fmt"
+	"github.com/iddqdeika/reactivetools/statistic"
+	"github.com/iddqdeika/rrr/helpful"
+	"sync"
+	"time"
+)
+
+const (
+	// предохранитель функции проверки и публикатора результатов:
+	// "circuit_breaker": {"failure_threshold": 5, "open_timeout_in_secs": 30, "half_open_probes": 1}
+	// в маршрутизирующем сервисе у каждого маршрута свой предохранитель: пока он разомкнут,
+	// заказы маршрута копятся в его очереди (route_queue_size), а остальные маршруты продолжают работу.
+	CircuitBreakerConfigKey = "circuit_breaker"
+
+	defaultHalfOpenProbes = 1
+)
+
+// ошибка публикатора, пока предохранитель разомкнут
+var ErrCircuitOpen = fmt.Errorf("circuit breaker is open")
+
+// состояние предохранителя
+type CircuitState int
+
+const (
+	// обращения проходят, ошибки подряд считаются
+	CircuitClosed CircuitState = iota
+	// обращения пропускаются по одному (пробы), успех пробы замыкает предохранитель, ошибка - размыкает
+	CircuitHalfOpen
+	// обращения не проходят до истечения OpenTimeout
+	CircuitOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "open"
+	}
+}
+
+// настройки предохранителя.
+// после FailureThreshold ошибок подряд предохранитель размыкается на OpenTimeout,
+// затем пропускает не больше HalfOpenProbes пробных обращений одновременно.
+type CircuitBreakerSettings struct {
+	FailureThreshold int
+	OpenTimeout      time.Duration
+	HalfOpenProbes   int
+}
+
+// собирает настройки предохранителя из конфига
+func NewCircuitBreakerSettings(cfg helpful.Config) (CircuitBreakerSettings, error) {
+	if cfg == nil {
+		return CircuitBreakerSettings{}, fmt.Errorf("must be not-nil Config")
+	}
+	threshold, err := cfg.GetInt("failure_threshold")
+	if err != nil {
+		return CircuitBreakerSettings{}, err
+	}
+	if threshold < 1 {
+		return CircuitBreakerSettings{}, fmt.Errorf("failure_threshold must be positive")
+	}
+	timeout, err := cfg.GetInt("open_timeout_in_secs")
+	if err != nil {
+		return CircuitBreakerSettings{}, err
+	}
+	if timeout < 1 {
+		return CircuitBreakerSettings{}, fmt.Errorf("open_timeout_in_secs must be positive")
+	}
+	probes, err := optionalInt(cfg, "half_open_probes", defaultHalfOpenProbes)
+	if err != nil {
+		return CircuitBreakerSettings{}, err
+	}
+	if probes < 1 {
+		return CircuitBreakerSettings{}, fmt.Errorf("half_open_probes must be positive")
+	}
+	return CircuitBreakerSettings{
+		FailureThreshold: threshold,
+		OpenTimeout:      time.Duration(timeout) * time.Second,
+		HalfOpenProbes:   probes,
+	}, nil
+}
+
+// предохранитель с данным названием, если раздел circuit_breaker задан (иначе nil)
+func circuitBreakerFromConfig(cfg helpful.Config, name string, l helpful.Logger) (*circuitBreaker, error) {
+	if !cfg.Contains(CircuitBreakerConfigKey) {
+		return nil, nil
+	}
+	s, err := NewCircuitBreakerSettings(cfg.Child(CircuitBreakerConfigKey))
+	if err != nil {
+		return nil, fmt.Errorf("incorrect %v: %v", CircuitBreakerConfigKey, err)
+	}
+	return newCircuitBreaker(name, s, l), nil
+}
+
+func newCircuitBreaker(name string, s CircuitBreakerSettings, l helpful.Logger) *circuitBreaker {
+	return &circuitBreaker{
+		name:    name,
+		s:       s,
+		l:       l,
+		pauses:  true,
+		changed: make(chan struct{}),
+		gauge: statistic.NewGauge("Circuit breaker state for "+name,
+			`Состояние предохранителя: 0 - замкнут, 1 - пробные обращения, 2 - разомкнут.`),
+		opens: statistic.NewCounter("Circuit breaker opens for "+name, `Кол-во размыканий предохранителя.`),
+	}
+}
+
+type circuitBreaker struct {
+	name string
+	s    CircuitBreakerSettings
+	l    helpful.Logger
+	// приостанавливать получение заказов, пока предохранитель разомкнут
+	pauses bool
+
+	m        sync.Mutex
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	probes   int
+	// закрывается и заменяется при смене состояния или освобождении пробы
+	changed chan struct{}
+
+	gauge *statistic.Gauge
+	opens *statistic.Counter
+}
+
+// пытается занять право на обращение. если нельзя - возвращает время, через которое стоит попробовать снова,
+// и канал, закрывающийся при смене состояния.
+func (b *circuitBreaker) tryAcquire() (bool, time.Duration, chan struct{}) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if b.state == CircuitOpen {
+		wait := b.s.OpenTimeout - time.Since(b.openedAt)
+		if wait > 0 {
+			return false, wait, b.changed
+		}
+		b.setState(CircuitHalfOpen)
+	}
+	if b.state == CircuitClosed {
+		return true, 0, nil
+	}
+	if b.probes < b.s.HalfOpenProbes {
+		b.probes++
+		return true, 0, nil
+	}
+	return false, b.s.OpenTimeout, b.changed
+}
+
+// ждет права на обращение, пока не закроется контекст
+func (b *circuitBreaker) acquire(ctx context.Context) error {
+	for {
+		ok, wait, changed := b.tryAcquire()
+		if ok {
+			return nil
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-changed:
+		case <-t.C:
+		}
+		t.Stop()
+	}
+}
+
+// ждет, пока предохранитель не перестанет быть разомкнутым
+func (b *circuitBreaker) waitNotOpen(ctx context.Context) error {
+	for {
+		b.m.Lock()
+		wait := b.s.OpenTimeout - time.Since(b.openedAt)
+		if b.state != CircuitOpen || wait <= 0 {
+			b.m.Unlock()
+			return nil
+		}
+		changed := b.changed
+		b.m.Unlock()
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-changed:
+		case <-t.C:
+		}
+		t.Stop()
+	}
+}
+
+// учитывает результат обращения. ignore - обращение прервано (например, остановкой) и ничего не говорит о ресурсе.
+func (b *circuitBreaker) record(err error, ignore bool) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if b.state == CircuitHalfOpen && b.probes > 0 {
+		b.probes--
+		b.notify()
+	}
+	if ignore {
+		return
+	}
+	if err == nil {
+		b.failures = 0
+		if b.state != CircuitClosed {
+			b.l.Infof("circuit breaker %v closed", b.name)
+			b.setState(CircuitClosed)
+		}
+		return
+	}
+	b.failures++
+	switch {
+	case b.state == CircuitHalfOpen:
+		b.l.Errorf("circuit breaker %v probe failed, opening for %v: %v", b.name, b.s.OpenTimeout, err)
+		b.open()
+	case b.state == CircuitClosed && b.failures >= b.s.FailureThreshold:
+		b.l.Errorf("circuit breaker %v opened for %v after %v consecutive failures: %v", b.name, b.s.OpenTimeout, b.failures, err)
+		b.open()
+	}
+}
+
+// вызывается под мьютексом
+func (b *circuitBreaker) open() {
+	b.openedAt = time.Now()
+	b.opens.Inc()
+	b.setState(CircuitOpen)
+}
+
+// вызывается под мьютексом
+func (b *circuitBreaker) setState(s CircuitState) {
+	if s != b.state && s == CircuitHalfOpen {
+		b.l.Infof("circuit breaker %v half-open, probing", b.name)
+	}
+	b.state = s
+	b.probes = 0
+	b.gauge.Set(int64(s))
+	b.notify()
+}
+
+// вызывается под мьютексом
+func (b *circuitBreaker) notify() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+func (b *circuitBreaker) currentState() CircuitState {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.state
+}
+
+func (b *circuitBreaker) Statistics() ([]statistic.Statistic, error) {
+	return []statistic.Statistic{b.gauge, b.opens}, nil
+}
+
+// процессор за предохранителем.
+// пока предохранитель разомкнут, Process ждет (а не возвращает ошибку), так что попытки повторов не расходуются
+// и лог не заполняется ошибками. таймаут проверки должен быть внутри, чтобы таймауты считались ошибками.
+type breakerProcessor struct {
+	proc CheckOrderProcessor
+	cb   *circuitBreaker
+}
+
+func (p *breakerProcessor) Process(ctx context.Context, o CheckOrder) error {
+	err := p.cb.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	err = p.proc.Process(ctx, o)
+	p.cb.record(err, ctx.Err() != nil)
+	return err
+}
+
+func (p *breakerProcessor) Statistics() ([]statistic.Statistic, error) {
+	if sp, ok := p.proc.(statistic.StatisticProvider); ok {
+		return sp.Statistics()
+	}
+	return nil, nil
+}
+
+func (p *breakerProcessor) HealthChecks() []statistic.HealthCheck {
+	return componentHealthChecks(p.proc)
+}
+
+func (p *breakerProcessor) forget(o CheckOrder) {
+	forgetOrder(p.proc, o)
+}
+
+// публикатор за предохранителем. в отличие от процессора не ждет: пока предохранитель разомкнут
+// (или заняты все пробы) - сразу возвращает ErrCircuitOpen, а повторяет публикацию вызывающий
+// (сервис или ретранслятор outbox) с интервалами своей политики повторов.
+type breakerPublisher struct {
+	pub CheckResultPublisher
+	cb  *circuitBreaker
+}
+
+func (p *breakerPublisher) PublishCheckResult(r CheckResult) error {
+	ok, _, _ := p.cb.tryAcquire()
+	if !ok {
+		return ErrCircuitOpen
+	}
+	err := p.pub.PublishCheckResult(r)
+	p.cb.record(err, false)
+	return err
+}
+
+func (p *breakerPublisher) HealthChecks() []statistic.HealthCheck {
+	return componentHealthChecks(p.pub)
+}
+
+// приостанавливает получение заказов, пока разомкнут хотя бы один из предохранителей (с pauses).
+// возвращает false, если контекст закрылся раньше.
+func waitCircuitBreakers(ctx context.Context, l helpful.Logger, breakers []*circuitBreaker) bool {
+	for _, b := range breakers {
+		if !b.pauses || b.currentState() != CircuitOpen {
+			continue
+		}
+		l.Infof("consumption paused: circuit breaker %v is open", b.name)
+		if b.waitNotOpen(ctx) != nil {
+			return false
+		}
+		l.Infof("consumption resumed: circuit breaker %v is %v", b.name, b.currentState())
+	}
+	return true
+}
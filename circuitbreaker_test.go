@@ -0,0 +1,163 @@
+package reactivetools
+
+import (
+	"context"
+	"errors"
+	"github.com/iddqdeika/rrr/helpful"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	l := helpful.DefaultLogger.WithLevel(helpful.LogNone)
+	cb := newCircuitBreaker("publisher", CircuitBreakerSettings{
+		FailureThreshold: 2,
+		OpenTimeout:      time.Millisecond * 50,
+		HalfOpenProbes:   1,
+	}, l)
+	pub := &breakerPublisher{pub: &flakyPublisher{failures: 3}, cb: cb}
+	res := NewCheckResult("product", "1", "images", "ok", true)
+
+	// после 2 ошибок подряд предохранитель размыкается и публикатор сразу отвечает ErrCircuitOpen
+	for i := 0; i < 2; i++ {
+		if err := pub.PublishCheckResult(res); err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("attempt %v: expected publisher error, got %v", i, err)
+		}
+	}
+	if cb.currentState() != CircuitOpen || cb.opens.Get() != 1 {
+		t.Fatalf("expected open breaker, got %v", cb.currentState())
+	}
+	if err := pub.PublishCheckResult(res); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected ErrCircuitOpen, got %v", err)
+	}
+
+	// получение заказов ждет окончания OpenTimeout
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	if waitCircuitBreakers(ctx, l, []*circuitBreaker{cb}) {
+		t.Fatal("must wait while breaker is open")
+	}
+	started := time.Now()
+	if !waitCircuitBreakers(context.Background(), l, []*circuitBreaker{cb}) {
+		t.Fatal("must resume after open timeout")
+	}
+	if time.Since(started) > time.Second {
+		t.Fatal("waited too long")
+	}
+
+	// неудачная проба снова размыкает предохранитель
+	if err := pub.PublishCheckResult(res); err == nil || errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected failed probe, got %v", err)
+	}
+	if cb.currentState() != CircuitOpen || cb.opens.Get() != 2 {
+		t.Fatalf("failed probe must open breaker, got %v", cb.currentState())
+	}
+
+	// удачная проба замыкает предохранитель
+	time.Sleep(time.Millisecond * 60)
+	if err := pub.PublishCheckResult(res); err != nil {
+		t.Fatalf("expected successful probe, got %v", err)
+	}
+	if cb.currentState() != CircuitClosed {
+		t.Fatalf("successful probe must close breaker, got %v", cb.currentState())
+	}
+}
+
+func TestBreakerProcessorWaitsWhileOpen(t *testing.T) {
+	l := helpful.DefaultLogger.WithLevel(helpful.LogNone)
+	cb := newCircuitBreaker("processor", CircuitBreakerSettings{
+		FailureThreshold: 1,
+		OpenTimeout:      time.Hour,
+		HalfOpenProbes:   1,
+	}, l)
+	proc := &breakerProcessor{proc: &errorProcessor{err: errors.New("unavailable")}, cb: cb}
+
+	err := proc.Process(context.Background(), newStubCheckOrder(0, nil))
+	if err == nil || cb.currentState() != CircuitOpen {
+		t.Fatalf("expected open breaker after failure, got %v, %v", err, cb.currentState())
+	}
+
+	// пока разомкнут - процессор не вызывается, а ждет
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	err = proc.Process(ctx, newStubCheckOrder(1, nil))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected wait until context deadline, got %v", err)
+	}
+	if cb.opens.Get() != 1 {
+		t.Fatalf("interrupted wait must not be counted, got %v opens", cb.opens.Get())
+	}
+}
+
+// процессор, всегда возвращающий ошибку
+type errorProcessor struct {
+	err error
+}
+
+func (p *errorProcessor) Process(ctx context.Context, o CheckOrder) error {
+	return p.err
+}
+
+func TestCircuitBreakerWithOutbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l := helpful.DefaultLogger.WithLevel(helpful.LogNone)
+	cfg := newFileConfig(map[string]interface{}{
+		CircuitBreakerConfigKey: map[string]interface{}{"failure_threshold": 1, "open_timeout_in_secs": 1},
+		OutboxConfigKey: map[string]interface{}{
+			"bolt_storage_path":  filepath.Join(dir, "outbox.db"),
+			RetryPolicyConfigKey: map[string]interface{}{"initial_interval_in_ms": 10, "max_interval_in_ms": 10},
+		},
+	}, nil)
+	kafka := &flakyPublisher{failures: 1}
+	pub, cb, err := publisherFromConfig(cfg, l, kafka)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, ok := pub.(*ResultOutbox)
+	if !ok || cb == nil {
+		t.Fatalf("expected outbox over circuit breaker, got %T", pub)
+	}
+	defer o.Close()
+	// outbox принимает результаты и при разомкнутом предохранителе - получение заказов не приостанавливается
+	if cb.pauses {
+		t.Fatal("publisher breaker must not pause consumption with outbox")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go o.Run(ctx)
+	for i, id := range []string{"1", "2"} {
+		if err := o.PublishCheckResult(NewCheckResult("product", id, "images", "ok", true)); err != nil {
+			t.Fatalf("result %v must be stored while kafka is down: %v", i, err)
+		}
+	}
+
+	// первая ошибка размыкает предохранитель, ретранслятор получает ErrCircuitOpen, пока не истечет open timeout
+	deadline := time.Now().Add(time.Second * 5)
+	for cb.currentState() != CircuitOpen {
+		if time.Now().After(deadline) {
+			t.Fatal("breaker must open after kafka failure")
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+	if len(kafka.results()) != 0 {
+		t.Fatal("nothing must be relayed while breaker is open")
+	}
+	// после open timeout проба проходит, предохранитель замыкается и outbox отправляет накопленное
+	for len(kafka.results()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("results were not relayed after breaker closed, got %v", len(kafka.results()))
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if cb.currentState() != CircuitClosed || cb.opens.Get() != 1 {
+		t.Fatalf("expected closed breaker after single open, got %v (opens: %v)", cb.currentState(), cb.opens.Get())
+	}
+}
@@ -0,0 +1,224 @@
+package reactivetools
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/iddqdeika/rrr/helpful"
+	"time"
+)
+
+const (
+	// формат сообщений в конфиге провайдера заказов и публикатора результатов: json (по умолчанию) или envelope
+	ConfigCodecKey = "codec"
+
+	CodecJSON     = "json"
+	CodecEnvelope = "envelope"
+
+	// текущая версия схемы конверта
+	envelopeSchemaVersion = 1
+)
+
+// разобранное сообщение с заказом на проверку.
+// SchemaVersion, OrderID, CreatedAt и Metadata заполняются только для сообщений в конверте.
+type OrderMessage struct {
+	SchemaVersion    int
+	OrderID          string
+	CreatedAt        time.Time
+	Metadata         map[string]string
+	ObjectType       string
+	CheckName        string
+	ObjectIdentifier string
+}
+
+// кодек заказов на проверку.
+// разбирает сообщение из очереди. ошибка означает, что сообщение некорректно.
+type CheckOrderCodec interface {
+	DecodeOrder(data []byte) (OrderMessage, error)
+}
+
+// кодек результатов проверки.
+// собирает из результата сообщение для очереди.
+type CheckResultCodec interface {
+	EncodeResult(r CheckResult) ([]byte, error)
+}
+
+// стандартные кодеки.
+// JSON - исторический формат без конверта, Envelope - версионированный конверт с метаданными.
+var CheckOrderCodecs = struct {
+	JSON     CheckOrderCodec
+	Envelope CheckOrderCodec
+}{JSON: jsonOrderCodec{}, Envelope: envelopeOrderCodec{}}
+
+var CheckResultCodecs = struct {
+	JSON     CheckResultCodec
+	Envelope CheckResultCodec
+}{JSON: jsonResultCodec{}, Envelope: envelopeResultCodec{}}
+
+// кодек заказов, выбранный в конфиге (по умолчанию - json).
+func orderCodecFromConfig(cfg helpful.Config) (CheckOrderCodec, error) {
+	name, err := codecName(cfg)
+	if err != nil {
+		return nil, err
+	}
+	switch name {
+	case CodecJSON:
+		return CheckOrderCodecs.JSON, nil
+	case CodecEnvelope:
+		return CheckOrderCodecs.Envelope, nil
+	}
+	return nil, fmt.Errorf("unknown %v: %v", ConfigCodecKey, name)
+}
+
+// кодек результатов, выбранный в конфиге (по умолчанию - json).
+func resultCodecFromConfig(cfg helpful.Config) (CheckResultCodec, error) {
+	name, err := codecName(cfg)
+	if err != nil {
+		return nil, err
+	}
+	switch name {
+	case CodecJSON:
+		return CheckResultCodecs.JSON, nil
+	case CodecEnvelope:
+		return CheckResultCodecs.Envelope, nil
+	}
+	return nil, fmt.Errorf("unknown %v: %v", ConfigCodecKey, name)
+}
+
+func codecName(cfg helpful.Config) (string, error) {
+	if !cfg.Contains(ConfigCodecKey) {
+		return CodecJSON, nil
+	}
+	return cfg.GetString(ConfigCodecKey)
+}
+
+type checkOrderData struct {
+	ObjectType       string `json:"object_type"`
+	CheckName        string `json:"check_name"`
+	ObjectIdentifier string `json:"object_identifier"`
+}
+
+func (d checkOrderData) validate() error {
+	if d.ObjectType == "" || d.CheckName == "" || d.ObjectIdentifier == "" {
+		return fmt.Errorf("object_type, check_name and object_identifier must be not empty")
+	}
+	return nil
+}
+
+type jsonOrderCodec struct {
+}
+
+func (c jsonOrderCodec) DecodeOrder(data []byte) (OrderMessage, error) {
+	od := checkOrderData{}
+	err := json.Unmarshal(data, &od)
+	if err != nil {
+		return OrderMessage{}, err
+	}
+	err = od.validate()
+	if err != nil {
+		return OrderMessage{}, err
+	}
+	return OrderMessage{
+		ObjectType:       od.ObjectType,
+		CheckName:        od.CheckName,
+		ObjectIdentifier: od.ObjectIdentifier,
+	}, nil
+}
+
+// версионированный конверт.
+// Payload - сообщение в историческом формате (checkOrderData или ResultDTO).
+type envelope struct {
+	SchemaVersion int               `json:"schema_version"`
+	OrderID       string            `json:"order_id,omitempty"`
+	CreatedAt     time.Time         `json:"created_at"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
+	Payload       json.RawMessage   `json:"payload"`
+}
+
+// сообщения без версии (schema_version = 0) разбираются как сообщения без конверта,
+// так что на конверт можно переходить, не дожидаясь всех отправителей.
+type envelopeOrderCodec struct {
+}
+
+func (c envelopeOrderCodec) DecodeOrder(data []byte) (OrderMessage, error) {
+	e := envelope{}
+	err := json.Unmarshal(data, &e)
+	if err != nil {
+		return OrderMessage{}, err
+	}
+	if e.SchemaVersion == 0 {
+		return CheckOrderCodecs.JSON.DecodeOrder(data)
+	}
+	if e.SchemaVersion > envelopeSchemaVersion {
+		return OrderMessage{}, fmt.Errorf("unsupported schema version %v", e.SchemaVersion)
+	}
+	od := checkOrderData{}
+	err = json.Unmarshal(e.Payload, &od)
+	if err != nil {
+		return OrderMessage{}, fmt.Errorf("cant parse payload: %v", err)
+	}
+	err = od.validate()
+	if err != nil {
+		return OrderMessage{}, err
+	}
+	return OrderMessage{
+		SchemaVersion:    e.SchemaVersion,
+		OrderID:          e.OrderID,
+		CreatedAt:        e.CreatedAt,
+		Metadata:         e.Metadata,
+		ObjectType:       od.ObjectType,
+		CheckName:        od.CheckName,
+		ObjectIdentifier: od.ObjectIdentifier,
+	}, nil
+}
+
+type jsonResultCodec struct {
+}
+
+func (c jsonResultCodec) EncodeResult(r CheckResult) ([]byte, error) {
+	return json.Marshal(newResultDTO(r))
+}
+
+type envelopeResultCodec struct {
+}
+
+func (c envelopeResultCodec) EncodeResult(r CheckResult) ([]byte, error) {
+	payload, err := json.Marshal(newResultDTO(r))
+	if err != nil {
+		return nil, err
+	}
+	e := envelope{
+		SchemaVersion: envelopeSchemaVersion,
+		CreatedAt:     time.Now(),
+		Payload:       payload,
+	}
+	if oi, ok := r.(orderIdentified); ok {
+		e.OrderID = oi.OrderID()
+	}
+	if tr, ok := r.(tracedResult); ok {
+		e.Metadata = traceMetadata(tr)
+	}
+	return json.Marshal(e)
+}
+
+// результат или заказ, знающий идентификатор заказа из конверта.
+type orderIdentified interface {
+	OrderID() string
+}
+
+// метаданные конверта результата: идентификатор корреляции и контекст трассировки
+func traceMetadata(tr tracedResult) map[string]string {
+	md := make(map[string]string)
+	if id := tr.CorrelationID(); id != "" {
+		md[CorrelationIDHeader] = id
+	}
+	if tc := tr.TraceContext(); tc.IsValid() {
+		md[TraceparentHeader] = tc.Traceparent()
+		if tc.TraceState != "" {
+			md[TracestateHeader] = tc.TraceState
+		}
+	}
+	if len(md) == 0 {
+		return nil
+	}
+	return md
+}
@@ -0,0 +1,107 @@
+package reactivetools
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnvelopeOrderCodec(t *testing.T) {
+	c := CheckOrderCodecs.Envelope
+
+	om, err := c.DecodeOrder([]byte(`{"schema_version":1,"order_id":"42","metadata":{"source":"pim"},` +
+		`"payload":{"object_type":"product","check_name":"images","object_identifier":"100"}}`))
+	if err != nil {
+		t.Fatalf("cant decode envelope: %v", err)
+	}
+	if om.OrderID != "42" || om.Metadata["source"] != "pim" || om.CheckName != "images" || om.ObjectIdentifier != "100" {
+		t.Fatalf("incorrect decoded order: %+v", om)
+	}
+
+	// сообщения без конверта разбираются как раньше
+	om, err = c.DecodeOrder([]byte(`{"object_type":"product","check_name":"images","object_identifier":"100"}`))
+	if err != nil || om.SchemaVersion != 0 || om.ObjectType != "product" {
+		t.Fatalf("cant decode legacy order: %+v, err: %v", om, err)
+	}
+
+	for _, data := range []string{
+		`not a json`,
+		`{"object_type":"product","check_name":"images"}`,
+		`{"schema_version":2,"payload":{"object_type":"product","check_name":"images","object_identifier":"100"}}`,
+	} {
+		if _, err := c.DecodeOrder([]byte(data)); err == nil {
+			t.Fatalf("malformed order must not be decoded: %v", data)
+		}
+	}
+}
+
+func TestEnvelopeResultCodec(t *testing.T) {
+	r := &checkResult{ot: "product", oid: "100", cn: "images", rm: "ok", cs: true, orderID: "42"}
+	data, err := CheckResultCodecs.Envelope.EncodeResult(r)
+	if err != nil {
+		t.Fatalf("cant encode result: %v", err)
+	}
+	e := envelope{}
+	err = json.Unmarshal(data, &e)
+	if err != nil {
+		t.Fatalf("cant parse envelope: %v", err)
+	}
+	dto := ResultDTO{}
+	err = json.Unmarshal(e.Payload, &dto)
+	if err != nil {
+		t.Fatalf("cant parse payload: %v", err)
+	}
+	if e.SchemaVersion != envelopeSchemaVersion || e.OrderID != "42" || dto.Identifier != "100" || !dto.CheckStatus {
+		t.Fatalf("incorrect encoded result: %+v, %+v", e, dto)
+	}
+}
+
+func TestDetailedResultDTO(t *testing.T) {
+	legacy, err := CheckResultCodecs.JSON.EncodeResult(NewCheckResult("product", "100", "images", "ok", true))
+	if err != nil {
+		t.Fatalf("cant encode result: %v", err)
+	}
+	expected := `{"object_type":"product","identifier":"100","check_name":"images","check_status":true,"check_message":"ok"}`
+	if string(legacy) != expected {
+		t.Fatalf("result without details must keep legacy format, got %s", legacy)
+	}
+
+	// результаты CheckProvider тоже публикуются без длительности
+	proc, err := NewCheckOrderProcessor(&delayCheckProvider{delay: func(o CheckOrder) time.Duration {
+		return time.Millisecond
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := newStubCheckOrder(0, nil)
+	if err := proc.Process(context.Background(), o); err != nil {
+		t.Fatalf("cant process order: %v", err)
+	}
+	checked, err := CheckResultCodecs.JSON.EncodeResult(<-o.Result())
+	if err != nil {
+		t.Fatalf("cant encode result: %v", err)
+	}
+	if strings.Contains(string(checked), "duration_ms") {
+		t.Fatalf("result of CheckProvider must keep legacy format, got %s", checked)
+	}
+
+	r := NewDetailedCheckResult("product", "100", "images", CheckDetails{
+		Message:    "no images",
+		Findings:   []Finding{{Field: "images", Code: "empty", Severity: SeverityError}},
+		Attributes: map[string]string{"checked": "3"},
+	}, time.Millisecond*1500)
+	data, err := CheckResultCodecs.JSON.EncodeResult(r)
+	if err != nil {
+		t.Fatalf("cant encode result: %v", err)
+	}
+	dto := ResultDTO{}
+	err = json.Unmarshal(data, &dto)
+	if err != nil {
+		t.Fatalf("cant parse result: %v", err)
+	}
+	if dto.Severity != SeverityError || len(dto.Findings) != 1 || dto.DurationMs != 1500 || dto.Attributes["checked"] != "3" {
+		t.Fatalf("incorrect detailed result: %+v", dto)
+	}
+}
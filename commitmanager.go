@@ -0,0 +1,212 @@
+package reactivetools
+
+import (
+	"context"
+	"github.com/iddqdeika/reactivetools/statistic"
+	"github.com/iddqdeika/rrr/helpful"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	ackRetryInterval = time.Millisecond * 100
+
+	// партиция для сообщений, которые не реализуют OffsetCarrier
+	unknownPartition = -1
+)
+
+// подтверждаемое сообщение (заказ на проверку, изменение).
+// реализации должны быть сравнимыми (как правило - указатели), т.к. используются как ключи.
+type acknowledgeable interface {
+	Ack() error
+}
+
+// сообщение, знающее свое положение в очереди.
+// если сообщение этот интерфейс не реализует (или партиция отрицательна), то считается,
+// что сообщения приходят в порядке записи и подтверждать их надо по одному в том же порядке.
+type OffsetCarrier interface {
+	Partition() int
+	Offset() int64
+}
+
+// менеджер подтверждений.
+// сообщения регистрируются (track) в порядке получения, а завершаются (complete) в любом порядке.
+// подтверждается только непрерывный обработанный префикс каждой партиции,
+// так что при падении сервиса не будет потерян ни один заказ, который еще в работе.
+// для сообщений с известным оффсетом подтверждается только последнее сообщение префикса
+// (коммит оффсета в кафка подтверждает и все предыдущие).
+func newCommitManager(l helpful.Logger) *commitManager {
+	return &commitManager{
+		l:          l,
+		partitions: make(map[int]*partitionCommits),
+		entries:    make(map[acknowledgeable]*commitEntry),
+		ackLatency: statistic.NewHistogram("Ack latency seconds", `Время подтверждения сообщения (с учетом повторов), в секундах.`),
+	}
+}
+
+type commitManager struct {
+	l helpful.Logger
+
+	m          sync.Mutex
+	seq        int64
+	partitions map[int]*partitionCommits
+	entries    map[acknowledgeable]*commitEntry
+
+	ackLatency *statistic.Histogram
+}
+
+func (m *commitManager) Statistics() ([]statistic.Statistic, error) {
+	return []statistic.Statistic{m.ackLatency}, nil
+}
+
+// сообщения партиции, ожидающие подтверждения, в порядке оффсетов.
+type partitionCommits struct {
+	pending []*commitEntry
+}
+
+type commitEntry struct {
+	item      acknowledgeable
+	partition int
+	offset    int64
+	done      bool
+}
+
+// регистрирует полученное сообщение. повторная регистрация (например, провайдером и сервисом) ничего не меняет.
+func (m *commitManager) track(a acknowledgeable) {
+	m.m.Lock()
+	defer m.m.Unlock()
+	if _, ok := m.entries[a]; ok {
+		return
+	}
+	e := &commitEntry{item: a}
+	if oc, ok := a.(OffsetCarrier); ok && oc.Partition() >= 0 {
+		e.partition, e.offset = oc.Partition(), oc.Offset()
+	} else {
+		m.seq++
+		e.partition, e.offset = unknownPartition, m.seq
+	}
+	p, ok := m.partitions[e.partition]
+	if !ok {
+		p = &partitionCommits{}
+		m.partitions[e.partition] = p
+	}
+	// как правило сообщения приходят по возрастанию оффсета, так что вставка - в конец
+	i := sort.Search(len(p.pending), func(i int) bool {
+		return p.pending[i].offset > e.offset
+	})
+	p.pending = append(p.pending, nil)
+	copy(p.pending[i+1:], p.pending[i:])
+	p.pending[i] = e
+	m.entries[a] = e
+}
+
+// отмечает сообщение обработанным и подтверждает то, что стало возможным подтвердить.
+// подтверждение происходит под блокировкой, так что оффсеты коммитятся строго по возрастанию.
+func (m *commitManager) complete(ctx context.Context, a acknowledgeable) {
+	m.m.Lock()
+	defer m.m.Unlock()
+	e, ok := m.entries[a]
+	if !ok {
+		// после остановки (nackPending) сообщения уже не отслеживаются и подтверждать их нельзя
+		if ctx.Err() != nil {
+			return
+		}
+		m.l.Errorf("completed message was not tracked, acking it as is")
+		m.ack(ctx, a)
+		return
+	}
+	e.done = true
+	p := m.partitions[e.partition]
+
+	n := 0
+	for n < len(p.pending) && p.pending[n].done {
+		n++
+	}
+	if n == 0 {
+		return
+	}
+	ready := p.pending[:n]
+	if e.partition != unknownPartition {
+		// коммит оффсета подтверждает и все предыдущие сообщения партиции
+		ready = ready[n-1:]
+	}
+	for _, r := range ready {
+		m.ack(ctx, r.item)
+	}
+	for _, r := range p.pending[:n] {
+		delete(m.entries, r.item)
+	}
+	p.pending = p.pending[n:]
+}
+
+// регистрирует и сразу завершает сообщение, которое не будет обработано (пропущено, некорректно).
+// оно подтверждается только после всех более ранних сообщений, так что не коммитит оффсеты тех, что еще в работе.
+func (m *commitManager) skip(ctx context.Context, a acknowledgeable) {
+	m.track(a)
+	m.complete(ctx, a)
+}
+
+// провайдер, сам регистрирующий в своем менеджере подтверждений все прочитанные сообщения в порядке чтения
+// и сразу завершающий те, что не отдает на обработку.
+// сервис с таким провайдером завершает сообщения в менеджере провайдера, а не в своем.
+type committingProvider interface {
+	commitManager() *commitManager
+}
+
+// менеджер подтверждений провайдера, если провайдер его ведет, иначе - новый.
+func providerCommitManager(prov interface{}, l helpful.Logger) *commitManager {
+	if cp, ok := prov.(committingProvider); ok {
+		return cp.commitManager()
+	}
+	return newCommitManager(l)
+}
+
+// сообщения, которые зарегистрированы, но еще не подтверждены.
+func (m *commitManager) pending() []acknowledgeable {
+	m.m.Lock()
+	defer m.m.Unlock()
+	res := make([]acknowledgeable, 0, len(m.entries))
+	for _, p := range m.partitions {
+		for _, e := range p.pending {
+			res = append(res, e.item)
+		}
+	}
+	return res
+}
+
+// отклоняет (Nack) все неподтвержденные сообщения и перестает их отслеживать.
+// используется при остановке сервиса, когда ждать их завершения больше нельзя.
+func (m *commitManager) nackPending() {
+	for _, a := range m.pending() {
+		n, ok := a.(interface{ Nack() error })
+		if !ok {
+			continue
+		}
+		err := n.Nack()
+		if err != nil {
+			m.l.Errorf("cant nack message, err: %v", err)
+		}
+	}
+	m.m.Lock()
+	defer m.m.Unlock()
+	m.partitions = make(map[int]*partitionCommits)
+	m.entries = make(map[acknowledgeable]*commitEntry)
+}
+
+// подтверждает сообщение, повторяя попытки до закрытия контекста.
+func (m *commitManager) ack(ctx context.Context, a acknowledgeable) {
+	defer m.ackLatency.ObserveSince(time.Now())
+	for {
+		err := a.Ack()
+		if err == nil {
+			return
+		}
+		m.l.Errorf("cant ack message, waiting %v, err: %v", ackRetryInterval, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(ackRetryInterval):
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package reactivetools
+
+import (
+	"context"
+	"github.com/iddqdeika/rrr/helpful"
+	"reflect"
+	"testing"
+)
+
+func TestCommitManagerOutOfOrder(t *testing.T) {
+	p := &stubOrderProvider{}
+	m := newCommitManager(helpful.DefaultLogger.WithLevel(helpful.LogNone))
+	orders := make([]CheckOrder, 5)
+	for i := range orders {
+		orders[i] = newStubCheckOrder(int64(i), p.ack)
+		m.track(orders[i])
+	}
+
+	ctx := context.Background()
+	for _, i := range []int{2, 0, 1, 4, 3} {
+		m.complete(ctx, orders[i])
+	}
+	// 2 ждет 0, 0 подтверждается сразу, 1 открывает 2, 4 ждет 3
+	expected := []int64{0, 2, 4}
+	if acked := p.ackedOffsets(); !reflect.DeepEqual(acked, expected) {
+		t.Fatalf("incorrect acked offsets: %v, expected %v", acked, expected)
+	}
+	if pending := m.pending(); len(pending) != 0 {
+		t.Fatalf("all orders must be acked, but %v are pending", len(pending))
+	}
+}
+
+func TestCommitManagerWithoutOffsets(t *testing.T) {
+	var acked []string
+	m := newCommitManager(helpful.DefaultLogger.WithLevel(helpful.LogNone))
+	events := make([]*ackRecordingEvent, 3)
+	for i := range events {
+		events[i] = &ackRecordingEvent{
+			ChangeEvent: newStubChangeEvent("stubObject", string(rune('a'+i)), "stubEvent", "stubData"),
+			acked:       &acked,
+		}
+		m.track(events[i])
+	}
+
+	ctx := context.Background()
+	m.complete(ctx, events[2])
+	m.complete(ctx, events[1])
+	if len(acked) != 0 {
+		t.Fatalf("events must not be acked before the first one is completed, acked: %v", acked)
+	}
+	m.complete(ctx, events[0])
+	// без оффсетов каждое изменение подтверждается отдельно, но по порядку
+	expected := []string{"a", "b", "c"}
+	if !reflect.DeepEqual(acked, expected) {
+		t.Fatalf("incorrect acked events: %v, expected %v", acked, expected)
+	}
+}
+
+type ackRecordingEvent struct {
+	ChangeEvent
+	acked *[]string
+}
+
+func (e *ackRecordingEvent) Ack() error {
+	*e.acked = append(*e.acked, e.ObjectIdentifier())
+	return nil
+}
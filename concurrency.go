@@ -0,0 +1,321 @@
+package reactivetools
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/iddqdeika/reactivetools/statistic"
+	"github.com/iddqdeika/rrr/helpful"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// адаптивный параллелизм:
+	// "adaptive_concurrency": {"min_parallelism": 1, "max_parallelism": 20, "target_latency_in_ms": 2000,
+	//   "max_error_rate_percent": 10, "decrease_percent": 25}
+	AdaptiveConcurrencyConfigKey = "adaptive_concurrency"
+
+	// http метод сервиса статистик для просмотра и ручной установки параллелизма
+	ConcurrencyEndpointPath = "/concurrency"
+
+	defaultMaxErrorRatePercent = 10
+	defaultDecreasePercent     = 25
+)
+
+// настройки адаптивного параллелизма.
+// параллелизм меняется по окнам из стольких попыток обработки, каков текущий параллелизм (AIMD):
+// если в окне доля ошибок больше MaxErrorRate или средняя длительность попытки больше TargetLatency -
+// параллелизм уменьшается на Decrease (доля от текущего), иначе, если все слоты были заняты, - растет на 1.
+type AdaptiveConcurrencySettings struct {
+	Min           int
+	Max           int
+	TargetLatency time.Duration
+	MaxErrorRate  float64
+	Decrease      float64
+}
+
+// собирает настройки из раздела adaptive_concurrency. parallelism - верхняя граница и значение max по умолчанию.
+func NewAdaptiveConcurrencySettings(cfg helpful.Config, parallelism int) (AdaptiveConcurrencySettings, error) {
+	if cfg == nil {
+		return AdaptiveConcurrencySettings{}, fmt.Errorf("must be not-nil Config")
+	}
+	min, err := optionalInt(cfg, "min_parallelism", 1)
+	if err != nil {
+		return AdaptiveConcurrencySettings{}, err
+	}
+	max, err := optionalInt(cfg, "max_parallelism", parallelism)
+	if err != nil {
+		return AdaptiveConcurrencySettings{}, err
+	}
+	if min < 1 || max < min {
+		return AdaptiveConcurrencySettings{}, fmt.Errorf("must be 1 <= min_parallelism <= max_parallelism")
+	}
+	if max > parallelism {
+		return AdaptiveConcurrencySettings{}, fmt.Errorf("max_parallelism must not exceed parallelism %v", parallelism)
+	}
+	latency, err := cfg.GetInt("target_latency_in_ms")
+	if err != nil {
+		return AdaptiveConcurrencySettings{}, err
+	}
+	if latency <= 0 {
+		return AdaptiveConcurrencySettings{}, fmt.Errorf("target_latency_in_ms must be positive")
+	}
+	errRate, err := optionalInt(cfg, "max_error_rate_percent", defaultMaxErrorRatePercent)
+	if err != nil {
+		return AdaptiveConcurrencySettings{}, err
+	}
+	if errRate < 0 || errRate > 100 {
+		return AdaptiveConcurrencySettings{}, fmt.Errorf("max_error_rate_percent must be between 0 and 100")
+	}
+	decrease, err := optionalInt(cfg, "decrease_percent", defaultDecreasePercent)
+	if err != nil {
+		return AdaptiveConcurrencySettings{}, err
+	}
+	if decrease <= 0 || decrease >= 100 {
+		return AdaptiveConcurrencySettings{}, fmt.Errorf("decrease_percent must be between 1 and 99")
+	}
+	return AdaptiveConcurrencySettings{
+		Min:           min,
+		Max:           max,
+		TargetLatency: time.Duration(latency) * time.Millisecond,
+		MaxErrorRate:  float64(errRate) / 100,
+		Decrease:      float64(decrease) / 100,
+	}, nil
+}
+
+// адаптивный ограничитель параллелизма, если он задан в конфиге (иначе nil)
+func adaptiveLimiterFromConfig(cfg helpful.Config, parallelism int, subject string) (*adaptiveLimiter, error) {
+	if !cfg.Contains(AdaptiveConcurrencyConfigKey) {
+		return nil, nil
+	}
+	s, err := NewAdaptiveConcurrencySettings(cfg.Child(AdaptiveConcurrencyConfigKey), parallelism)
+	if err != nil {
+		return nil, fmt.Errorf("incorrect %v: %v", AdaptiveConcurrencyConfigKey, err)
+	}
+	return newAdaptiveLimiter(s, subject), nil
+}
+
+// начинает с максимального параллелизма, чтобы включение режима не снижало пропускную способность
+func newAdaptiveLimiter(s AdaptiveConcurrencySettings, subject string) *adaptiveLimiter {
+	l := &adaptiveLimiter{
+		s:       s,
+		limit:   s.Max,
+		changed: make(chan struct{}),
+		gauge:   statistic.NewGauge("Concurrency limit for "+subject, `Текущий предел параллелизма обработки заказов.`),
+		increases: statistic.NewCounter("Concurrency limit increases for "+subject,
+			`Кол-во увеличений предела параллелизма.`),
+		decreases: statistic.NewCounter("Concurrency limit decreases for "+subject,
+			`Кол-во уменьшений предела параллелизма.`),
+	}
+	l.gauge.Set(int64(l.limit))
+	return l
+}
+
+type adaptiveLimiter struct {
+	s AdaptiveConcurrencySettings
+
+	m        sync.Mutex
+	limit    int
+	inFlight int
+	// предел, установленный вручную (0 - адаптивный режим)
+	override int
+	// закрывается и заменяется при освобождении слота или изменении предела
+	changed chan struct{}
+
+	// текущее окно
+	samples   int
+	errors    int
+	latency   time.Duration
+	saturated bool
+
+	gauge     *statistic.Gauge
+	increases *statistic.Counter
+	decreases *statistic.Counter
+}
+
+// ждет свободного слота в пределах текущего предела. false - контекст закрыт.
+func (l *adaptiveLimiter) acquire(ctx context.Context) bool {
+	for {
+		l.m.Lock()
+		if l.inFlight < l.current() {
+			l.inFlight++
+			if l.inFlight == l.current() {
+				l.saturated = true
+			}
+			l.m.Unlock()
+			return true
+		}
+		ch := l.changed
+		l.m.Unlock()
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+func (l *adaptiveLimiter) release() {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.inFlight--
+	l.notify()
+}
+
+// учитывает попытку обработки и по окончании окна пересчитывает предел
+func (l *adaptiveLimiter) observe(d time.Duration, err error) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.samples++
+	l.latency += d
+	if err != nil {
+		l.errors++
+	}
+	if l.samples < l.limit {
+		return
+	}
+	errRate := float64(l.errors) / float64(l.samples)
+	avg := l.latency / time.Duration(l.samples)
+	switch {
+	case errRate > l.s.MaxErrorRate || avg > l.s.TargetLatency:
+		limit := int(float64(l.limit) * (1 - l.s.Decrease))
+		if limit < l.s.Min {
+			limit = l.s.Min
+		}
+		if limit < l.limit {
+			l.limit = limit
+			l.decreases.Inc()
+		}
+	case l.saturated && l.limit < l.s.Max:
+		l.limit++
+		l.increases.Inc()
+		l.notify()
+	}
+	l.samples, l.errors, l.latency, l.saturated = 0, 0, 0, false
+	l.gauge.Set(int64(l.current()))
+}
+
+// действующий предел. вызывается под мьютексом.
+func (l *adaptiveLimiter) current() int {
+	if l.override > 0 {
+		return l.override
+	}
+	return l.limit
+}
+
+// будит ожидающих слота. вызывается под мьютексом.
+func (l *adaptiveLimiter) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// устанавливает предел вручную (в пределах min/max). 0 - возврат к адаптивному режиму.
+func (l *adaptiveLimiter) setOverride(limit int) error {
+	if limit != 0 && (limit < l.s.Min || limit > l.s.Max) {
+		return fmt.Errorf("limit must be between %v and %v", l.s.Min, l.s.Max)
+	}
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.override = limit
+	l.gauge.Set(int64(l.current()))
+	l.notify()
+	return nil
+}
+
+// состояние ограничителя для http метода
+type concurrencyState struct {
+	Limit      int  `json:"limit"`
+	Adaptive   int  `json:"adaptive_limit"`
+	Min        int  `json:"min"`
+	Max        int  `json:"max"`
+	InFlight   int  `json:"in_flight"`
+	Overridden bool `json:"overridden"`
+}
+
+func (l *adaptiveLimiter) state() concurrencyState {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return concurrencyState{
+		Limit:      l.current(),
+		Adaptive:   l.limit,
+		Min:        l.s.Min,
+		Max:        l.s.Max,
+		InFlight:   l.inFlight,
+		Overridden: l.override > 0,
+	}
+}
+
+func (l *adaptiveLimiter) Statistics() ([]statistic.Statistic, error) {
+	return []statistic.Statistic{l.gauge, l.increases, l.decreases}, nil
+}
+
+// http метод /concurrency для ограничителей сервисов (по названию сервиса).
+// GET - состояние всех ограничителей.
+// POST ?limit=N - ручная установка предела, ?limit=auto - возврат к адаптивному режиму.
+// если ограничителей несколько, сервис указывается параметром ?service=<название>.
+// без ограничителей метод не добавляется.
+func concurrencyEndpoints(limiters map[string]*adaptiveLimiter) []statistic.Endpoint {
+	if len(limiters) == 0 {
+		return nil
+	}
+	return []statistic.Endpoint{{Path: ConcurrencyEndpointPath, Handler: func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+			states := make(map[string]concurrencyState, len(limiters))
+			for name, l := range limiters {
+				states[name] = l.state()
+			}
+			data, err := json.Marshal(states)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(data)
+		case http.MethodPost, http.MethodPut:
+			l, err := concurrencyLimiterByName(limiters, req.FormValue("service"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			limit := 0
+			if v := req.FormValue("limit"); v != "auto" {
+				limit, err = strconv.Atoi(v)
+				if err != nil || limit < 1 {
+					http.Error(w, "limit must be a positive integer or auto", http.StatusBadRequest)
+					return
+				}
+			}
+			err = l.setOverride(limit)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}}}
+}
+
+func concurrencyLimiterByName(limiters map[string]*adaptiveLimiter, name string) (*adaptiveLimiter, error) {
+	if name == "" && len(limiters) == 1 {
+		for _, l := range limiters {
+			return l, nil
+		}
+	}
+	l, ok := limiters[name]
+	if !ok {
+		names := make([]string, 0, len(limiters))
+		for n := range limiters {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown service %q, must be one of: %v", name, names)
+	}
+	return l, nil
+}
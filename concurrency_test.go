@@ -0,0 +1,80 @@
+package reactivetools
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveLimiter(t *testing.T) {
+	l := newAdaptiveLimiter(AdaptiveConcurrencySettings{
+		Min:           2,
+		Max:           8,
+		TargetLatency: time.Millisecond * 100,
+		MaxErrorRate:  0.1,
+		Decrease:      0.5,
+	}, "orders")
+
+	// окно с ошибками - предел уменьшается вдвое, но не ниже min
+	for i := 0; i < 8; i++ {
+		l.observe(time.Millisecond, errors.New("unavailable"))
+	}
+	for i := 0; i < 4; i++ {
+		l.observe(time.Second, nil)
+	}
+	for i := 0; i < 2; i++ {
+		l.observe(time.Second, nil)
+	}
+	if s := l.state(); s.Limit != 2 {
+		t.Fatalf("expected limit 2, got %+v", s)
+	}
+
+	// слоты заняты, попытки быстрые и успешные - предел растет на 1
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	if !l.acquire(ctx) || !l.acquire(ctx) {
+		t.Fatal("must acquire up to limit")
+	}
+	if l.acquire(ctx) {
+		t.Fatal("must not acquire over limit")
+	}
+	l.observe(time.Millisecond, nil)
+	l.observe(time.Millisecond, nil)
+	if s := l.state(); s.Limit != 3 || s.InFlight != 2 {
+		t.Fatalf("expected limit 3 with 2 in flight, got %+v", s)
+	}
+	l.release()
+	l.release()
+
+	// ручная установка через http метод
+	h := concurrencyEndpoints(map[string]*adaptiveLimiter{"orders": l})[0].Handler
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodPost, ConcurrencyEndpointPath+"?limit=6", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("unexpected response %v: %v", rec.Code, rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodPost, ConcurrencyEndpointPath+"?limit=9", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("limit over max must be rejected, got %v", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodGet, ConcurrencyEndpointPath, nil))
+	states := make(map[string]concurrencyState)
+	err := json.Unmarshal(rec.Body.Bytes(), &states)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := states["orders"]; s.Limit != 6 || s.Adaptive != 3 || !s.Overridden {
+		t.Fatalf("unexpected state %+v", s)
+	}
+	rec = httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodPost, ConcurrencyEndpointPath+"?limit=auto", nil))
+	if s := l.state(); rec.Code != http.StatusNoContent || s.Limit != 3 || s.Overridden {
+		t.Fatalf("expected adaptive limit after reset, got %+v", s)
+	}
+}
@@ -0,0 +1,250 @@
+package reactivetools
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/iddqdeika/rrr/helpful"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// флаг командной строки с путем к конфигу: -config=/etc/app/config.yaml
+	ConfigPathFlag = "config"
+	// переменная окружения с путем к конфигу, если флаг не задан
+	ConfigPathEnv = "CONFIG_PATH"
+	// префикс переменных окружения, переопределяющих ключи конфига.
+	// путь к ключу записывается в верхнем регистре через "__":
+	// CONFIG__CHECK_ORDER_PROVIDER__KAFKA__BROKERS переопределяет check_order_provider.KAFKA.BROKERS
+	ConfigEnvPrefix = "CONFIG__"
+
+	configEnvSeparator = "__"
+
+	// раздел с настройками кафка в конфигах компонент
+	kafkaConfigKey = "KAFKA"
+)
+
+// путь к конфигу: флаг -config (или --config), затем переменная окружения CONFIG_PATH, иначе config.json.
+func ConfigPath() string {
+	if p := configPathFromArgs(os.Args[1:]); p != "" {
+		return p
+	}
+	if p := os.Getenv(ConfigPathEnv); p != "" {
+		return p
+	}
+	return checkServiceJsonConfigFileName
+}
+
+// флаги разбираются вручную: flag.Parse приложения может объявлять свои флаги или не вызываться вовсе
+func configPathFromArgs(args []string) string {
+	for i, a := range args {
+		if a == "--" {
+			return ""
+		}
+		name := strings.TrimLeft(a, "-")
+		if name == a || len(a)-len(name) > 2 {
+			continue
+		}
+		if name == ConfigPathFlag && i+1 < len(args) {
+			return args[i+1]
+		}
+		if strings.HasPrefix(name, ConfigPathFlag+"=") {
+			return strings.TrimPrefix(name, ConfigPathFlag+"=")
+		}
+	}
+	return ""
+}
+
+// читает конфиг по пути из ConfigPath.
+func LoadConfigFromEnvironment() (helpful.Config, error) {
+	return LoadConfig(ConfigPath())
+}
+
+// читает конфиг из json или yaml (по расширению .yaml/.yml) файла.
+// значения ключей переопределяются переменными окружения с префиксом ConfigEnvPrefix,
+// в том числе для ключей, которых в файле нет.
+func LoadConfig(path string) (helpful.Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cant read config %v: %v", path, err)
+	}
+	values := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		var raw interface{}
+		err = yaml.Unmarshal(data, &raw)
+		if err != nil {
+			return nil, fmt.Errorf("cant parse yaml config %v: %v", path, err)
+		}
+		if raw != nil {
+			m, ok := normalizeYaml(raw).(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("yaml config %v must be a mapping", path)
+			}
+			values = m
+		}
+	default:
+		err = json.Unmarshal(data, &values)
+		if err != nil {
+			return nil, fmt.Errorf("cant parse json config %v: %v", path, err)
+		}
+	}
+	return newFileConfig(values, envOverrides(os.Environ())), nil
+}
+
+// переменные окружения с префиксом ConfigEnvPrefix по пути ключа (без префикса)
+func envOverrides(environ []string) map[string]string {
+	res := make(map[string]string)
+	for _, kv := range environ {
+		i := strings.Index(kv, "=")
+		if i < 0 || !strings.HasPrefix(kv[:i], ConfigEnvPrefix) {
+			continue
+		}
+		res[strings.ToUpper(kv[len(ConfigEnvPrefix):i])] = kv[i+1:]
+	}
+	return res
+}
+
+// yaml отдает вложенные словари как map[interface{}]interface{}
+func normalizeYaml(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, v := range t {
+			m[fmt.Sprint(k)] = normalizeYaml(v)
+		}
+		return m
+	case []interface{}:
+		for i := range t {
+			t[i] = normalizeYaml(t[i])
+		}
+	}
+	return v
+}
+
+func newFileConfig(values map[string]interface{}, env map[string]string) *fileConfig {
+	return &fileConfig{values: values, env: env}
+}
+
+// конфиг из файла с переопределением ключей переменными окружения.
+// ошибки содержат полный путь ключа.
+type fileConfig struct {
+	values map[string]interface{}
+	env    map[string]string
+	path   []string
+}
+
+func (c *fileConfig) keyPath(key string) string {
+	return strings.Join(append(append([]string(nil), c.path...), key), ".")
+}
+
+func (c *fileConfig) envKey(key string) string {
+	return strings.ToUpper(strings.Join(append(append([]string(nil), c.path...), key), configEnvSeparator))
+}
+
+func (c *fileConfig) value(key string) (interface{}, error) {
+	if v, ok := c.env[c.envKey(key)]; ok {
+		return v, nil
+	}
+	v, ok := c.values[key]
+	if !ok || v == nil {
+		return nil, fmt.Errorf("config key %v is missing", c.keyPath(key))
+	}
+	return v, nil
+}
+
+func (c *fileConfig) GetString(key string) (string, error) {
+	v, err := c.value(key)
+	if err != nil {
+		return "", err
+	}
+	switch t := v.(type) {
+	case string:
+		return t, nil
+	case map[string]interface{}, []interface{}:
+		return "", fmt.Errorf("config key %v must be a string", c.keyPath(key))
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64), nil
+	}
+	return fmt.Sprint(v), nil
+}
+
+func (c *fileConfig) GetInt(key string) (int, error) {
+	v, err := c.value(key)
+	if err != nil {
+		return 0, err
+	}
+	switch t := v.(type) {
+	case int:
+		return t, nil
+	case float64:
+		if t == float64(int(t)) {
+			return int(t), nil
+		}
+	case string:
+		i, err := strconv.Atoi(strings.TrimSpace(t))
+		if err == nil {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("config key %v must be an integer, got %v", c.keyPath(key), v)
+}
+
+// вложенный раздел. для отсутствующего раздела возвращается пустой конфиг,
+// который все еще учитывает переопределения из окружения.
+func (c *fileConfig) Child(key string) helpful.Config {
+	values, _ := c.values[key].(map[string]interface{})
+	return &fileConfig{
+		values: values,
+		env:    c.env,
+		path:   append(append([]string(nil), c.path...), key),
+	}
+}
+
+func (c *fileConfig) Contains(key string) bool {
+	if v, ok := c.values[key]; ok && v != nil {
+		return true
+	}
+	prefix := c.envKey(key)
+	for k := range c.env {
+		if k == prefix || strings.HasPrefix(k, prefix+configEnvSeparator) {
+			return true
+		}
+	}
+	return false
+}
+
+// проверяет наличие всех ключей (пути через точку: "check_order_provider.KAFKA").
+// возвращает одну ошибку со всеми отсутствующими ключами.
+func RequireConfigKeys(cfg helpful.Config, paths ...string) error {
+	var missing []string
+	for _, p := range paths {
+		if !configContains(cfg, p) {
+			missing = append(missing, p)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	return fmt.Errorf("config keys are missing: %v", strings.Join(missing, ", "))
+}
+
+// путь к ключу через точку
+func configKey(keys ...string) string {
+	return strings.Join(keys, ".")
+}
+
+func configContains(cfg helpful.Config, path string) bool {
+	keys := strings.Split(path, ".")
+	for _, k := range keys[:len(keys)-1] {
+		if !cfg.Contains(k) {
+			return false
+		}
+		cfg = cfg.Child(k)
+	}
+	return cfg.Contains(keys[len(keys)-1])
+}
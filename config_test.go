@@ -0,0 +1,83 @@
+package reactivetools
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"config.json": `{"parallelism": 4, "check_order_provider": {"check_name": "images", "KAFKA": {"BROKERS": "kafka:9092"}}}`,
+		"config.yaml": "parallelism: 4\ncheck_order_provider:\n  check_name: images\n  KAFKA:\n    BROKERS: kafka:9092\n",
+	}
+	os.Setenv("CONFIG__CHECK_ORDER_PROVIDER__KAFKA__BROKERS", "broker-1:9092,broker-2:9092")
+	os.Setenv("CONFIG__CHANGES_PROCESSOR__CONN_STRING", "sqlserver://secret")
+	defer os.Unsetenv("CONFIG__CHECK_ORDER_PROVIDER__KAFKA__BROKERS")
+	defer os.Unsetenv("CONFIG__CHANGES_PROCESSOR__CONN_STRING")
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		err := ioutil.WriteFile(path, []byte(content), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := LoadConfig(path)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		p, err := cfg.GetInt("parallelism")
+		if err != nil || p != 4 {
+			t.Errorf("%v: unexpected parallelism %v, %v", name, p, err)
+		}
+		cn, err := cfg.Child(CheckOrderProviderConfigKey).GetString("check_name")
+		if err != nil || cn != "images" {
+			t.Errorf("%v: unexpected check name %v, %v", name, cn, err)
+		}
+		brokers, err := cfg.Child(CheckOrderProviderConfigKey).Child("KAFKA").GetString("BROKERS")
+		if err != nil || brokers != "broker-1:9092,broker-2:9092" {
+			t.Errorf("%v: env override not applied: %v, %v", name, brokers, err)
+		}
+		if !cfg.Contains("changes_processor") {
+			t.Errorf("%v: section defined only by env must be contained", name)
+		}
+		cs, err := cfg.Child("changes_processor").GetString("conn_string")
+		if err != nil || cs != "sqlserver://secret" {
+			t.Errorf("%v: unexpected conn string %v, %v", name, cs, err)
+		}
+
+		_, err = cfg.Child(CheckOrderProviderConfigKey).GetString("object_type")
+		if err == nil || !strings.Contains(err.Error(), "check_order_provider.object_type") {
+			t.Errorf("%v: error must contain full key path, got %v", name, err)
+		}
+		err = RequireConfigKeys(cfg, "parallelism", "check_order_provider.object_type", "statistics.port")
+		if err == nil || !strings.Contains(err.Error(), "check_order_provider.object_type, statistics.port") {
+			t.Errorf("%v: all missing keys must be reported, got %v", name, err)
+		}
+	}
+}
+
+func TestConfigPathFromArgs(t *testing.T) {
+	for _, c := range []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"-config", "/etc/app.yaml"}, "/etc/app.yaml"},
+		{[]string{"-v", "--config=/etc/app.json"}, "/etc/app.json"},
+		{[]string{"-configs=x"}, ""},
+		{[]string{"--", "-config", "x"}, ""},
+		{nil, ""},
+	} {
+		if p := configPathFromArgs(c.args); p != c.expected {
+			t.Errorf("args %v: expected %q, got %q", c.args, c.expected, p)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package reactivetools
+
+import (
+	"context"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"github.com/iddqdeika/reactivetools/statistic"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// окно, за которое считается скорость потребления
+	consumptionRateWindow = time.Minute
+)
+
+// учет полученных, но еще не подтвержденных сообщений провайдера и скорости потребления.
+func newConsumptionTracker() *consumptionTracker {
+	return &consumptionTracker{
+		partitions: make(map[int][]trackedMessage),
+		rate:       newRateMeter(consumptionRateWindow),
+	}
+}
+
+type consumptionTracker struct {
+	m          sync.Mutex
+	seq        int64
+	partitions map[int][]trackedMessage
+	rate       *rateMeter
+}
+
+type trackedMessage struct {
+	offset int64
+	// время записи в очередь, если оно известно, иначе - время получения
+	received time.Time
+}
+
+// регистрирует полученное сообщение. возвращает функцию, которую надо вызвать после его подтверждения.
+func (t *consumptionTracker) received(md MessageMetadata) func() {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.rate.add(1)
+	tm := trackedMessage{offset: md.Offset, received: md.Timestamp}
+	if tm.received.IsZero() {
+		tm.received = time.Now()
+	}
+	partition := md.Partition
+	if partition < 0 {
+		// без оффсетов сообщения подтверждаются по одному
+		t.seq++
+		partition, tm.offset = unknownPartition, t.seq
+	}
+	t.partitions[partition] = append(t.partitions[partition], tm)
+	return func() {
+		t.acked(partition, tm.offset)
+	}
+}
+
+// подтверждение оффсета в кафка подтверждает и все предыдущие сообщения партиции
+func (t *consumptionTracker) acked(partition int, offset int64) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	pending := t.partitions[partition]
+	rest := pending[:0]
+	for _, tm := range pending {
+		if tm.offset > offset || (partition == unknownPartition && tm.offset != offset) {
+			rest = append(rest, tm)
+		}
+	}
+	t.partitions[partition] = rest
+}
+
+// возраст самого старого неподтвержденного сообщения
+func (t *consumptionTracker) oldestAge() time.Duration {
+	t.m.Lock()
+	defer t.m.Unlock()
+	var oldest time.Time
+	for _, pending := range t.partitions {
+		for _, tm := range pending {
+			if oldest.IsZero() || tm.received.Before(oldest) {
+				oldest = tm.received
+			}
+		}
+	}
+	if oldest.IsZero() {
+		return 0
+	}
+	return time.Since(oldest)
+}
+
+// статистики потребления топика: возраст самого старого неподтвержденного сообщения
+// и скорость потребления (сообщений в секунду).
+// subject - что потребляется (для названий статистик), what - как называются сообщения (order, change).
+func (t *consumptionTracker) statistics(subject, what string) []statistic.Statistic {
+	return []statistic.Statistic{
+		statistic.NewGaugeValue(fmt.Sprintf("Oldest unprocessed %v age seconds for %v", what, subject),
+			`Возраст самого старого полученного, но еще не подтвержденного сообщения, в секундах.`, t.oldestAge().Seconds()),
+		statistic.NewGaugeValue(fmt.Sprintf("Consumed %v per second for %v", what, subject),
+			`Скорость получения сообщений из топика за последнюю минуту.`, t.rate.perSecond()),
+	}
+}
+
+// лаг группы потребителей топика: по каждой партиции и общий.
+// адаптер кафка отдает только лаг одной партиции (GetConsumerLagForSinglePartition),
+// поэтому оффсеты партиций и группы запрашиваются у кафка напрямую.
+type consumerLag struct {
+	kafka   kafkaSettings
+	topic   string
+	subject string
+}
+
+func (l *consumerLag) Statistics() ([]statistic.Statistic, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), lagRetrievingTimeout)
+	defer cancel()
+	lags := make(chan map[int32]int64, 1)
+	err := withKafkaClient(ctx, l.kafka, func(c sarama.Client) error {
+		res, err := consumerGroupLag(c, l.kafka.group, l.topic)
+		lags <- res
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cant get consumer lag for kafka: %v", err)
+	}
+	return lagStatistics(<-lags, l.subject), nil
+}
+
+func lagStatistics(lags map[int32]int64, subject string) []statistic.Statistic {
+	partitions := make([]int32, 0, len(lags))
+	var total int64
+	for p, lag := range lags {
+		partitions = append(partitions, p)
+		total += lag
+	}
+	sort.Slice(partitions, func(i, j int) bool {
+		return partitions[i] < partitions[j]
+	})
+
+	ss := []statistic.Statistic{
+		statistic.NewGaugeValue(fmt.Sprintf("Consumer lag for %v", subject),
+			`Очередь на обработку. Сумма по партициям разниц между оффсетами последних записанного и подтвержденного сообщений.`,
+			float64(total)),
+	}
+	for _, p := range partitions {
+		ss = append(ss, statistic.NewGaugeValue(fmt.Sprintf("Consumer lag for %v, partition %v", subject, p),
+			`Очередь на обработку в партиции.`, float64(lags[p])))
+	}
+	return ss
+}
+
+// скорость событий за скользящее окно (по секундным корзинам).
+func newRateMeter(window time.Duration) *rateMeter {
+	n := int(window / time.Second)
+	if n < 1 {
+		n = 1
+	}
+	return &rateMeter{buckets: make([]int64, n), started: time.Now()}
+}
+
+type rateMeter struct {
+	m       sync.Mutex
+	buckets []int64
+	last    int64
+	started time.Time
+}
+
+func (r *rateMeter) add(n int64) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	now := r.advance()
+	r.buckets[now%int64(len(r.buckets))] += n
+}
+
+func (r *rateMeter) perSecond() float64 {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.advance()
+	var sum int64
+	for _, b := range r.buckets {
+		sum += b
+	}
+	// пока окно не заполнено - делим на прошедшее время
+	window := math.Min(time.Since(r.started).Seconds(), float64(len(r.buckets)))
+	if window < 1 {
+		window = 1
+	}
+	return float64(sum) / window
+}
+
+// обнуляет корзины, которые вышли из окна. возвращает номер текущей секунды.
+func (r *rateMeter) advance() int64 {
+	now := int64(time.Since(r.started) / time.Second)
+	for s := r.last + 1; s <= now && s <= r.last+int64(len(r.buckets)); s++ {
+		r.buckets[s%int64(len(r.buckets))] = 0
+	}
+	if now > r.last {
+		r.last = now
+	}
+	return now
+}
@@ -0,0 +1,96 @@
+package reactivetools
+
+import (
+	"github.com/Shopify/sarama"
+	"github.com/iddqdeika/reactivetools/statistic"
+	"testing"
+	"time"
+)
+
+func TestConsumptionTracker(t *testing.T) {
+	ct := newConsumptionTracker()
+	ackUnknown := ct.received(MessageMetadata{Partition: unknownPartition, Offset: -1})
+	time.Sleep(time.Millisecond * 100)
+	ack0 := ct.received(MessageMetadata{Partition: 0, Offset: 0})
+	ct.received(MessageMetadata{Partition: 0, Offset: 1})
+	ack2 := ct.received(MessageMetadata{Partition: 0, Offset: 2})
+
+	if age := ct.oldestAge(); age < time.Millisecond*100 {
+		t.Fatalf("oldest age must count message without offset, got %v", age)
+	}
+	ackUnknown()
+	ack0()
+	if age := ct.oldestAge(); age >= time.Millisecond*100 {
+		t.Fatalf("oldest age must be of offset 1, got %v", age)
+	}
+	// подтверждение оффсета подтверждает и все предыдущие
+	ack2()
+	if age := ct.oldestAge(); age != 0 {
+		t.Fatalf("all messages acked, got oldest age %v", age)
+	}
+	if rate := ct.rate.perSecond(); rate != 4 {
+		t.Fatalf("expected 4 messages per second in first second, got %v", rate)
+	}
+}
+
+// оффсеты партиций: [самый старый, следующий записываемый]
+type stubPartitionOffsets map[int32][2]int64
+
+func (s stubPartitionOffsets) Partitions(topic string) ([]int32, error) {
+	var res []int32
+	for p := range s {
+		res = append(res, p)
+	}
+	return res, nil
+}
+
+func (s stubPartitionOffsets) GetOffset(topic string, partition int32, time int64) (int64, error) {
+	if time == sarama.OffsetOldest {
+		return s[partition][0], nil
+	}
+	return s[partition][1], nil
+}
+
+func TestPartitionLags(t *testing.T) {
+	offsets := stubPartitionOffsets{0: {0, 100}, 1: {50, 80}, 2: {0, 10}}
+	partitions, _ := offsets.Partitions("orders")
+	// в партиции 1 группа еще ничего не подтверждала, в партиции 2 подтвержденный оффсет устарел
+	lags, err := partitionLags(offsets, "orders", partitions, map[int32]int64{0: 90, 1: -1, 2: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lags[0] != 10 || lags[1] != 30 || lags[2] != 0 {
+		t.Fatalf("unexpected lags %v", lags)
+	}
+
+	ss := lagStatistics(lags, "orders")
+	if len(ss) != 4 || ss[0].Value() != "40" || ss[2].Name() != "Consumer lag for orders, partition 1" || ss[2].Value() != "30" {
+		t.Fatalf("unexpected lag statistics %v", ss)
+	}
+}
+
+func TestProviderStatisticsWithoutLag(t *testing.T) {
+	p := &checkOrderProvider{
+		// кафка недоступна
+		lag:            &consumerLag{kafka: kafkaSettings{brokers: []string{"127.0.0.1:1"}}, topic: "orders", subject: "check"},
+		consumption:    newConsumptionTracker(),
+		skipped:        statistic.NewCounter("Orders skipped by provider", ""),
+		malformedCount: statistic.NewCounter("Malformed orders", ""),
+	}
+	ss, err := p.Statistics()
+	if err != nil {
+		t.Fatalf("lag error must not fail provider statistics: %v", err)
+	}
+	var lagErr, skipped bool
+	for _, s := range ss {
+		if s.Name() == "Statistic provider error" && statistic.StatisticLabels(s)[statistic.LabelComponent] == statisticComponentConsumerLag {
+			lagErr = true
+		}
+		if s == p.skipped {
+			skipped = true
+		}
+	}
+	if !lagErr || !skipped {
+		t.Fatalf("lag error must be reported as error statistic along with other statistics, got %v", ss)
+	}
+}
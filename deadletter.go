@@ -0,0 +1,168 @@
+package reactivetools
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	adapter "github.com/iddqdeika/kafka-adapter"
+	"github.com/iddqdeika/reactivetools/statistic"
+	"github.com/iddqdeika/rrr/helpful"
+	"time"
+)
+
+const (
+	DeadLetterPublisherConfigKey = "dead_letter_publisher"
+	ConfigDeadLetterTopicNameKey = "dead_letter_topic"
+
+	deadLetterSourceCheckOrder  = "check_order"
+	deadLetterSourceChangeEvent = "change_event"
+)
+
+// публикатор "мертвых" сообщений.
+// сюда попадают заказы и изменения, которые не удалось обработать за отведенные политикой повторов попытки.
+type DeadLetterPublisher interface {
+	PublishDeadLetter(d DeadLetter) error
+}
+
+// "мертвое" сообщение.
+// Source - откуда сообщение (check_order или change_event), Name - название проверки или ивента.
+type DeadLetter struct {
+	Source           string    `json:"source"`
+	ObjectType       string    `json:"object_type"`
+	ObjectIdentifier string    `json:"object_identifier"`
+	Name             string    `json:"name"`
+	Data             string    `json:"data,omitempty"`
+	LastError        string    `json:"last_error"`
+	Attempts         int       `json:"attempts"`
+	FailedAt         time.Time `json:"failed_at"`
+	CorrelationID    string    `json:"correlation_id,omitempty"`
+}
+
+func newOrderDeadLetter(o CheckOrder, attempts int, err error) DeadLetter {
+	return DeadLetter{
+		Source:           deadLetterSourceCheckOrder,
+		ObjectType:       o.ObjectType(),
+		ObjectIdentifier: o.ObjectIdentifier(),
+		Name:             o.CheckName(),
+		LastError:        errorString(err),
+		Attempts:         attempts,
+		FailedAt:         time.Now(),
+		CorrelationID:    messageCorrelationID(o),
+	}
+}
+
+func newChangeDeadLetter(e ChangeEvent, attempts int, err error) DeadLetter {
+	return DeadLetter{
+		Source:           deadLetterSourceChangeEvent,
+		ObjectType:       e.ObjectType(),
+		ObjectIdentifier: e.ObjectIdentifier(),
+		Name:             e.EventName(),
+		Data:             e.Data(),
+		LastError:        errorString(err),
+		Attempts:         attempts,
+		FailedAt:         time.Now(),
+		CorrelationID:    messageCorrelationID(e),
+	}
+}
+
+func messageCorrelationID(e interface{}) string {
+	if mc, ok := e.(MetadataCarrier); ok {
+		return mc.CorrelationID()
+	}
+	return ""
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// инстанциирует публикатор "мертвых" сообщений в кафка.
+func NewKafkaDeadLetterPublisher(config helpful.Config, logger helpful.Logger) (DeadLetterPublisher, error) {
+	if config == nil {
+		return nil, fmt.Errorf("must be not-nil config")
+	}
+	if logger == nil {
+		return nil, fmt.Errorf("must be not-nil logger")
+	}
+
+	topic, err := config.GetString(ConfigDeadLetterTopicNameKey)
+	if err != nil {
+		return nil, err
+	}
+
+	kafka, err := kafkaSettingsFromConfig(config, false)
+	if err != nil {
+		return nil, err
+	}
+	q, err := adapter.FromConfig(config, logger)
+	if err != nil {
+		return nil, err
+	}
+	err = q.EnsureTopic(topic)
+	if err != nil {
+		return nil, err
+	}
+	q.WriterRegister(topic)
+	return &deadLetterPublisher{
+		q:     q,
+		kafka: kafka,
+		l:     logger,
+		topic: topic,
+	}, nil
+}
+
+// публикует "мертвые" сообщения в топик кафка в виде json.
+type deadLetterPublisher struct {
+	q     *adapter.Queue
+	kafka kafkaSettings
+	l     helpful.Logger
+	topic string
+}
+
+func (p *deadLetterPublisher) PublishDeadLetter(d DeadLetter) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return p.q.Put(p.topic, data)
+}
+
+func (p *deadLetterPublisher) HealthChecks() []statistic.HealthCheck {
+	return []statistic.HealthCheck{kafkaWriterHealthCheck(p.kafka, p.topic)}
+}
+
+// собирает публикатор "мертвых" сообщений, если он задан в конфиге.
+func deadLetterPublisherFromConfig(cfg helpful.Config, l helpful.Logger) (DeadLetterPublisher, error) {
+	if !cfg.Contains(DeadLetterPublisherConfigKey) {
+		return nil, nil
+	}
+	return NewKafkaDeadLetterPublisher(cfg.Child(DeadLetterPublisherConfigKey), l)
+}
+
+// политика повторов, ограничивающая попытки, требует публикатора "мертвых" сообщений:
+// иначе сообщение, исчерпавшее попытки, было бы подтверждено без результата и потеряно.
+func requireDeadLetterPublisher(retry RetryPolicy, dl DeadLetterPublisher) error {
+	if retry.bounded() && dl == nil {
+		return fmt.Errorf("%v limits attempts, so %v must be set", RetryPolicyConfigKey, DeadLetterPublisherConfigKey)
+	}
+	return nil
+}
+
+// публикует "мертвое" сообщение в dl, повторяя попытки с интервалами политики повторов до закрытия контекста.
+// dl задан всегда, когда политика повторов ограничена (см. requireDeadLetterPublisher).
+// возвращает false, если опубликовать не удалось (контекст закрыт).
+func publishDeadLetter(ctx context.Context, l helpful.Logger, dl DeadLetterPublisher, retry RetryPolicy, d DeadLetter) bool {
+	retry.MaxAttempts = 0
+	retry.MaxElapsedTime = 0
+	_, err := retry.Do(ctx, func(attempt int) error {
+		err := dl.PublishDeadLetter(d)
+		if err != nil {
+			l.Errorf("cant publish dead letter (attempt %v): %v", attempt, err)
+		}
+		return err
+	})
+	return err == nil
+}
@@ -0,0 +1,117 @@
+package reactivetools
+
+import (
+	"fmt"
+	"github.com/iddqdeika/rrr/helpful"
+	"sync"
+	"time"
+)
+
+const (
+	// схлопывание повторных заказов: "dedup": {"window_in_ms": 5000, "max_superseded": 100}
+	DedupConfigKey = "dedup"
+
+	defaultDedupMaxSuperseded = 100
+)
+
+// ключ схлопывания: один и тот же объект и одна и та же проверка
+type dedupKey struct {
+	objectType       string
+	objectIdentifier string
+	checkName        string
+}
+
+func orderDedupKey(o CheckOrder) dedupKey {
+	return dedupKey{objectType: o.ObjectType(), objectIdentifier: o.ObjectIdentifier(), checkName: o.CheckName()}
+}
+
+// схлопывает повторные заказы на проверку одного объекта.
+// заказ, полученный не позже window после заказа с тем же ключом, который еще ожидает обработки или в обработке,
+// не обрабатывается: он присоединяется к этому (выжившему) заказу и завершается только после публикации его результата.
+// по истечении окна (или после завершения выжившего) заказ с тем же ключом снова обрабатывается отдельно.
+// к одному выжившему присоединяется не больше maxSuperseded заказов, следующий становится новым выжившим
+// и занимает слот сервиса, так что ожидающие заказы не копятся без ограничения.
+func newOrderDeduplicator(window time.Duration, maxSuperseded int) *orderDeduplicator {
+	return &orderDeduplicator{
+		window:        window,
+		maxSuperseded: maxSuperseded,
+		entries:       make(map[dedupKey]*dedupEntry),
+		survivors:     make(map[CheckOrder]*dedupEntry),
+	}
+}
+
+type orderDeduplicator struct {
+	window        time.Duration
+	maxSuperseded int
+
+	m sync.Mutex
+	// текущий выживший по ключу
+	entries map[dedupKey]*dedupEntry
+	// все незавершенные выжившие, в том числе с истекшим окном
+	survivors map[CheckOrder]*dedupEntry
+}
+
+type dedupEntry struct {
+	survivor   CheckOrder
+	received   time.Time
+	superseded []CheckOrder
+}
+
+// раздел dedup конфига. без него схлопывание выключено (nil).
+func dedupFromConfig(cfg helpful.Config) (*orderDeduplicator, error) {
+	if !cfg.Contains(DedupConfigKey) {
+		return nil, nil
+	}
+	dc := cfg.Child(DedupConfigKey)
+	ms, err := dc.GetInt("window_in_ms")
+	if err != nil {
+		return nil, fmt.Errorf("incorrect %v: %v", DedupConfigKey, err)
+	}
+	if ms <= 0 {
+		return nil, fmt.Errorf("incorrect %v: window_in_ms must be positive", DedupConfigKey)
+	}
+	maxSuperseded, err := optionalInt(dc, "max_superseded", defaultDedupMaxSuperseded)
+	if err != nil {
+		return nil, fmt.Errorf("incorrect %v: %v", DedupConfigKey, err)
+	}
+	if maxSuperseded < 1 {
+		return nil, fmt.Errorf("incorrect %v: max_superseded must be positive", DedupConfigKey)
+	}
+	return newOrderDeduplicator(time.Duration(ms)*time.Millisecond, maxSuperseded), nil
+}
+
+// решает, обрабатывать ли заказ. false - заказ присоединен к выжившему и обрабатывать его не надо.
+func (d *orderDeduplicator) admit(o CheckOrder) bool {
+	k := orderDedupKey(o)
+	now := time.Now()
+	d.m.Lock()
+	defer d.m.Unlock()
+	e, ok := d.entries[k]
+	if ok && now.Sub(e.received) <= d.window && len(e.superseded) < d.maxSuperseded {
+		e.superseded = append(e.superseded, o)
+		return false
+	}
+	// окно предыдущего выжившего истекло (или к нему присоединено уже достаточно заказов) -
+	// он завершится сам по себе, а выжившим становится новый заказ
+	e = &dedupEntry{survivor: o, received: now}
+	d.entries[k] = e
+	d.survivors[o] = e
+	return true
+}
+
+// вызывается после публикации результата заказа.
+// возвращает присоединенные к нему заказы, которые теперь можно завершить.
+func (d *orderDeduplicator) release(o CheckOrder) []CheckOrder {
+	d.m.Lock()
+	defer d.m.Unlock()
+	e, ok := d.survivors[o]
+	if !ok {
+		return nil
+	}
+	delete(d.survivors, o)
+	k := orderDedupKey(o)
+	if d.entries[k] == e {
+		delete(d.entries, k)
+	}
+	return e.superseded
+}
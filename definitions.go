@@ -6,6 +6,7 @@ import (
 	"github.com/iddqdeika/reactivetools/statistic"
 	"github.com/iddqdeika/rrr/helpful"
 	"io"
+	"time"
 )
 
 // сервис проверки.
@@ -46,6 +47,17 @@ type CheckResult interface {
 	CheckSuccess() bool
 }
 
+// подробный результат проверки.
+// реализуется стандартным результатом, так что публикатор может проверить его наличие через приведение типа.
+// Duration - время исполнения самой проверки.
+type DetailedCheckResult interface {
+	CheckResult
+	Severity() Severity
+	Findings() []Finding
+	Duration() time.Duration
+	Attributes() map[string]string
+}
+
 // функция для обрабтки заказов на проверку
 // важно, чтобы она нормально работала с контекстом и завершалась при его закрытии.
 // функция должна быть конкурентно-безопасна.
@@ -59,6 +71,13 @@ type CheckProvider interface {
 	PerformCheck(ctx context.Context, o CheckOrder) (msg string, success bool, err error)
 }
 
+// функция для обработки заказов на проверку с подробным результатом.
+// помимо сообщения и признака успеха возвращает важность, отдельные замечания и произвольные атрибуты.
+// требования те же, что и к CheckProvider.
+type DetailedCheckProvider interface {
+	PerformDetailedCheck(ctx context.Context, o CheckOrder) (CheckDetails, error)
+}
+
 type CheckProviderFabric interface {
 	New(cfg helpful.Config, l helpful.Logger) (CheckProvider, error)
 }
@@ -91,6 +110,7 @@ type Service interface {
 }
 
 // предоставляет канал изменений, начитывая его, например, из кафка
+// может предоставлять и статистики (statistic.StatisticProvider), например, кол-во полученных и отфильтрованных изменений
 type ChangesProvider interface {
 	ChangesChan() chan ChangeEvent
 }
@@ -3,8 +3,10 @@ module github.com/iddqdeika/reactivetools
 go 1.13
 
 require (
+	github.com/Shopify/sarama v1.26.4
 	github.com/denisenkom/go-mssqldb v0.9.0
 	github.com/iddqdeika/kafka-adapter v1.5.6
 	github.com/iddqdeika/rrr v1.6.3
 	go.etcd.io/bbolt v1.3.5
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,148 @@
+package reactivetools
+
+import (
+	"context"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"github.com/iddqdeika/reactivetools/statistic"
+	"github.com/iddqdeika/rrr/helpful"
+	"sync"
+	"time"
+)
+
+const (
+	// если задан, то сервис считается нездоровым (/healthz), когда в работе есть заказы или изменения,
+	// но ни один из них не был завершен за это время (например, все обработчики застряли в повторах)
+	NoProgressTimeoutConfigKey = "no_progress_timeout_in_mins"
+)
+
+// отслеживает прогресс конвейера обработки.
+// busy сообщает, есть ли сейчас работа, без работы отсутствие прогресса - норма.
+func newProgressTracker(name string, timeout time.Duration, busy func() bool) *progressTracker {
+	return &progressTracker{
+		name:    name,
+		timeout: timeout,
+		busy:    busy,
+		last:    time.Now(),
+	}
+}
+
+type progressTracker struct {
+	name    string
+	timeout time.Duration
+	busy    func() bool
+
+	m    sync.Mutex
+	last time.Time
+}
+
+// отмечает прогресс (завершение обработки заказа или изменения)
+func (t *progressTracker) touch() {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.last = time.Now()
+}
+
+func (t *progressTracker) check(ctx context.Context) error {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if !t.busy() {
+		// простой тоже считается прогрессом, иначе первый заказ после простоя сразу будет "без прогресса"
+		t.last = time.Now()
+		return nil
+	}
+	if idle := time.Since(t.last); idle > t.timeout {
+		return fmt.Errorf("no progress for %v", idle.Round(time.Second))
+	}
+	return nil
+}
+
+func (t *progressTracker) HealthChecks() []statistic.HealthCheck {
+	if t == nil || t.timeout <= 0 {
+		return nil
+	}
+	return []statistic.HealthCheck{{Name: t.name + " progress", Kind: statistic.Liveness, Check: t.check}}
+}
+
+func noProgressTimeoutFromConfig(cfg helpful.Config) (time.Duration, error) {
+	mins, err := optionalInt(cfg, NoProgressTimeoutConfigKey, 0)
+	if err != nil {
+		return 0, err
+	}
+	if mins < 0 {
+		return 0, fmt.Errorf("%v must not be negative", NoProgressTimeoutConfigKey)
+	}
+	return time.Duration(mins) * time.Minute, nil
+}
+
+// проверки здоровья данных компонент (тех, что реализуют statistic.HealthCheckProvider).
+func componentHealthChecks(components ...interface{}) []statistic.HealthCheck {
+	var res []statistic.HealthCheck
+	for _, c := range components {
+		if hp, ok := c.(statistic.HealthCheckProvider); ok && hp != nil {
+			res = append(res, hp.HealthChecks()...)
+		}
+	}
+	return res
+}
+
+// проверка читателя кафка: доступность брокеров, топика и координатора группы потребителей.
+// проверки кафка только читают метаданные: топики создаются один раз, в конструкторах компонент.
+func kafkaReaderHealthCheck(kafka kafkaSettings, topic string) statistic.HealthCheck {
+	return statistic.HealthCheck{
+		Name: fmt.Sprintf("kafka reader (%v)", topic),
+		Kind: statistic.Readiness,
+		Check: func(ctx context.Context) error {
+			return withKafkaClient(ctx, kafka, func(c sarama.Client) error {
+				err := topicAvailable(c, topic)
+				if err != nil {
+					return err
+				}
+				_, err = c.Coordinator(kafka.group)
+				if err != nil {
+					return fmt.Errorf("cant get coordinator of group %v: %v", kafka.group, err)
+				}
+				return nil
+			})
+		},
+	}
+}
+
+// проверка писателя кафка: доступность брокеров и топика.
+func kafkaWriterHealthCheck(kafka kafkaSettings, topic string) statistic.HealthCheck {
+	return statistic.HealthCheck{
+		Name: fmt.Sprintf("kafka writer (%v)", topic),
+		Kind: statistic.Readiness,
+		Check: func(ctx context.Context) error {
+			return withKafkaClient(ctx, kafka, func(c sarama.Client) error {
+				return topicAvailable(c, topic)
+			})
+		},
+	}
+}
+
+// топик есть в метаданных кластера и у него есть партиции
+func topicAvailable(c sarama.Client, topic string) error {
+	partitions, err := c.Partitions(topic)
+	if err != nil {
+		return fmt.Errorf("cant get metadata of topic %v: %v", topic, err)
+	}
+	if len(partitions) == 0 {
+		return fmt.Errorf("topic %v has no partitions", topic)
+	}
+	return nil
+}
+
+// выполняет f, не дожидаясь ее дольше, чем открыт контекст.
+func callCtx(ctx context.Context, f func() error) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- f()
+	}()
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
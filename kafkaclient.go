@@ -0,0 +1,168 @@
+package reactivetools
+
+import (
+	"context"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"github.com/iddqdeika/rrr/helpful"
+	"strings"
+)
+
+const (
+	// ключи раздела KAFKA, которые читаются и напрямую (помимо адаптера):
+	// оффсеты, партиции и метаданные топиков адаптер не отдает, за ними ходим через sarama.
+	kafkaBrokersKey       = "BROKERS"
+	kafkaConsumerGroupKey = "CONSUMER_GROUP"
+	// необязательная версия протокола кафка, например "2.1.0"
+	kafkaVersionKey = "VERSION"
+
+	kafkaClientID = "reactivetools"
+
+	// версия запроса оффсетов группы, хранящихся в самой кафка (а не в zookeeper)
+	offsetFetchVersion = 1
+)
+
+// версия протокола по умолчанию
+var defaultKafkaVersion = sarama.V1_0_0_0
+
+// настройки прямого подключения к кафка из раздела KAFKA компоненты.
+// group задана только для читателей.
+type kafkaSettings struct {
+	brokers []string
+	group   string
+	version sarama.KafkaVersion
+}
+
+// настройки из раздела KAFKA конфига компоненты (cfg - конфиг компоненты, как и для adapter.FromConfig).
+// reader - компонента читает топик, тогда обязательна группа потребителей.
+func kafkaSettingsFromConfig(cfg helpful.Config, reader bool) (kafkaSettings, error) {
+	kc := cfg.Child(kafkaConfigKey)
+	brokers, err := kc.GetString(kafkaBrokersKey)
+	if err != nil {
+		return kafkaSettings{}, err
+	}
+	s := kafkaSettings{version: defaultKafkaVersion}
+	for _, b := range strings.Split(brokers, ",") {
+		if b = strings.TrimSpace(b); b != "" {
+			s.brokers = append(s.brokers, b)
+		}
+	}
+	if len(s.brokers) == 0 {
+		return kafkaSettings{}, fmt.Errorf("must be at least one kafka broker")
+	}
+	if reader {
+		s.group, err = kc.GetString(kafkaConsumerGroupKey)
+		if err != nil {
+			return kafkaSettings{}, err
+		}
+		if s.group == "" {
+			return kafkaSettings{}, fmt.Errorf("must be not-empty kafka consumer group")
+		}
+	}
+	if kc.Contains(kafkaVersionKey) {
+		v, err := kc.GetString(kafkaVersionKey)
+		if err != nil {
+			return kafkaSettings{}, err
+		}
+		s.version, err = sarama.ParseKafkaVersion(v)
+		if err != nil {
+			return kafkaSettings{}, fmt.Errorf("incorrect kafka version %v: %v", v, err)
+		}
+	}
+	return s, nil
+}
+
+func (s kafkaSettings) saramaConfig() *sarama.Config {
+	c := sarama.NewConfig()
+	c.ClientID = kafkaClientID
+	c.Version = s.version
+	// метаданные только нужных топиков, а не всего кластера
+	c.Metadata.Full = false
+	return c
+}
+
+// выполняет f с клиентом кафка, подключенным на время вызова, и не ждет ее дольше, чем открыт контекст.
+// клиент только читает метаданные и оффсеты, топики им не создаются.
+func withKafkaClient(ctx context.Context, s kafkaSettings, f func(c sarama.Client) error) error {
+	return callCtx(ctx, func() error {
+		c, err := sarama.NewClient(s.brokers, s.saramaConfig())
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		return f(c)
+	})
+}
+
+// оффсеты партиций топика (реализуется sarama.Client)
+type partitionOffsets interface {
+	Partitions(topic string) ([]int32, error)
+	GetOffset(topic string, partition int32, time int64) (int64, error)
+}
+
+// лаг группы потребителей по всем партициям топика
+func consumerGroupLag(c sarama.Client, group, topic string) (map[int32]int64, error) {
+	partitions, err := c.Partitions(topic)
+	if err != nil {
+		return nil, fmt.Errorf("cant get partitions of topic %v: %v", topic, err)
+	}
+	committed, err := committedOffsets(c, group, topic, partitions)
+	if err != nil {
+		return nil, err
+	}
+	return partitionLags(c, topic, partitions, committed)
+}
+
+// подтвержденные группой оффсеты партиций. -1 - группа в партиции еще ничего не подтверждала.
+func committedOffsets(c sarama.Client, group, topic string, partitions []int32) (map[int32]int64, error) {
+	coordinator, err := c.Coordinator(group)
+	if err != nil {
+		return nil, fmt.Errorf("cant get coordinator of group %v: %v", group, err)
+	}
+	req := &sarama.OffsetFetchRequest{Version: offsetFetchVersion, ConsumerGroup: group}
+	for _, p := range partitions {
+		req.AddPartition(topic, p)
+	}
+	resp, err := coordinator.FetchOffset(req)
+	if err != nil {
+		return nil, fmt.Errorf("cant get committed offsets of group %v: %v", group, err)
+	}
+	res := make(map[int32]int64, len(partitions))
+	for _, p := range partitions {
+		res[p] = -1
+		b := resp.GetBlock(topic, p)
+		if b == nil {
+			continue
+		}
+		if b.Err != sarama.ErrNoError {
+			return nil, fmt.Errorf("cant get committed offset of partition %v: %v", p, b.Err)
+		}
+		res[p] = b.Offset
+	}
+	return res, nil
+}
+
+// лаг по партициям: разница между оффсетом следующего записываемого сообщения и подтвержденным оффсетом.
+// если группа в партиции ничего не подтверждала, то необработанными считаются все сообщения партиции.
+func partitionLags(c partitionOffsets, topic string, partitions []int32, committed map[int32]int64) (map[int32]int64, error) {
+	res := make(map[int32]int64, len(partitions))
+	for _, p := range partitions {
+		newest, err := c.GetOffset(topic, p, sarama.OffsetNewest)
+		if err != nil {
+			return nil, fmt.Errorf("cant get newest offset of partition %v: %v", p, err)
+		}
+		offset, ok := committed[p]
+		if !ok || offset < 0 {
+			offset, err = c.GetOffset(topic, p, sarama.OffsetOldest)
+			if err != nil {
+				return nil, fmt.Errorf("cant get oldest offset of partition %v: %v", p, err)
+			}
+		}
+		lag := newest - offset
+		if lag < 0 {
+			lag = 0
+		}
+		res[p] = lag
+	}
+	return res, nil
+}
@@ -0,0 +1,160 @@
+package reactivetools
+
+import (
+	"context"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"github.com/iddqdeika/rrr/helpful"
+	"sync"
+)
+
+// сообщение из очереди провайдера
+type queueMessage interface {
+	Data() []byte
+	Ack() error
+	Nack() error
+}
+
+// читатель топика в группе потребителей кафка (sarama).
+// адаптер кафка отдает только данные сообщения, а провайдерам нужны ключ, время, заголовки, партиция и оффсет
+// (метаданные заказов и изменений, порядок подтверждений), поэтому топики заказов и изменений читаются напрямую.
+// группа подключается при первом get и работает до Close, а не до закрытия контекста провайдера:
+// при плавной остановке сервис подтверждает завершенные заказы уже после остановки провайдера.
+func newKafkaConsumer(kafka kafkaSettings, topic string, l helpful.Logger) *kafkaConsumer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &kafkaConsumer{
+		kafka:  kafka,
+		topic:  topic,
+		l:      l,
+		msgs:   make(chan *kafkaMessage),
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+}
+
+type kafkaConsumer struct {
+	kafka kafkaSettings
+	topic string
+	l     helpful.Logger
+	msgs  chan *kafkaMessage
+
+	start  sync.Once
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// следующее сообщение топика. ждет его, пока открыт ctx.
+func (c *kafkaConsumer) get(ctx context.Context) (*kafkaMessage, error) {
+	c.start.Do(func() {
+		go c.run()
+	})
+	select {
+	case m := <-c.msgs:
+		return m, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.ctx.Done():
+		return nil, fmt.Errorf("consumer of topic %v is closed", c.topic)
+	}
+}
+
+// закрывает группу. отмеченные (подтвержденные) оффсеты коммитятся при окончании ее сессии.
+func (c *kafkaConsumer) Close() error {
+	c.cancel()
+	c.start.Do(func() {
+		close(c.done)
+	})
+	<-c.done
+	return nil
+}
+
+// переподключается к группе, пока потребитель не закрыт
+func (c *kafkaConsumer) run() {
+	defer close(c.done)
+	for c.ctx.Err() == nil {
+		err := c.consume()
+		if err != nil && c.ctx.Err() == nil {
+			c.l.Errorf("cant consume topic %v, err: %v", c.topic, err)
+			sleepCtx(c.ctx, intervalWhenCantGetMsg)
+		}
+	}
+}
+
+func (c *kafkaConsumer) consume() error {
+	cfg := c.kafka.saramaConfig()
+	// новая группа читает топик с начала, чтобы не пропустить записанное до ее первого запуска
+	cfg.Consumer.Offsets.Initial = sarama.OffsetOldest
+	group, err := sarama.NewConsumerGroup(c.kafka.brokers, c.kafka.group, cfg)
+	if err != nil {
+		return err
+	}
+	defer group.Close()
+	for c.ctx.Err() == nil {
+		// Consume возвращается при каждой перебалансировке группы
+		err = group.Consume(c.ctx, []string{c.topic}, c)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *kafkaConsumer) Setup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+func (c *kafkaConsumer) Cleanup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+// отдает сообщения партиции провайдеру по мере того, как он их забирает.
+// сессия заканчивается при перебалансировке группы и при закрытии потребителя.
+func (c *kafkaConsumer) ConsumeClaim(sess sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for {
+		select {
+		case msg, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+			select {
+			case c.msgs <- &kafkaMessage{msg: msg, sess: sess}:
+			case <-sess.Context().Done():
+				return nil
+			}
+		case <-sess.Context().Done():
+			return nil
+		}
+	}
+}
+
+// сообщение, полученное в сессии группы.
+// знает свои партицию и оффсет, поэтому менеджер подтверждений подтверждает сообщения по порядку в партиции.
+type kafkaMessage struct {
+	msg  *sarama.ConsumerMessage
+	sess sarama.ConsumerGroupSession
+}
+
+func (m *kafkaMessage) Data() []byte {
+	return m.msg.Value
+}
+
+// отмечает оффсет сообщения (а значит, и всех предыдущих в партиции) для коммита группой
+func (m *kafkaMessage) Ack() error {
+	m.sess.MarkMessage(m.msg, "")
+	return nil
+}
+
+// оффсет не отмечается, так что сообщение будет получено заново после перезапуска или перебалансировки группы
+func (m *kafkaMessage) Nack() error {
+	return nil
+}
+
+func (m *kafkaMessage) Partition() int {
+	return int(m.msg.Partition)
+}
+
+func (m *kafkaMessage) Offset() int64 {
+	return m.msg.Offset
+}
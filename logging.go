@@ -0,0 +1,358 @@
+package reactivetools
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/iddqdeika/rrr/helpful"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// раздел конфига логгера:
+	// "log": {"level": "info", "format": "json", "components": {"provider": "debug", "publisher": "warn"}}
+	LogConfigKey = "log"
+
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+
+	logLevelConfigName      = "level"
+	logFormatConfigName     = "format"
+	logComponentsConfigName = "components"
+)
+
+// названия компонент для уровней логирования (log.components)
+const (
+	LogComponentService    = "service"
+	LogComponentProvider   = "provider"
+	LogComponentPublisher  = "publisher"
+	LogComponentDeadLetter = "dead_letter"
+	LogComponentProcessor  = "processor"
+)
+
+var logComponents = []string{LogComponentService, LogComponentProvider, LogComponentPublisher,
+	LogComponentDeadLetter, LogComponentProcessor}
+
+// поля записи лога
+const (
+	LogFieldCheckName        = "check_name"
+	LogFieldObjectType       = "object_type"
+	LogFieldObjectIdentifier = "object_identifier"
+	LogFieldEventName        = "event_name"
+	LogFieldPartition        = "partition"
+	LogFieldOffset           = "offset"
+	LogFieldAttempt          = "attempt"
+	LogFieldCorrelationID    = "correlation_id"
+	LogFieldComponent        = "component"
+)
+
+// уровень логирования. записи ниже уровня логгера отбрасываются, LogLevelNone отключает лог.
+type LogLevel int
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+	LogLevelNone
+)
+
+// уровни логирования по названию в конфиге (log.level)
+var logLevels = map[string]LogLevel{
+	"debug": LogLevelDebug,
+	"info":  LogLevelInfo,
+	"warn":  LogLevelWarn,
+	"error": LogLevelError,
+	"none":  LogLevelNone,
+}
+
+func (l LogLevel) String() string {
+	for n, lvl := range logLevels {
+		if lvl == l {
+			return n
+		}
+	}
+	return "unknown"
+}
+
+func logLevelNames() []string {
+	names := make([]string, 0, len(logLevels))
+	for n := range logLevels {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// поля записи лога
+type LogFields map[string]interface{}
+
+// логгер с уровнями debug и warn, полями записей и уровнями по компонентам.
+// реализует helpful.Logger, так что его можно передавать в любые компоненты.
+type StructuredLogger interface {
+	helpful.Logger
+	Debugf(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	// логгер, добавляющий поля к каждой записи
+	WithFields(fields LogFields) StructuredLogger
+	// логгер компоненты: записи получают поле component, уровень берется из log.components (если задан)
+	Component(name string) StructuredLogger
+}
+
+// инстанциирует логгер из раздела log конфига. пишет в out построчно.
+// без раздела log - уровень info, текстовый формат.
+func NewLoggerFromConfig(cfg helpful.Config, out io.Writer) (StructuredLogger, error) {
+	if out == nil {
+		return nil, fmt.Errorf("must be not-nil Writer")
+	}
+	l := newStructuredLogger(out, LogLevelInfo, LogFormatText)
+	if cfg == nil || !cfg.Contains(LogConfigKey) {
+		return l, nil
+	}
+	lc := cfg.Child(LogConfigKey)
+	if lc.Contains(logLevelConfigName) {
+		lvl, err := logLevelFromConfig(lc, logLevelConfigName)
+		if err != nil {
+			return nil, err
+		}
+		l.level = lvl
+	}
+	if lc.Contains(logFormatConfigName) {
+		format, err := lc.GetString(logFormatConfigName)
+		if err != nil {
+			return nil, err
+		}
+		if format != LogFormatText && format != LogFormatJSON {
+			return nil, fmt.Errorf("unknown log format %v", format)
+		}
+		l.json = format == LogFormatJSON
+	}
+	if !lc.Contains(logComponentsConfigName) {
+		return l, nil
+	}
+	cc := lc.Child(logComponentsConfigName)
+	for _, name := range logComponents {
+		if !cc.Contains(name) {
+			continue
+		}
+		lvl, err := logLevelFromConfig(cc, name)
+		if err != nil {
+			return nil, err
+		}
+		l.levels[name] = lvl
+	}
+	return l, nil
+}
+
+func logLevelFromConfig(cfg helpful.Config, key string) (LogLevel, error) {
+	name, err := cfg.GetString(key)
+	if err != nil {
+		return 0, err
+	}
+	lvl, ok := logLevels[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown log level %v", name)
+	}
+	return lvl, nil
+}
+
+// инстанциирует логгер с данным уровнем и форматом (text или json).
+func NewStructuredLogger(out io.Writer, level LogLevel, format string) StructuredLogger {
+	return newStructuredLogger(out, level, format)
+}
+
+func newStructuredLogger(out io.Writer, level LogLevel, format string) *structuredLogger {
+	return &structuredLogger{
+		out:    &lockedWriter{w: out},
+		level:  level,
+		json:   format == LogFormatJSON,
+		levels: make(map[string]LogLevel),
+	}
+}
+
+type structuredLogger struct {
+	out       *lockedWriter
+	level     LogLevel
+	json      bool
+	levels    map[string]LogLevel
+	component string
+	fields    LogFields
+}
+
+// запись в общий writer не должна перемешиваться
+type lockedWriter struct {
+	m sync.Mutex
+	w io.Writer
+}
+
+func (w *lockedWriter) write(p []byte) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	_, _ = w.w.Write(p)
+}
+
+func (l *structuredLogger) Debugf(format string, args ...interface{}) {
+	l.log(LogLevelDebug, format, args...)
+}
+
+func (l *structuredLogger) Infof(format string, args ...interface{}) {
+	l.log(LogLevelInfo, format, args...)
+}
+
+func (l *structuredLogger) Warnf(format string, args ...interface{}) {
+	l.log(LogLevelWarn, format, args...)
+}
+
+func (l *structuredLogger) Errorf(format string, args ...interface{}) {
+	l.log(LogLevelError, format, args...)
+}
+
+// уровень helpful переводится в ближайший свой
+func (l *structuredLogger) WithLevel(lvl helpful.LogLevel) helpful.Logger {
+	c := l.clone()
+	switch lvl {
+	case helpful.LogNone:
+		c.level = LogLevelNone
+	case helpful.LogError:
+		c.level = LogLevelError
+	default:
+		c.level = LogLevelInfo
+	}
+	return c
+}
+
+func (l *structuredLogger) WithFields(fields LogFields) StructuredLogger {
+	c := l.clone()
+	c.fields = make(LogFields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		c.fields[k] = v
+	}
+	for k, v := range fields {
+		c.fields[k] = v
+	}
+	return c
+}
+
+func (l *structuredLogger) Component(name string) StructuredLogger {
+	c := l.clone()
+	c.component = name
+	if lvl, ok := l.levels[name]; ok {
+		c.level = lvl
+	}
+	return c
+}
+
+func (l *structuredLogger) clone() *structuredLogger {
+	c := *l
+	return &c
+}
+
+func (l *structuredLogger) log(lvl LogLevel, format string, args ...interface{}) {
+	if lvl < l.level || l.level == LogLevelNone {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	if l.json {
+		rec := make(map[string]interface{}, len(l.fields)+4)
+		for k, v := range l.fields {
+			rec[k] = v
+		}
+		rec["time"] = now
+		rec["level"] = lvl.String()
+		rec["msg"] = msg
+		if l.component != "" {
+			rec[LogFieldComponent] = l.component
+		}
+		data, err := json.Marshal(rec)
+		if err != nil {
+			data = []byte(fmt.Sprintf(`{"time":%q,"level":"error","msg":"cant marshal log record: %v"}`, now, err))
+		}
+		l.out.write(append(data, '\n'))
+		return
+	}
+	var b strings.Builder
+	b.WriteString(now)
+	b.WriteString(" " + strings.ToUpper(lvl.String()))
+	if l.component != "" {
+		b.WriteString(" [" + l.component + "]")
+	}
+	b.WriteString(" " + msg)
+	keys := make([]string, 0, len(l.fields))
+	for k := range l.fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %v=%v", k, l.fields[k])
+	}
+	b.WriteString("\n")
+	l.out.write([]byte(b.String()))
+}
+
+// хелперы для любого helpful.Logger: если логгер структурный - используются уровни и поля,
+// иначе debug отбрасывается, warn пишется как error, а поля не добавляются.
+
+func logDebugf(l helpful.Logger, format string, args ...interface{}) {
+	if sl, ok := l.(StructuredLogger); ok {
+		sl.Debugf(format, args...)
+	}
+}
+
+func logWarnf(l helpful.Logger, format string, args ...interface{}) {
+	if sl, ok := l.(StructuredLogger); ok {
+		sl.Warnf(format, args...)
+		return
+	}
+	l.Errorf(format, args...)
+}
+
+func withLogFields(l helpful.Logger, fields LogFields) helpful.Logger {
+	if sl, ok := l.(StructuredLogger); ok {
+		return sl.WithFields(fields)
+	}
+	return l
+}
+
+func componentLogger(l helpful.Logger, name string) helpful.Logger {
+	if sl, ok := l.(StructuredLogger); ok {
+		return sl.Component(name)
+	}
+	return l
+}
+
+// поля лога заказа на проверку
+func orderLogFields(o CheckOrder) LogFields {
+	f := LogFields{
+		LogFieldCheckName:        o.CheckName(),
+		LogFieldObjectType:       o.ObjectType(),
+		LogFieldObjectIdentifier: o.ObjectIdentifier(),
+	}
+	addMessageLogFields(f, o)
+	return f
+}
+
+// поля лога изменения
+func eventLogFields(e ChangeEvent) LogFields {
+	f := LogFields{
+		LogFieldEventName:        e.EventName(),
+		LogFieldObjectType:       e.ObjectType(),
+		LogFieldObjectIdentifier: e.ObjectIdentifier(),
+	}
+	addMessageLogFields(f, e)
+	return f
+}
+
+// положение в очереди и correlation id, если сообщение их предоставляет
+func addMessageLogFields(f LogFields, msg interface{}) {
+	if oc, ok := msg.(OffsetCarrier); ok && oc.Partition() >= 0 {
+		f[LogFieldPartition] = oc.Partition()
+		f[LogFieldOffset] = oc.Offset()
+	}
+	if mc, ok := msg.(MetadataCarrier); ok && mc.CorrelationID() != "" {
+		f[LogFieldCorrelationID] = mc.CorrelationID()
+	}
+}
@@ -0,0 +1,68 @@
+package reactivetools
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestStructuredLogger(t *testing.T) {
+	cfg, err := LoadConfig("config_template.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	l, err := NewLoggerFromConfig(cfg, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l.Debugf("hidden by level")
+	prov := l.Component(LogComponentProvider)
+	prov.Infof("hidden by component level")
+	prov.WithFields(LogFields{LogFieldPartition: 2, LogFieldOffset: 10}).Warnf("lag is %v", 5)
+	l.Component(LogComponentDeadLetter).Debugf("visible by component level")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 records, got:\n%v", buf.String())
+	}
+	rec := make(map[string]interface{})
+	err = json.Unmarshal([]byte(lines[0]), &rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec["level"] != "warn" || rec["msg"] != "lag is 5" || rec[LogFieldComponent] != LogComponentProvider ||
+		rec[LogFieldPartition] != float64(2) || rec[LogFieldOffset] != float64(10) {
+		t.Errorf("unexpected record %v", lines[0])
+	}
+	if !strings.Contains(lines[1], `"level":"debug"`) {
+		t.Errorf("unexpected record %v", lines[1])
+	}
+}
+
+func TestStructuredLoggerText(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := NewStructuredLogger(buf, LogLevelWarn, LogFormatText)
+	o := newStubCheckOrder(7, nil)
+	withLogFields(l, LogFields{LogFieldAttempt: 3}).Infof("hidden")
+	logWarnf(withLogFields(l.WithFields(orderLogFields(o)), LogFields{LogFieldAttempt: 3}), "check failed")
+	out := buf.String()
+	for _, expected := range []string{" WARN check failed ", "attempt=3", "offset=7", "partition=0"} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected %q in %q", expected, out)
+		}
+	}
+	if strings.Contains(out, "hidden") {
+		t.Errorf("info record must be filtered out: %q", out)
+	}
+
+	buf.Reset()
+	l.WithLevel(0).Errorf("nothing")
+	none := NewStructuredLogger(buf, LogLevelNone, LogFormatText)
+	none.Errorf("nothing")
+	if buf.Len() != 0 {
+		t.Errorf("disabled logger must not write: %q", buf.String())
+	}
+}
@@ -0,0 +1,97 @@
+package reactivetools
+
+import (
+	"context"
+	"fmt"
+	adapter "github.com/iddqdeika/kafka-adapter"
+	"github.com/iddqdeika/rrr/helpful"
+	"time"
+)
+
+const (
+	// что делать с сообщениями, которые не удалось разобрать (в конфиге провайдера):
+	// ack (по умолчанию) - подтвердить и записать в лог,
+	// dead_letter - опубликовать в dead_letter_topic провайдера и подтвердить,
+	// stop - остановить провайдер с ошибкой, не подтверждая сообщение.
+	ConfigMalformedPolicyKey = "malformed_message_policy"
+
+	MalformedPolicyAck        = "ack"
+	MalformedPolicyDeadLetter = "dead_letter"
+	MalformedPolicyStop       = "stop"
+)
+
+// обработчик некорректных сообщений согласно политике из конфига провайдера.
+// q - очередь провайдера, через нее же публикуются "мертвые" сообщения.
+func newMalformedHandler(cfg helpful.Config, q *adapter.Queue, l helpful.Logger, source string) (*malformedHandler, error) {
+	policy := MalformedPolicyAck
+	if cfg.Contains(ConfigMalformedPolicyKey) {
+		var err error
+		policy, err = cfg.GetString(ConfigMalformedPolicyKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	h := &malformedHandler{
+		policy: policy,
+		source: source,
+		l:      l,
+	}
+	switch policy {
+	case MalformedPolicyAck, MalformedPolicyStop:
+	case MalformedPolicyDeadLetter:
+		topic, err := cfg.GetString(ConfigDeadLetterTopicNameKey)
+		if err != nil {
+			return nil, fmt.Errorf("%v is required for %v policy: %v", ConfigDeadLetterTopicNameKey, policy, err)
+		}
+		err = q.EnsureTopic(topic)
+		if err != nil {
+			return nil, err
+		}
+		q.WriterRegister(topic)
+		h.dl = &deadLetterPublisher{q: q, l: l, topic: topic}
+	default:
+		return nil, fmt.Errorf("unknown %v: %v", ConfigMalformedPolicyKey, policy)
+	}
+	return h, nil
+}
+
+type malformedHandler struct {
+	policy string
+	source string
+	l      helpful.Logger
+	dl     DeadLetterPublisher
+}
+
+// обрабатывает сообщение, которое не удалось разобрать.
+// true - сообщение обработано и его можно подтверждать (подтверждает провайдер, в общем порядке).
+// ошибка означает, что провайдер должен остановиться.
+// если контекст закрылся раньше, чем сообщение удалось обработать, то оно не подтверждается.
+func (h *malformedHandler) handle(ctx context.Context, topic string, msg queueMessage, parseErr error) (bool, error) {
+	switch h.policy {
+	case MalformedPolicyStop:
+		return false, fmt.Errorf("cant parse msg from topic %v, stopping: %v", topic, parseErr)
+	case MalformedPolicyDeadLetter:
+		d := DeadLetter{
+			Source:    h.source,
+			Data:      string(msg.Data()),
+			LastError: parseErr.Error(),
+			Attempts:  1,
+			FailedAt:  time.Now(),
+		}
+		// без dead letter подтверждать нельзя - сообщение потеряется
+		for {
+			err := h.dl.PublishDeadLetter(d)
+			if err == nil {
+				break
+			}
+			h.l.Errorf("cant publish malformed msg from topic %v to dead letter, err: %v", topic, err)
+			if !sleepCtx(ctx, intervalWhenCantGetMsg) {
+				return false, nil
+			}
+		}
+		h.l.Errorf("cant parse msg from topic %v, sent to dead letter, err: %v", topic, parseErr)
+	default:
+		h.l.Errorf("cant parse msg from topic %v, skipping, err: %v", topic, parseErr)
+	}
+	return true, nil
+}
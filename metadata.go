@@ -0,0 +1,165 @@
+package reactivetools
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"strings"
+	"time"
+)
+
+const (
+	// поля metadata конверта заказа (или изменения), переносимые из заказа в результат
+	CorrelationIDHeader = "correlation_id"
+	TraceparentHeader   = "traceparent"
+	TracestateHeader    = "tracestate"
+
+	traceparentVersion = "00"
+)
+
+// метаданные сообщения из очереди.
+// если очередь не предоставляет какое-то из значений, то оно остается пустым,
+// а для партиции и оффсета используется -1 (например, у заглушек).
+type MessageMetadata struct {
+	Headers   map[string]string
+	Key       string
+	Timestamp time.Time
+	Partition int
+	Offset    int64
+}
+
+// заказ или изменение, знающие метаданные сообщения, из которого получены.
+// реализуется стандартными заказами и изменениями, так что проверить наличие можно приведением типа.
+type MetadataCarrier interface {
+	Metadata() MessageMetadata
+	CorrelationID() string
+	TraceContext() TraceContext
+}
+
+// собирает метаданные сообщения кафка: ключ, время записи, заголовки, партицию и оффсет.
+// extra - метаданные из тела сообщения (например, из конверта), они дополняют заголовки, не перезаписывая их.
+// названия заголовков приводятся к нижнему регистру.
+func newMessageMetadata(msg *sarama.ConsumerMessage, extra map[string]string) MessageMetadata {
+	md := MessageMetadata{
+		Headers:   make(map[string]string, len(msg.Headers)+len(extra)),
+		Key:       string(msg.Key),
+		Timestamp: msg.Timestamp,
+		Partition: int(msg.Partition),
+		Offset:    msg.Offset,
+	}
+	for _, h := range msg.Headers {
+		if h != nil {
+			md.Headers[strings.ToLower(string(h.Key))] = string(h.Value)
+		}
+	}
+	for k, v := range extra {
+		k = strings.ToLower(k)
+		if _, ok := md.Headers[k]; !ok {
+			md.Headers[k] = v
+		}
+	}
+	return md
+}
+
+// идентификатор корреляции: из метаданных, иначе - идентификатор заказа, иначе - новый.
+func correlationID(md MessageMetadata, orderID string) string {
+	if id := md.Headers[CorrelationIDHeader]; id != "" {
+		return id
+	}
+	if orderID != "" {
+		return orderID
+	}
+	return randomHex(16)
+}
+
+// W3C trace context (https://www.w3.org/TR/trace-context/).
+// пустой контекст означает, что сообщение пришло без трассировки.
+type TraceContext struct {
+	TraceID    string
+	ParentID   string
+	Flags      string
+	TraceState string
+}
+
+// разбирает заголовок traceparent вида 00-<trace-id>-<parent-id>-<flags>
+func ParseTraceparent(traceparent, tracestate string) (TraceContext, error) {
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 {
+		return TraceContext{}, fmt.Errorf("incorrect traceparent: %v", traceparent)
+	}
+	if parts[0] == "ff" || !isHex(parts[0], 2) {
+		return TraceContext{}, fmt.Errorf("unsupported traceparent version: %v", parts[0])
+	}
+	// для версии 00 лишних полей быть не должно, более новые версии разбираем по известным полям
+	if parts[0] == traceparentVersion && len(parts) != 4 {
+		return TraceContext{}, fmt.Errorf("incorrect traceparent: %v", traceparent)
+	}
+	tc := TraceContext{
+		TraceID:    parts[1],
+		ParentID:   parts[2],
+		Flags:      parts[3],
+		TraceState: tracestate,
+	}
+	if !isHex(tc.TraceID, 32) || !isHex(tc.ParentID, 16) || !isHex(tc.Flags, 2) ||
+		isZeroHex(tc.TraceID) || isZeroHex(tc.ParentID) {
+		return TraceContext{}, fmt.Errorf("incorrect traceparent: %v", traceparent)
+	}
+	return tc, nil
+}
+
+func traceContextFromMetadata(md MessageMetadata) TraceContext {
+	tp, ok := md.Headers[TraceparentHeader]
+	if !ok {
+		return TraceContext{}
+	}
+	tc, err := ParseTraceparent(tp, md.Headers[TracestateHeader])
+	if err != nil {
+		return TraceContext{}
+	}
+	return tc
+}
+
+func (t TraceContext) IsValid() bool {
+	return t.TraceID != ""
+}
+
+// значение заголовка traceparent
+func (t TraceContext) Traceparent() string {
+	if !t.IsValid() {
+		return ""
+	}
+	return traceparentVersion + "-" + t.TraceID + "-" + t.ParentID + "-" + t.Flags
+}
+
+// контекст для сообщения, порожденного в рамках этой трассировки (например, результата проверки):
+// тот же trace-id с новым parent-id.
+func (t TraceContext) NewChild() TraceContext {
+	if !t.IsValid() {
+		return t
+	}
+	t.ParentID = randomHex(8)
+	return t
+}
+
+func isHex(s string, length int) bool {
+	if len(s) != length || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+func isZeroHex(s string) bool {
+	return strings.Trim(s, "0") == ""
+}
+
+func randomHex(bytes int) string {
+	b := make([]byte, bytes)
+	_, err := rand.Read(b)
+	if err != nil {
+		// без случайности - хотя бы уникально по времени
+		return fmt.Sprintf("%0*x", bytes*2, time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,98 @@
+package reactivetools
+
+import (
+	"github.com/Shopify/sarama"
+	"testing"
+	"time"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tc, err := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "congo=t61rcWkgMzE")
+	if err != nil {
+		t.Fatalf("cant parse traceparent: %v", err)
+	}
+	if tc.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || tc.ParentID != "00f067aa0ba902b7" || tc.Flags != "01" {
+		t.Fatalf("incorrect trace context: %+v", tc)
+	}
+	child := tc.NewChild()
+	if child.TraceID != tc.TraceID || child.ParentID == tc.ParentID || !isHex(child.ParentID, 16) {
+		t.Fatalf("incorrect child trace context: %+v", child)
+	}
+
+	for _, tp := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+	} {
+		if _, err := ParseTraceparent(tp, ""); err == nil {
+			t.Fatalf("incorrect traceparent must not be parsed: %v", tp)
+		}
+	}
+}
+
+func TestOrderMetadataPropagation(t *testing.T) {
+	md := MessageMetadata{
+		Headers: map[string]string{
+			CorrelationIDHeader: "corr-1",
+			TraceparentHeader:   "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		},
+		Partition: unknownPartition,
+		Offset:    -1,
+	}
+	o := &checkOrder{
+		ot:            "product",
+		oid:           "100",
+		cn:            "images",
+		md:            md,
+		correlationID: correlationID(md, "order-1"),
+		trace:         traceContextFromMetadata(md),
+	}
+	dto := newResultDTO(newOrderResult(o, "ok", true))
+	if dto.CorrelationID != "corr-1" {
+		t.Fatalf("correlation id must be copied from order, got %v", dto.CorrelationID)
+	}
+	tc, err := ParseTraceparent(dto.Traceparent, "")
+	if err != nil || tc.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Fatalf("result must continue order's trace, got %v (err: %v)", dto.Traceparent, err)
+	}
+
+	if id := correlationID(MessageMetadata{}, "order-1"); id != "order-1" {
+		t.Fatalf("order id must be used as correlation id, got %v", id)
+	}
+	if id := correlationID(MessageMetadata{}, ""); len(id) != 32 {
+		t.Fatalf("correlation id must be generated, got %v", id)
+	}
+}
+
+func TestKafkaMessageMetadata(t *testing.T) {
+	written := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	msg := &sarama.ConsumerMessage{
+		Key:       []byte("100"),
+		Value:     []byte(`{}`),
+		Timestamp: written,
+		Partition: 3,
+		Offset:    42,
+		Headers: []*sarama.RecordHeader{
+			{Key: []byte("Correlation_ID"), Value: []byte("corr-header")},
+		},
+	}
+	md := newMessageMetadata(msg, map[string]string{CorrelationIDHeader: "corr-body", "Tenant": "a"})
+	if md.Key != "100" || !md.Timestamp.Equal(written) || md.Partition != 3 || md.Offset != 42 {
+		t.Fatalf("incorrect metadata: %+v", md)
+	}
+	if md.Headers[CorrelationIDHeader] != "corr-header" {
+		t.Fatalf("kafka headers must not be overwritten by body metadata, got %v", md.Headers[CorrelationIDHeader])
+	}
+	if md.Headers["tenant"] != "a" {
+		t.Fatalf("body metadata must complement kafka headers, got %v", md.Headers)
+	}
+
+	o := newCheckOrder(OrderMessage{ObjectType: "product", ObjectIdentifier: "100", CheckName: "images"}, &kafkaMessage{msg: msg})
+	f := orderLogFields(o)
+	if f[LogFieldPartition] != 3 || f[LogFieldOffset] != int64(42) || f[LogFieldCorrelationID] != "corr-header" {
+		t.Fatalf("incorrect order log fields: %v", f)
+	}
+}
@@ -2,12 +2,12 @@ package reactivetools
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	adapter "github.com/iddqdeika/kafka-adapter"
 	"github.com/iddqdeika/reactivetools/statistic"
 	helpful "github.com/iddqdeika/rrr/helpful"
-	"strconv"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -31,19 +31,51 @@ func NewKafkaOrderProvider(config helpful.Config, logger helpful.Logger) (CheckO
 		return nil, fmt.Errorf("must be not-nil logger")
 	}
 
-	orderTopic, err := config.GetString(ConfigOrderTopicNameKey)
+	objectType, err := config.GetString(ConfigObjectTypeKey)
 	if err != nil {
 		return nil, err
 	}
-	objectType, err := config.GetString(ConfigObjectTypeKey)
+	checkName, err := config.GetString(ConfigCheckNameKey)
 	if err != nil {
 		return nil, err
 	}
-	checkName, err := config.GetString(ConfigCheckNameKey)
+	return NewKafkaRoutingOrderProvider(config, logger, CheckRoute{ObjectType: objectType, CheckName: checkName})
+}
+
+// инстанциирует провайдер заказов сразу для нескольких маршрутов (тип объекта + название проверки).
+// в отличие от NewKafkaOrderProvider не читает object_type и check_name из конфига,
+// пропускает (подтверждая) только заказы, для которых не задан ни один маршрут.
+func NewKafkaRoutingOrderProvider(config helpful.Config, logger helpful.Logger, routes ...CheckRoute) (CheckOrderProvider, error) {
+
+	if config == nil {
+		return nil, fmt.Errorf("must be not-nil config")
+	}
+	if logger == nil {
+		return nil, fmt.Errorf("must be not-nil logger")
+	}
+	if len(routes) == 0 {
+		return nil, fmt.Errorf("must be at least one route")
+	}
+
+	orderTopic, err := config.GetString(ConfigOrderTopicNameKey)
+	if err != nil {
+		return nil, err
+	}
+
+	rs := make(map[CheckRoute]struct{}, len(routes))
+	for _, r := range routes {
+		rs[r] = struct{}{}
+	}
+
+	codec, err := orderCodecFromConfig(config)
 	if err != nil {
 		return nil, err
 	}
 
+	kafka, err := kafkaSettingsFromConfig(config, true)
+	if err != nil {
+		return nil, err
+	}
 	q, err := adapter.FromConfig(config, logger)
 	if err != nil {
 		return nil, err
@@ -52,58 +84,80 @@ func NewKafkaOrderProvider(config helpful.Config, logger helpful.Logger) (CheckO
 	if err != nil {
 		return nil, err
 	}
-	q.ReaderRegister(orderTopic)
+	malformed, err := newMalformedHandler(config, q, logger, deadLetterSourceCheckOrder)
+	if err != nil {
+		return nil, err
+	}
 	p := &checkOrderProvider{
 		orderTopicName: orderTopic,
-		objectType:     objectType,
-		checkName:      checkName,
-		q:              q,
+		routes:         rs,
+		codec:          codec,
+		malformed:      malformed,
+		skipped:        statistic.NewCounter("Orders skipped by provider", `Кол-во заказов, пропущенных провайдером (другие проверки и типы объектов).`),
+		malformedCount: statistic.NewCounter("Malformed orders", `Кол-во сообщений с заказами, которые не удалось разобрать.`),
+		consumption:    newConsumptionTracker(),
+		commits:        newCommitManager(logger),
+		consumer:       newKafkaConsumer(kafka, orderTopic, logger),
 		l:              logger,
 		ch:             make(chan CheckOrder, checkOrderChannelBuffer),
 	}
-	go p.run()
+	p.lag = &consumerLag{kafka: kafka, topic: orderTopic, subject: p.routesDescription()}
 	return p, nil
 }
 
 // читает нужный топик из данной Kafka и получает оттуда CheckOrder
-// из них собирает все подходящие по названию проверки и типу объекта
-// остальные - пропускает (подтверждая)
+// из них собирает все подходящие по названию проверки и типу объекта (маршруты)
+// остальные - пропускает (подтверждая в общем порядке, после всех более ранних заказов)
 // выбранные заказы на проверку пхает в очередь, доступную по методу OrderChan()
+// чтение идет только пока запущен Run (провайдер - rrr.Service), сервис проверки запускает его сам.
 type checkOrderProvider struct {
 	orderTopicName string
-	objectType     string
-	checkName      string
+	routes         map[CheckRoute]struct{}
+	codec          CheckOrderCodec
+	malformed      *malformedHandler
+	skipped        *statistic.Counter
+	malformedCount *statistic.Counter
+	lag            *consumerLag
+	consumption    *consumptionTracker
+	// все прочитанные сообщения регистрируются здесь в порядке чтения (см. committingProvider)
+	commits  *commitManager
+	consumer *kafkaConsumer
 
-	q  *adapter.Queue
 	l  helpful.Logger
 	ch chan CheckOrder
 }
 
 // дает статистики по провайдеру
-// пока это только лаг очереди, которую он смотрит.
-// не ну а шо, эт уже неплохо.
+// лаг очереди, которую он смотрит (по партициям и общий), возраст самого старого необработанного заказа,
+// скорость потребления и кол-во пропущенных и некорректных заказов.
+// недоступность лага (например, кафка) не скрывает остальные статистики: вместо лага отдается статистика-ошибка.
 func (p *checkOrderProvider) Statistics() ([]statistic.Statistic, error) {
-	ss := make([]statistic.Statistic, 0)
-	lags, err := p.getKafkaLagStatistic()
+	ss, err := statistic.NewCompositeProvider().AddNamed(statisticComponentConsumerLag, p.lag).Statistics()
 	if err != nil {
 		return nil, err
 	}
-	ss = append(ss, lags)
+	ss = append(ss, p.consumption.statistics(p.lag.subject, "order")...)
+	ss = append(ss, p.skipped, p.malformedCount)
 	return ss, nil
 }
 
-func (p *checkOrderProvider) getKafkaLagStatistic() (statistic.Statistic, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), lagRetrievingTimeout)
-	defer cancel()
-	lag, err := p.q.GetConsumerLagForSinglePartition(ctx, p.orderTopicName)
-	if err != nil {
-		return nil, fmt.Errorf("cant get consumer lag for kafka: %v", err)
+// доступность топика заказов
+func (p *checkOrderProvider) HealthChecks() []statistic.HealthCheck {
+	return []statistic.HealthCheck{kafkaReaderHealthCheck(p.lag.kafka, p.orderTopicName)}
+}
+
+// описание маршрутов провайдера для статистик.
+// для одного маршрута сохраняет прежний формат: check "name" (object type: type)
+func (p *checkOrderProvider) routesDescription() string {
+	descs := make([]string, 0, len(p.routes))
+	for r := range p.routes {
+		descs = append(descs, r.description())
 	}
-	return &SimpleStatistic{
-		N:    fmt.Sprintf("Consumer lag for check \"%v\" (object type: %v)", p.checkName, p.objectType),
-		V:    strconv.Itoa(int(lag)),
-		Desc: `Очередь на проверку. Разница между оффсетами последних обработанного и записанного сообщений.`,
-	}, nil
+	sort.Strings(descs)
+	if len(descs) == 1 {
+		return "check " + descs[0]
+	}
+	return "checks " + strings.Join(descs, ", ")
 }
 
 type SimpleStatistic struct {
@@ -128,44 +182,87 @@ func (s SimpleStatistic) Description() string {
 	return s.Desc
 }
 
-func (p *checkOrderProvider) run() {
+// читает заказы до закрытия контекста.
+// по завершении закрывает канал заказов, так что запускать можно только один раз.
+// группа потребителей закрывается не здесь, а в Close (см. kafkaConsumer).
+func (p *checkOrderProvider) Run(ctx context.Context) error {
+	defer close(p.ch)
+	p.l.Infof("order provider for topic %v started", p.orderTopicName)
+	defer p.l.Infof("order provider for topic %v finished", p.orderTopicName)
 	for {
-		p.iteration()
+		ok, err := p.iteration(ctx)
+		if err != nil {
+			p.l.Errorf("order provider for topic %v stopped: %v", p.orderTopicName, err)
+			return err
+		}
+		if !ok {
+			return nil
+		}
 	}
 }
 
-func (p *checkOrderProvider) iteration() {
-	msg, err := p.q.Get(p.orderTopicName)
+// возвращает false, если контекст закрыт и чтение пора заканчивать.
+// ошибка означает, что провайдер должен остановиться (например, политика некорректных сообщений stop).
+func (p *checkOrderProvider) iteration(ctx context.Context) (bool, error) {
+	msg, err := p.consumer.get(ctx)
 	if err != nil {
+		if ctx.Err() != nil {
+			return false, nil
+		}
 		p.l.Errorf("cant get msg from topic %v, err: %v", p.orderTopicName, err)
-		time.Sleep(intervalWhenCantGetMsg)
-		return
+		return sleepCtx(ctx, intervalWhenCantGetMsg), nil
 	}
-	od := &checkOrderData{}
-	err = json.Unmarshal(msg.Data(), od)
+	om, err := p.codec.DecodeOrder(msg.Data())
 	if err != nil {
-		p.l.Errorf("cant parse msg from topic %v, skipping, err: %v", p.orderTopicName, err)
-		return
+		p.malformedCount.Inc()
+		handled, err := p.malformed.handle(ctx, p.orderTopicName, msg, err)
+		if handled {
+			p.commits.skip(ctx, msg)
+		}
+		return ctx.Err() == nil, err
 	}
 
 	//skip other msgs
-	if !(od.ObjectType == p.objectType && od.CheckName == p.checkName) {
-		err := msg.Ack()
-		if err != nil {
-			p.l.Errorf("cant ack skipped msg, err: %v", err)
-		}
-		return
+	if _, ok := p.routes[CheckRoute{ObjectType: om.ObjectType, CheckName: om.CheckName}]; !ok {
+		p.skipped.Inc()
+		p.commits.skip(ctx, msg)
+		return true, nil
+	}
+	order := newCheckOrder(om, msg)
+	order.onAck = p.consumption.received(order.md)
+	// регистрируем до отправки в канал, чтобы следующие пропущенные сообщения не подтвердились раньше заказа
+	p.commits.track(order)
+	select {
+	case p.ch <- order:
+		return true, nil
+	case <-ctx.Done():
+		// заказ не подтвержден и будет получен заново
+		return false, nil
 	}
-	order := newCheckOrder(od.CheckName, od.ObjectType, od.ObjectIdentifier, msg)
-	p.ch <- order
 }
 
 func (p *checkOrderProvider) OrderChan() chan CheckOrder {
 	return p.ch
 }
 
-type checkOrderData struct {
-	ObjectType       string `json:"object_type"`
-	CheckName        string `json:"check_name"`
-	ObjectIdentifier string `json:"object_identifier"`
+func (p *checkOrderProvider) commitManager() *commitManager {
+	return p.commits
+}
+
+// закрывает группу потребителей. вызывается после остановки сервиса, чтобы успели подтвердиться
+// заказы, завершенные при плавной остановке.
+func (p *checkOrderProvider) Close() error {
+	return p.consumer.Close()
+}
+
+// ждет заданное время. возвращает false, если контекст закрылся раньше.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
 }
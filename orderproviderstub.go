@@ -3,10 +3,15 @@ package reactivetools
 import (
 	"context"
 	"github.com/iddqdeika/reactivetools/statistic"
+	"sync"
 	"time"
 )
 
 func NewStubOrderProvider(ctx context.Context, count int, interval time.Duration) CheckOrderProvider {
+	return newStubOrderProvider(ctx, count, interval)
+}
+
+func newStubOrderProvider(ctx context.Context, count int, interval time.Duration) *stubOrderProvider {
 	op := &stubOrderProvider{
 		count:    count,
 		interval: interval,
@@ -16,10 +21,15 @@ func NewStubOrderProvider(ctx context.Context, count int, interval time.Duration
 	return op
 }
 
+// заглушка-провайдер заказов.
+// заказы получают последовательные оффсеты в партиции 0, подтвержденные оффсеты запоминаются.
 type stubOrderProvider struct {
 	count    int
 	interval time.Duration
 	ch       chan CheckOrder
+
+	m     sync.Mutex
+	acked []int64
 }
 
 func (s *stubOrderProvider) Statistics() ([]statistic.Statistic, error) {
@@ -27,11 +37,11 @@ func (s *stubOrderProvider) Statistics() ([]statistic.Statistic, error) {
 }
 
 func (s *stubOrderProvider) generate(ctx context.Context) {
-	for i := s.count; i > 0; i-- {
+	for i := 0; i < s.count; i++ {
 		select {
 		case <-ctx.Done():
 			return
-		case s.ch <- newStubCheckOrder():
+		case s.ch <- newStubCheckOrder(int64(i), s.ack):
 			time.Sleep(s.interval)
 		}
 	}
@@ -42,16 +52,33 @@ func (s *stubOrderProvider) OrderChan() chan CheckOrder {
 	return s.ch
 }
 
-func newStubCheckOrder() CheckOrder {
+func (s *stubOrderProvider) ack(offset int64) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.acked = append(s.acked, offset)
+}
+
+// подтвержденные оффсеты в порядке подтверждения
+func (s *stubOrderProvider) ackedOffsets() []int64 {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return append([]int64(nil), s.acked...)
+}
+
+func newStubCheckOrder(offset int64, ack func(offset int64)) CheckOrder {
 	return &stubCheckOrder{
-		rch: make(chan CheckResult, 1),
-		pub: make(chan struct{}),
+		offset: offset,
+		ack:    ack,
+		rch:    make(chan CheckResult, 1),
+		pub:    make(chan struct{}),
 	}
 }
 
 type stubCheckOrder struct {
-	rch chan CheckResult
-	pub chan struct{}
+	offset int64
+	ack    func(offset int64)
+	rch    chan CheckResult
+	pub    chan struct{}
 }
 
 func (s *stubCheckOrder) ObjectType() string {
@@ -67,7 +94,6 @@ func (s *stubCheckOrder) CheckName() string {
 }
 
 func (s *stubCheckOrder) Result() chan CheckResult {
-	s.rch <- NewCheckResult("stub_type", s.ObjectIdentifier(), s.CheckName(), "stub_result", true)
 	return s.rch
 }
 
@@ -75,7 +101,18 @@ func (s *stubCheckOrder) Published() chan struct{} {
 	return s.pub
 }
 
+func (s *stubCheckOrder) Partition() int {
+	return 0
+}
+
+func (s *stubCheckOrder) Offset() int64 {
+	return s.offset
+}
+
 func (s *stubCheckOrder) Ack() error {
+	if s.ack != nil {
+		s.ack(s.offset)
+	}
 	return nil
 }
 
@@ -0,0 +1,323 @@
+package reactivetools
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/iddqdeika/reactivetools/statistic"
+	"github.com/iddqdeika/rrr/helpful"
+	bolt "go.etcd.io/bbolt"
+	"sync"
+	"time"
+)
+
+const (
+	// локальный outbox результатов:
+	// "outbox": {"bolt_storage_path": "/data/outbox.db", "retry_policy": {"initial_interval_in_ms": 100, "max_interval_in_ms": 10000}}
+	OutboxConfigKey = "outbox"
+
+	defaultOutboxRetryInitialInterval = time.Millisecond * 100
+	defaultOutboxRetryMaxInterval     = time.Second * 10
+)
+
+var outboxBucketName = []byte("outbox")
+
+// собирает outbox из раздела outbox конфига. без раздела публикатор возвращается как есть.
+func outboxFromConfig(cfg helpful.Config, l helpful.Logger, pub CheckResultPublisher) (CheckResultPublisher, error) {
+	if !cfg.Contains(OutboxConfigKey) {
+		return pub, nil
+	}
+	oc := cfg.Child(OutboxConfigKey)
+	path, err := oc.GetString("bolt_storage_path")
+	if err != nil {
+		return nil, err
+	}
+	retry := RetryPolicy{
+		InitialInterval: defaultOutboxRetryInitialInterval,
+		MaxInterval:     defaultOutboxRetryMaxInterval,
+		Multiplier:      defaultRetryMultiplier,
+		Jitter:          float64(defaultRetryJitterPercent) / 100,
+	}
+	if oc.Contains(RetryPolicyConfigKey) {
+		retry, err = NewRetryPolicy(oc.Child(RetryPolicyConfigKey))
+		if err != nil {
+			return nil, fmt.Errorf("incorrect %v: %v", configKey(OutboxConfigKey, RetryPolicyConfigKey), err)
+		}
+	}
+	return NewBoltResultOutbox(path, pub, retry, l)
+}
+
+// инстанциирует outbox результатов в файле bolt поверх данного публикатора.
+// PublishCheckResult только сохраняет результат в файл, так что заказ подтверждается сразу после этого,
+// а в кафка результаты отправляет фоновый ретранслятор (Run) - по порядку сохранения,
+// с повторами согласно retry (ограничения попыток не учитываются: результат не может быть потерян).
+// доставленные результаты удаляются из файла, недоставленные - отправляются после перезапуска.
+// outbox запускается вместе с сервисом проверки, если передан ему как публикатор.
+func NewBoltResultOutbox(path string, pub CheckResultPublisher, retry RetryPolicy, l helpful.Logger) (*ResultOutbox, error) {
+	if pub == nil {
+		return nil, fmt.Errorf("must be not-nil CheckResultPublisher")
+	}
+	if l == nil {
+		return nil, fmt.Errorf("must be not-nil Logger")
+	}
+	db, err := openSharedBolt(path)
+	if err != nil {
+		return nil, err
+	}
+	pending := 0
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(outboxBucketName)
+		if err != nil {
+			return err
+		}
+		pending = b.Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	retry.MaxAttempts = 0
+	retry.MaxElapsedTime = 0
+	o := &ResultOutbox{
+		db:      db,
+		pub:     pub,
+		retry:   retry,
+		l:       l,
+		notify:  make(chan struct{}, 1),
+		pending: statistic.NewGauge("Outbox pending results", `Кол-во результатов в outbox, ожидающих отправки.`),
+		relayed: statistic.NewCounter("Outbox relayed results", `Кол-во результатов, отправленных из outbox.`),
+		errors:  statistic.NewCounter("Outbox relay errors", `Кол-во неудачных попыток отправки результатов из outbox.`),
+	}
+	o.pending.Set(int64(pending))
+	return o, nil
+}
+
+type ResultOutbox struct {
+	db    *sharedBolt
+	pub   CheckResultPublisher
+	retry RetryPolicy
+	l     helpful.Logger
+
+	// сигнал ретранслятору о новых результатах
+	notify chan struct{}
+
+	// Close останавливает запущенные ретрансляторы и дожидается их завершения
+	m       sync.Mutex
+	closed  bool
+	stops   []context.CancelFunc
+	running sync.WaitGroup
+
+	pending *statistic.Gauge
+	relayed *statistic.Counter
+	errors  *statistic.Counter
+}
+
+// сохраненный результат: все, что нужно для восстановления результата при отправке
+type outboxEntry struct {
+	ObjectType    string            `json:"object_type"`
+	Identifier    string            `json:"identifier"`
+	CheckName     string            `json:"check_name"`
+	Message       string            `json:"message"`
+	Success       bool              `json:"success"`
+	OrderID       string            `json:"order_id,omitempty"`
+	CorrelationID string            `json:"correlation_id,omitempty"`
+	Trace         TraceContext      `json:"trace"`
+	Severity      Severity          `json:"severity,omitempty"`
+	Findings      []Finding         `json:"findings,omitempty"`
+	Duration      time.Duration     `json:"duration,omitempty"`
+	Attributes    map[string]string `json:"attributes,omitempty"`
+}
+
+func newOutboxEntry(r CheckResult) outboxEntry {
+	e := outboxEntry{
+		ObjectType: r.ObjectType(),
+		Identifier: r.ObjectIdentifier(),
+		CheckName:  r.CheckName(),
+		Message:    r.ResultMessage(),
+		Success:    r.CheckSuccess(),
+	}
+	if oi, ok := r.(orderIdentified); ok {
+		e.OrderID = oi.OrderID()
+	}
+	if tr, ok := r.(tracedResult); ok {
+		e.CorrelationID = tr.CorrelationID()
+		e.Trace = tr.TraceContext()
+	}
+	if dr, ok := r.(DetailedCheckResult); ok {
+		e.Severity = dr.Severity()
+		e.Findings = dr.Findings()
+		e.Duration = dr.Duration()
+		e.Attributes = dr.Attributes()
+	}
+	return e
+}
+
+func (e outboxEntry) result() *checkResult {
+	return &checkResult{
+		ot:            e.ObjectType,
+		oid:           e.Identifier,
+		cn:            e.CheckName,
+		rm:            e.Message,
+		cs:            e.Success,
+		orderID:       e.OrderID,
+		correlationID: e.CorrelationID,
+		trace:         e.Trace,
+		severity:      e.Severity,
+		findings:      e.Findings,
+		duration:      e.Duration,
+		attributes:    e.Attributes,
+	}
+}
+
+// сохраняет результат в outbox. после возврата без ошибки результат не будет потерян.
+func (o *ResultOutbox) PublishCheckResult(r CheckResult) error {
+	if r == nil {
+		return nil
+	}
+	data, err := json.Marshal(newOutboxEntry(r))
+	if err != nil {
+		return err
+	}
+	err = o.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(outboxBucketName)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		return b.Put(outboxKey(seq), data)
+	})
+	if err != nil {
+		return fmt.Errorf("cant store result in outbox: %v", err)
+	}
+	o.pending.Add(1)
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// ключи по возрастанию последовательности, так что курсор идет в порядке сохранения
+func outboxKey(seq uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	return k
+}
+
+// ретранслятор: отправляет сохраненные результаты по порядку, пока не закроется контекст или outbox (Close).
+func (o *ResultOutbox) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	o.m.Lock()
+	if o.closed {
+		o.m.Unlock()
+		return fmt.Errorf("outbox is closed")
+	}
+	o.stops = append(o.stops, cancel)
+	o.running.Add(1)
+	o.m.Unlock()
+	defer o.running.Done()
+
+	o.l.Infof("outbox relay started, pending results: %v", o.pending.Get())
+	for {
+		if ctx.Err() != nil {
+			return nil
+		}
+		key, data, err := o.first()
+		if err != nil {
+			return fmt.Errorf("cant read outbox: %v", err)
+		}
+		if key == nil {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-o.notify:
+				continue
+			}
+		}
+		var e outboxEntry
+		err = json.Unmarshal(data, &e)
+		if err != nil {
+			// такую запись отправить невозможно никогда - удаляем, чтобы не блокировать остальные
+			o.l.Errorf("dropping corrupted outbox entry: %v", err)
+			err = o.remove(key)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		r := e.result()
+		_, err = o.retry.Do(ctx, func(attempt int) error {
+			err := o.pub.PublishCheckResult(r)
+			if errors.Is(err, ErrCircuitOpen) {
+				// о размыкании пишет сам предохранитель
+				logDebugf(o.l, "cant relay result from outbox (attempt %v): %v", attempt, err)
+			} else if err != nil {
+				o.errors.Inc()
+				logWarnf(o.l, "cant relay result from outbox (attempt %v): %v", attempt, err)
+			}
+			return err
+		})
+		if err != nil {
+			// повторы прекращаются только при закрытии контекста - результат останется до следующего запуска
+			return nil
+		}
+		err = o.remove(key)
+		if err != nil {
+			return err
+		}
+		o.relayed.Inc()
+	}
+}
+
+// самая ранняя сохраненная запись, nil - outbox пуст
+func (o *ResultOutbox) first() ([]byte, []byte, error) {
+	var key, data []byte
+	err := o.db.View(func(tx *bolt.Tx) error {
+		k, v := tx.Bucket(outboxBucketName).Cursor().First()
+		key = append(key, k...)
+		data = append(data, v...)
+		return nil
+	})
+	return key, data, err
+}
+
+func (o *ResultOutbox) remove(key []byte) error {
+	err := o.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(outboxBucketName).Delete(key)
+	})
+	if err != nil {
+		return fmt.Errorf("cant remove result from outbox: %v", err)
+	}
+	o.pending.Add(-1)
+	return nil
+}
+
+func (o *ResultOutbox) Statistics() ([]statistic.Statistic, error) {
+	return []statistic.Statistic{o.pending, o.relayed, o.errors}, nil
+}
+
+// проверки здоровья публикатора, в который ретранслируются результаты
+func (o *ResultOutbox) HealthChecks() []statistic.HealthCheck {
+	return componentHealthChecks(o.pub)
+}
+
+// останавливает ретранслятор и закрывает файл outbox. неотправленные результаты остаются в файле до следующего запуска.
+// вызывается после остановки сервиса (Release рута).
+func (o *ResultOutbox) Close() error {
+	o.m.Lock()
+	if o.closed {
+		o.m.Unlock()
+		return nil
+	}
+	o.closed = true
+	for _, stop := range o.stops {
+		stop()
+	}
+	o.m.Unlock()
+	o.running.Wait()
+	return o.db.Close()
+}
@@ -0,0 +1,161 @@
+package reactivetools
+
+import (
+	"context"
+	"errors"
+	"github.com/iddqdeika/rrr/helpful"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// публикатор, недоступный первые failures попыток
+type flakyPublisher struct {
+	m         sync.Mutex
+	failures  int
+	published []CheckResult
+}
+
+func (p *flakyPublisher) PublishCheckResult(r CheckResult) error {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.failures > 0 {
+		p.failures--
+		return errors.New("kafka is down")
+	}
+	p.published = append(p.published, r)
+	return nil
+}
+
+func (p *flakyPublisher) results() []CheckResult {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return append([]CheckResult(nil), p.published...)
+}
+
+func TestResultOutbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "outbox.db")
+	l := helpful.DefaultLogger.WithLevel(helpful.LogNone)
+	retry := RetryPolicy{InitialInterval: time.Millisecond, MaxInterval: time.Millisecond, MaxAttempts: 1}
+
+	// результаты сохранены, но ретранслятор не запускался
+	pub := &flakyPublisher{failures: 3}
+	o, err := NewBoltResultOutbox(path, pub, retry, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.PublishCheckResult(NewDetailedCheckResult("product", "1", "images", CheckDetails{Message: "first",
+		Findings: []Finding{{Field: "images", Code: "missing"}}}, time.Second))
+	o.PublishCheckResult(NewCheckResult("product", "2", "images", "second", true))
+	err = o.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// после перезапуска результаты отправляются по порядку, несмотря на ошибки публикатора
+	o, err = NewBoltResultOutbox(path, pub, retry, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	if o.pending.Get() != 2 {
+		t.Fatalf("expected 2 pending results after restart, got %v", o.pending.Get())
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		o.Run(ctx)
+	}()
+	o.PublishCheckResult(NewCheckResult("product", "3", "images", "third", true))
+
+	deadline := time.Now().Add(time.Second * 5)
+	for len(pub.results()) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("results were not relayed in time, got %v", len(pub.results()))
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	cancel()
+	<-done
+
+	rs := pub.results()
+	for i, msg := range []string{"first", "second", "third"} {
+		if rs[i].ResultMessage() != msg {
+			t.Errorf("result %v: expected %v, got %v", i, msg, rs[i].ResultMessage())
+		}
+	}
+	dr, ok := rs[0].(DetailedCheckResult)
+	if !ok || dr.Duration() != time.Second || len(dr.Findings()) != 1 || dr.Severity() != SeverityError {
+		t.Errorf("result details must survive outbox, got %+v", rs[0])
+	}
+	if o.pending.Get() != 0 || o.errors.Get() != 3 {
+		t.Errorf("expected empty outbox and 3 relay errors, got %v and %v", o.pending.Get(), o.errors.Get())
+	}
+}
+
+func TestResultOutboxCloseStopsRelay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "outbox.db")
+	l := helpful.DefaultLogger.WithLevel(helpful.LogNone)
+	retry := RetryPolicy{InitialInterval: time.Millisecond, MaxInterval: time.Millisecond}
+
+	// кафка недоступна: ретранслятор повторяет попытки, пока outbox не закроют
+	down := &flakyPublisher{failures: 1 << 30}
+	o, err := NewBoltResultOutbox(path, down, retry, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- o.Run(context.Background())
+	}()
+	o.PublishCheckResult(NewCheckResult("product", "1", "images", "pending", true))
+	time.Sleep(time.Millisecond * 20)
+	err = o.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("relay must stop without error, got %v", err)
+		}
+	default:
+		t.Fatal("relay must be stopped by Close")
+	}
+
+	// неотправленный результат остается в файле и отправляется после перезапуска
+	up := &flakyPublisher{}
+	o, err = NewBoltResultOutbox(path, up, retry, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.pending.Get() != 1 {
+		t.Fatalf("expected 1 pending result after reopen, got %v", o.pending.Get())
+	}
+	go o.Run(context.Background())
+	deadline := time.Now().Add(time.Second * 5)
+	for len(up.results()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("pending result was not relayed after reopen")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	err = o.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
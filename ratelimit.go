@@ -0,0 +1,210 @@
+package reactivetools
+
+import (
+	"context"
+	"fmt"
+	"github.com/iddqdeika/reactivetools/statistic"
+	"github.com/iddqdeika/rrr/helpful"
+	"sync"
+	"time"
+)
+
+const (
+	// ограничение частоты проверок:
+	// "rate_limit": {
+	//   "limiters": {"pim_api": {"requests_per_second": 50, "burst": 10}},
+	//   "checks": {"<check_name>": {"requests_per_second": 5, "burst": 1}, "<other_check_name>": {"limiter": "pim_api"}}
+	// }
+	RateLimitConfigKey = "rate_limit"
+
+	defaultRateLimitBurst = 1
+)
+
+// ограничитель частоты: корзина токенов, пополняемая со скоростью rate в секунду, вместимостью burst.
+func newTokenBucket(name string, rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		name:   name,
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+		wait: statistic.NewHistogram("Rate limiter wait seconds for "+name,
+			`Время ожидания разрешения ограничителя частоты проверок, в секундах.`),
+	}
+}
+
+type tokenBucket struct {
+	name  string
+	rate  float64
+	burst float64
+
+	m      sync.Mutex
+	tokens float64
+	last   time.Time
+
+	wait *statistic.Histogram
+}
+
+// ждет токен, пока не закроется контекст
+func (b *tokenBucket) Wait(ctx context.Context) error {
+	started := time.Now()
+	d := b.reserve()
+	if d <= 0 {
+		b.wait.Observe(0)
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		b.wait.ObserveSince(started)
+		return nil
+	case <-ctx.Done():
+		// токен не использован - возвращаем его
+		b.release()
+		return ctx.Err()
+	}
+}
+
+// забирает токен (в том числе будущий) и возвращает время, через которое его можно использовать
+func (b *tokenBucket) reserve() time.Duration {
+	b.m.Lock()
+	defer b.m.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) release() {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.tokens++
+}
+
+// ограничители частоты по названиям проверок.
+// несколько проверок могут ссылаться на один именованный ограничитель (общий ресурс).
+type rateLimits struct {
+	byCheck map[string]*tokenBucket
+}
+
+// собирает ограничители для переданных названий проверок из раздела rate_limit.
+// без раздела (или для проверок, которых в нем нет) частота не ограничивается.
+func rateLimitsFromConfig(cfg helpful.Config, checkNames ...string) (*rateLimits, error) {
+	rl := &rateLimits{byCheck: make(map[string]*tokenBucket)}
+	if !cfg.Contains(RateLimitConfigKey) {
+		return rl, nil
+	}
+	rc := cfg.Child(RateLimitConfigKey)
+	if !rc.Contains("checks") {
+		return rl, nil
+	}
+	checks := rc.Child("checks")
+	named := make(map[string]*tokenBucket)
+	for _, cn := range checkNames {
+		if !checks.Contains(cn) {
+			continue
+		}
+		cc := checks.Child(cn)
+		if !cc.Contains("limiter") {
+			b, err := tokenBucketFromConfig(cc, cn)
+			if err != nil {
+				return nil, fmt.Errorf("cant get rate limit for check %v: %v", cn, err)
+			}
+			rl.byCheck[cn] = b
+			continue
+		}
+		// именованный ограничитель создается один раз и разделяется всеми ссылающимися на него проверками
+		name, err := cc.GetString("limiter")
+		if err != nil {
+			return nil, fmt.Errorf("cant get limiter for check %v: %v", cn, err)
+		}
+		b, ok := named[name]
+		if !ok {
+			if !configContains(rc, configKey("limiters", name)) {
+				return nil, fmt.Errorf("unknown limiter %v for check %v", name, cn)
+			}
+			b, err = tokenBucketFromConfig(rc.Child("limiters").Child(name), name)
+			if err != nil {
+				return nil, fmt.Errorf("cant get limiter %v: %v", name, err)
+			}
+			named[name] = b
+		}
+		rl.byCheck[cn] = b
+	}
+	return rl, nil
+}
+
+func tokenBucketFromConfig(cfg helpful.Config, name string) (*tokenBucket, error) {
+	rps, err := cfg.GetInt("requests_per_second")
+	if err != nil {
+		return nil, err
+	}
+	if rps <= 0 {
+		return nil, fmt.Errorf("requests_per_second must be positive")
+	}
+	burst, err := optionalInt(cfg, "burst", defaultRateLimitBurst)
+	if err != nil {
+		return nil, err
+	}
+	if burst < 1 {
+		return nil, fmt.Errorf("burst must be positive")
+	}
+	return newTokenBucket(name, float64(rps), burst), nil
+}
+
+// оборачивает процессор проверки checkName, если для нее задано ограничение
+func (rl *rateLimits) wrap(proc CheckOrderProcessor, checkName string) CheckOrderProcessor {
+	b, ok := rl.byCheck[checkName]
+	if !ok {
+		return proc
+	}
+	return &rateLimitProcessor{proc: proc, limiter: b}
+}
+
+// процессор, перед проверкой ожидающий разрешения ограничителя.
+// должен оборачивать процессор с таймаутом: ожидание откладывает проверку, но не учитывается в таймауте
+// проверки (check_timeout) и не приводит к результату "timed out".
+// кэширующий процессор оборачивает ограничитель, так что токен расходуют только попытки, которые
+// действительно выполняют проверку, а результат из кэша отдается без ожидания.
+// пакетный процессор получает заказ только после разрешения, так что каждый заказ пакета расходует токен.
+type rateLimitProcessor struct {
+	proc    CheckOrderProcessor
+	limiter *tokenBucket
+}
+
+func (p *rateLimitProcessor) Process(ctx context.Context, o CheckOrder) error {
+	err := p.limiter.Wait(ctx)
+	if err != nil {
+		return err
+	}
+	return p.proc.Process(ctx, o)
+}
+
+// время ожидания ограничителя и статистики обернутого процессора (если он их предоставляет)
+func (p *rateLimitProcessor) Statistics() ([]statistic.Statistic, error) {
+	res := []statistic.Statistic{p.limiter.wait}
+	if sp, ok := p.proc.(statistic.StatisticProvider); ok {
+		ps, err := sp.Statistics()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, ps...)
+	}
+	return res, nil
+}
+
+func (p *rateLimitProcessor) HealthChecks() []statistic.HealthCheck {
+	return componentHealthChecks(p.proc)
+}
+
+func (p *rateLimitProcessor) forget(o CheckOrder) {
+	forgetOrder(p.proc, o)
+}
@@ -0,0 +1,122 @@
+package reactivetools
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/iddqdeika/rrr/helpful"
+	"testing"
+	"time"
+)
+
+func TestRateLimits(t *testing.T) {
+	values := make(map[string]interface{})
+	err := json.Unmarshal([]byte(`{"rate_limit": {
+		"limiters": {"pim_api": {"requests_per_second": 20, "burst": 2}},
+		"checks": {"a": {"limiter": "pim_api"}, "b": {"limiter": "pim_api"}, "c": {"requests_per_second": 1000}}
+	}}`), &values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl, err := rateLimitsFromConfig(newFileConfig(values, nil), "a", "b", "c", "d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rl.byCheck["a"] != rl.byCheck["b"] || rl.byCheck["c"] == nil || rl.byCheck["d"] != nil {
+		t.Fatalf("unexpected limiters %+v", rl.byCheck)
+	}
+
+	// burst проходит сразу, дальше - не чаще 20 в секунду на обе проверки
+	inner, err := NewCheckOrderProcessor(&countingCheckProvider{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := rl.wrap(inner, "a"), rl.wrap(inner, "b")
+	started := time.Now()
+	for i := 0; i < 6; i++ {
+		proc := a
+		if i%2 == 1 {
+			proc = b
+		}
+		o := revisionOrder("1", "")
+		err = proc.Process(context.Background(), o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-o.Result()
+	}
+	if d := time.Since(started); d < time.Millisecond*190 || d > time.Millisecond*400 {
+		t.Errorf("6 checks with burst 2 and 20 rps must take about 200ms, took %v", d)
+	}
+	h := rl.byCheck["a"].wait
+	if h.Count() != 6 {
+		t.Errorf("expected 6 wait observations, got %v", h.Count())
+	}
+
+	// ожидание прерывается закрытием контекста, токен возвращается
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	err = rl.byCheck["a"].Wait(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+
+	values["rate_limit"].(map[string]interface{})["checks"] = map[string]interface{}{"a": map[string]interface{}{"limiter": "missing"}}
+	_, err = rateLimitsFromConfig(newFileConfig(values, nil), "a")
+	if err == nil {
+		t.Errorf("unknown limiter must be an error")
+	}
+}
+
+func TestRateLimitWaitIsNotTimeout(t *testing.T) {
+	inner, err := NewCheckOrderProcessor(&delayCheckProvider{delay: func(o CheckOrder) time.Duration {
+		return time.Millisecond
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proc, err := NewTimeoutCheckOrderProcessor(inner, CheckTimeoutPolicy{Timeout: time.Millisecond * 50},
+		helpful.DefaultLogger.WithLevel(helpful.LogNone))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ожидание второго токена (100мс) дольше таймаута проверки, но проверку только откладывает
+	limited := &rateLimitProcessor{proc: proc, limiter: newTokenBucket("test", 10, 1)}
+	for i := 0; i < 2; i++ {
+		o := newStubCheckOrder(int64(i), nil)
+		err = limited.Process(context.Background(), o)
+		if err != nil {
+			t.Fatalf("order %v: rate limit wait must not time out the check, got %v", i, err)
+		}
+		if r := <-o.Result(); !r.CheckSuccess() {
+			t.Fatalf("order %v: unexpected result %+v", i, r)
+		}
+	}
+}
+
+func TestCacheHitsSkipRateLimit(t *testing.T) {
+	cp := &countingCheckProvider{}
+	inner, err := NewCheckOrderProcessor(cp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter := newTokenBucket("test", 10, 1)
+	proc := newCachingProcessor(&rateLimitProcessor{proc: inner, limiter: limiter}, newLruResultCache(10), time.Minute, "",
+		helpful.DefaultLogger.WithLevel(helpful.LogNone), "")
+
+	started := time.Now()
+	for i := 0; i < 3; i++ {
+		o := revisionOrder("1", "")
+		err = proc.Process(context.Background(), o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-o.Result()
+	}
+	// токен расходует только проверка, результаты из кэша отдаются без ожидания второго токена (100мс)
+	if d := time.Since(started); d > time.Millisecond*50 {
+		t.Errorf("cache hits must not wait for rate limiter, took %v", d)
+	}
+	if cp.calls != 1 || limiter.wait.Count() != 1 {
+		t.Errorf("only cache miss must take a token, checks: %v, waits: %v", cp.calls, limiter.wait.Count())
+	}
+}
@@ -1,9 +1,9 @@
 package reactivetools
 
 import (
-	"encoding/json"
 	"fmt"
 	adapter "github.com/iddqdeika/kafka-adapter"
+	"github.com/iddqdeika/reactivetools/statistic"
 	"github.com/iddqdeika/rrr/helpful"
 )
 
@@ -24,7 +24,15 @@ func NewKafkaResultPublisher(config helpful.Config, logger helpful.Logger) (Chec
 	if err != nil {
 		return nil, err
 	}
+	codec, err := resultCodecFromConfig(config)
+	if err != nil {
+		return nil, err
+	}
 
+	kafka, err := kafkaSettingsFromConfig(config, false)
+	if err != nil {
+		return nil, err
+	}
 	q, err := adapter.FromConfig(config, logger)
 	if err != nil {
 		return nil, err
@@ -36,8 +44,10 @@ func NewKafkaResultPublisher(config helpful.Config, logger helpful.Logger) (Chec
 	q.WriterRegister(resultTopic)
 	return &publisher{
 		q:               q,
+		kafka:           kafka,
 		l:               logger,
 		resultTopicName: resultTopic,
+		codec:           codec,
 	}, nil
 }
 
@@ -45,14 +55,32 @@ func NewKafkaResultPublisher(config helpful.Config, logger helpful.Logger) (Chec
 // публикует результаты проверок в кафка.
 type publisher struct {
 	q               *adapter.Queue
+	kafka           kafkaSettings
 	l               helpful.Logger
 	resultTopicName string
+	codec           CheckResultCodec
 }
 
 func (p *publisher) PublishCheckResult(r CheckResult) error {
 	if r == nil {
 		return nil
 	}
+	data, err := p.codec.EncodeResult(r)
+	if err != nil {
+		return err
+	}
+	return p.q.Put(p.resultTopicName, data)
+}
+
+// доступность топика результатов
+func (p *publisher) HealthChecks() []statistic.HealthCheck {
+	return []statistic.HealthCheck{kafkaWriterHealthCheck(p.kafka, p.resultTopicName)}
+}
+
+// подробности (важность, замечания, длительность, атрибуты) задаются только для результатов DetailedCheckProvider
+// (и результатов по таймауту), а пустые поля не сериализуются,
+// так что результаты CheckProvider публикуются в прежнем виде.
+func newResultDTO(r CheckResult) ResultDTO {
 	res := ResultDTO{
 		ObjectType:   r.ObjectType(),
 		Identifier:   r.ObjectIdentifier(),
@@ -60,17 +88,36 @@ func (p *publisher) PublishCheckResult(r CheckResult) error {
 		CheckStatus:  r.CheckSuccess(),
 		CheckMessage: r.ResultMessage(),
 	}
-	data, err := json.Marshal(res)
-	if err != nil {
-		return err
+	if tr, ok := r.(tracedResult); ok {
+		res.CorrelationID = tr.CorrelationID()
+		res.Traceparent = tr.TraceContext().Traceparent()
 	}
-	return p.q.Put(p.resultTopicName, data)
+	if dr, ok := r.(DetailedCheckResult); ok {
+		res.Severity = dr.Severity()
+		res.Findings = dr.Findings()
+		res.DurationMs = dr.Duration().Milliseconds()
+		res.Attributes = dr.Attributes()
+	}
+	return res
 }
 
 type ResultDTO struct {
-	ObjectType   string `json:"object_type"`
-	Identifier   string `json:"identifier"`
-	CheckName    string `json:"check_name"`
-	CheckStatus  bool   `json:"check_status"`
-	CheckMessage string `json:"check_message"`
+	ObjectType   string            `json:"object_type"`
+	Identifier   string            `json:"identifier"`
+	CheckName    string            `json:"check_name"`
+	CheckStatus  bool              `json:"check_status"`
+	CheckMessage string            `json:"check_message"`
+	Severity     Severity          `json:"severity,omitempty"`
+	Findings     []Finding         `json:"findings,omitempty"`
+	DurationMs   int64             `json:"duration_ms,omitempty"`
+	Attributes   map[string]string `json:"attributes,omitempty"`
+
+	CorrelationID string `json:"correlation_id,omitempty"`
+	Traceparent   string `json:"traceparent,omitempty"`
+}
+
+// результат, несущий идентификатор корреляции и контекст трассировки заказа
+type tracedResult interface {
+	CorrelationID() string
+	TraceContext() TraceContext
 }
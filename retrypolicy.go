@@ -0,0 +1,170 @@
+package reactivetools
+
+import (
+	"context"
+	"fmt"
+	"github.com/iddqdeika/rrr/helpful"
+	"math"
+	"math/rand"
+	"time"
+)
+
+const (
+	RetryPolicyConfigKey = "retry_policy"
+
+	defaultRetryMultiplier    = 2
+	defaultRetryJitterPercent = 20
+)
+
+// политика повторов обработки.
+// интервал между попытками растет экспоненциально (InitialInterval * Multiplier^(n-1)) до MaxInterval,
+// к нему добавляется случайный разброс в пределах Jitter (доля от интервала, от 0 до 1).
+// MaxAttempts и MaxElapsedTime ограничивают повторы, нулевые значения - без ограничений.
+type RetryPolicy struct {
+	MaxAttempts     int
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	Multiplier      float64
+	Jitter          float64
+	MaxElapsedTime  time.Duration
+}
+
+// политика по умолчанию: бесконечные повторы раз в processRetryInterval.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		InitialInterval: processRetryInterval,
+		MaxInterval:     processRetryInterval,
+		Multiplier:      1,
+	}
+}
+
+// собирает политику повторов из конфига.
+// ключи: max_attempts, initial_interval_in_ms, max_interval_in_ms, multiplier, jitter_percent, max_elapsed_time_in_secs.
+// обязателен только initial_interval_in_ms.
+func NewRetryPolicy(cfg helpful.Config) (RetryPolicy, error) {
+	if cfg == nil {
+		return RetryPolicy{}, fmt.Errorf("must be not-nil Config")
+	}
+	initial, err := cfg.GetInt("initial_interval_in_ms")
+	if err != nil {
+		return RetryPolicy{}, err
+	}
+	if initial <= 0 {
+		return RetryPolicy{}, fmt.Errorf("initial_interval_in_ms must be positive")
+	}
+	maxInterval := initial
+	if cfg.Contains("max_interval_in_ms") {
+		maxInterval, err = cfg.GetInt("max_interval_in_ms")
+		if err != nil {
+			return RetryPolicy{}, err
+		}
+		if maxInterval < initial {
+			return RetryPolicy{}, fmt.Errorf("max_interval_in_ms must not be less than initial_interval_in_ms")
+		}
+	}
+	multiplier, err := optionalInt(cfg, "multiplier", defaultRetryMultiplier)
+	if err != nil {
+		return RetryPolicy{}, err
+	}
+	if multiplier < 1 {
+		return RetryPolicy{}, fmt.Errorf("multiplier must be at least 1")
+	}
+	jitter, err := optionalInt(cfg, "jitter_percent", defaultRetryJitterPercent)
+	if err != nil {
+		return RetryPolicy{}, err
+	}
+	if jitter < 0 || jitter > 100 {
+		return RetryPolicy{}, fmt.Errorf("jitter_percent must be between 0 and 100")
+	}
+	maxAttempts, err := optionalInt(cfg, "max_attempts", 0)
+	if err != nil {
+		return RetryPolicy{}, err
+	}
+	maxElapsed, err := optionalInt(cfg, "max_elapsed_time_in_secs", 0)
+	if err != nil {
+		return RetryPolicy{}, err
+	}
+	if maxAttempts < 0 || maxElapsed < 0 {
+		return RetryPolicy{}, fmt.Errorf("max_attempts and max_elapsed_time_in_secs must not be negative")
+	}
+	return RetryPolicy{
+		MaxAttempts:     maxAttempts,
+		InitialInterval: time.Duration(initial) * time.Millisecond,
+		MaxInterval:     time.Duration(maxInterval) * time.Millisecond,
+		Multiplier:      float64(multiplier),
+		Jitter:          float64(jitter) / 100,
+		MaxElapsedTime:  time.Duration(maxElapsed) * time.Second,
+	}, nil
+}
+
+// политика повторов из раздела retry_policy конфига, если он есть. иначе - политика по умолчанию.
+func retryPolicyFromConfig(cfg helpful.Config) (RetryPolicy, error) {
+	if !cfg.Contains(RetryPolicyConfigKey) {
+		return DefaultRetryPolicy(), nil
+	}
+	p, err := NewRetryPolicy(cfg.Child(RetryPolicyConfigKey))
+	if err != nil {
+		return RetryPolicy{}, fmt.Errorf("incorrect %v: %v", RetryPolicyConfigKey, err)
+	}
+	return p, nil
+}
+
+func optionalInt(cfg helpful.Config, key string, def int) (int, error) {
+	if !cfg.Contains(key) {
+		return def, nil
+	}
+	return cfg.GetInt(key)
+}
+
+// ограничивает ли политика кол-во попыток или время повторов
+func (p RetryPolicy) bounded() bool {
+	return p.MaxAttempts > 0 || p.MaxElapsedTime > 0
+}
+
+// исполняет f, пока она не завершится без ошибки, не кончатся попытки или не закроется контекст.
+// возвращает кол-во сделанных попыток и последнюю ошибку (nil, если последняя попытка успешна).
+// если ошибка вернулась из-за закрытия контекста, то ctx.Err() будет не nil.
+func (p RetryPolicy) Do(ctx context.Context, f func(attempt int) error) (int, error) {
+	started := time.Now()
+	attempt := 0
+	for {
+		attempt++
+		err := f(attempt)
+		if err == nil {
+			return attempt, nil
+		}
+		if p.MaxAttempts > 0 && attempt >= p.MaxAttempts {
+			return attempt, err
+		}
+		wait := p.Backoff(attempt)
+		if p.MaxElapsedTime > 0 && time.Since(started)+wait > p.MaxElapsedTime {
+			return attempt, err
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return attempt, err
+		case <-t.C:
+		}
+	}
+}
+
+// интервал ожидания после данной (начиная с 1) неудачной попытки.
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	d := float64(p.InitialInterval) * math.Pow(multiplier, float64(attempt-1))
+	if p.MaxInterval > 0 && d > float64(p.MaxInterval) {
+		d = float64(p.MaxInterval)
+	}
+	if p.Jitter > 0 {
+		d += d * p.Jitter * (rand.Float64()*2 - 1)
+	}
+	return time.Duration(d)
+}
@@ -0,0 +1,71 @@
+package reactivetools
+
+import (
+	"context"
+	"fmt"
+	"github.com/iddqdeika/rrr/helpful"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	p := RetryPolicy{
+		MaxAttempts:     3,
+		InitialInterval: time.Millisecond,
+		MaxInterval:     time.Millisecond * 4,
+		Multiplier:      2,
+	}
+	for attempt, expected := range []time.Duration{time.Millisecond, time.Millisecond * 2, time.Millisecond * 4, time.Millisecond * 4} {
+		if b := p.Backoff(attempt + 1); b != expected {
+			t.Fatalf("incorrect backoff for attempt %v: %v, expected %v", attempt+1, b, expected)
+		}
+	}
+
+	calls := 0
+	attempts, err := p.Do(context.Background(), func(attempt int) error {
+		calls++
+		return fmt.Errorf("attempt %v failed", attempt)
+	})
+	if err == nil || attempts != 3 || calls != 3 {
+		t.Fatalf("policy must stop after 3 attempts, got %v attempts (%v calls), err: %v", attempts, calls, err)
+	}
+
+	attempts, err = p.Do(context.Background(), func(attempt int) error {
+		if attempt < 2 {
+			return fmt.Errorf("attempt %v failed", attempt)
+		}
+		return nil
+	})
+	if err != nil || attempts != 2 {
+		t.Fatalf("policy must succeed on second attempt, got %v attempts, err: %v", attempts, err)
+	}
+}
+
+func TestBoundedRetryPolicyRequiresDeadLetters(t *testing.T) {
+	l := helpful.DefaultLogger.WithLevel(helpful.LogNone)
+	cfg := newFileConfig(map[string]interface{}{
+		"parallelism":        1,
+		RetryPolicyConfigKey: map[string]interface{}{"initial_interval_in_ms": 10, "max_attempts": 3},
+	}, nil)
+	proc, err := NewCheckOrderProcessor(&stubCheckProvider{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prov := newStubOrderProvider(context.Background(), 0, 0)
+	// исчерпавший попытки заказ некуда деть - такой конфиг не принимается
+	_, err = NewCheckService(cfg, l, prov, proc, &stubPublisher{})
+	if err == nil {
+		t.Fatal("bounded retry policy without dead letter publisher must be rejected")
+	}
+	_, err = NewCheckServiceWithDeadLetter(cfg, l, prov, proc, &stubPublisher{}, &discardDeadLetters{})
+	if err != nil {
+		t.Fatalf("bounded retry policy with dead letter publisher must be accepted: %v", err)
+	}
+}
+
+// публикатор "мертвых" сообщений, выбрасывающий их
+type discardDeadLetters struct{}
+
+func (discardDeadLetters) PublishDeadLetter(d DeadLetter) error {
+	return nil
+}
@@ -28,7 +28,7 @@ func (c *statisticCache) set(stat Statistic) {
 	}
 	c.Lock()
 	defer c.Unlock()
-	c.cache[stat.Name()] = cachedStatistic{
+	c.cache[statisticKey(stat)] = cachedStatistic{
 		s:        stat,
 		deadLine: time.Now().Add(c.timeout),
 	}
@@ -0,0 +1,238 @@
+package statistic
+
+import (
+	"fmt"
+	"github.com/iddqdeika/rrr/helpful"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// метки статистик в конфиге сервиса статистики:
+	// "labels": {"service": "checker", "instance_id": "checker-1"}
+	// метка host добавляется всегда (имя хоста), instance_id по умолчанию - host-pid.
+	labelsConfigName = "labels"
+
+	LabelService    = "service"
+	LabelHost       = "host"
+	LabelInstanceID = "instance_id"
+	LabelComponent  = "component"
+
+	providerErrorStatisticName = "Statistic provider error"
+)
+
+// статистика с метками.
+// необязательная форма Statistic: метки позволяют отличать одинаковые статистики разных сервисов и экземпляров.
+type LabeledStatistic interface {
+	Statistic
+	Labels() map[string]string
+}
+
+// метки статистики (пустые, если статистика их не предоставляет)
+func StatisticLabels(s Statistic) map[string]string {
+	if ls, ok := s.(LabeledStatistic); ok {
+		return ls.Labels()
+	}
+	return nil
+}
+
+// NewCompositeProvider объединяет несколько провайдеров статистик в один.
+// ошибка отдельного провайдера не ломает остальные: вместо его статистик отдается статистика с текстом ошибки.
+// метки композита добавляются ко всем статистикам (метки самих статистик имеют приоритет).
+// конкурентно-безопасен.
+func NewCompositeProvider(providers ...StatisticProvider) *CompositeProvider {
+	c := &CompositeProvider{}
+	c.Add(providers...)
+	return c
+}
+
+type CompositeProvider struct {
+	m         sync.RWMutex
+	labels    map[string]string
+	providers []namedProvider
+}
+
+type namedProvider struct {
+	component string
+	p         StatisticProvider
+}
+
+// добавляет провайдеры. nil игнорируется.
+func (c *CompositeProvider) Add(providers ...StatisticProvider) *CompositeProvider {
+	for _, p := range providers {
+		c.AddNamed("", p)
+	}
+	return c
+}
+
+// добавляет провайдер компоненты: ее статистики получают метку component.
+func (c *CompositeProvider) AddNamed(component string, p StatisticProvider) *CompositeProvider {
+	if p == nil {
+		return c
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.providers = append(c.providers, namedProvider{component: component, p: p})
+	return c
+}
+
+// задает метки, добавляемые ко всем статистикам.
+func (c *CompositeProvider) WithLabels(labels map[string]string) *CompositeProvider {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.labels = make(map[string]string, len(labels))
+	for k, v := range labels {
+		c.labels[k] = v
+	}
+	return c
+}
+
+// статистики всех провайдеров. ошибку не возвращает никогда.
+func (c *CompositeProvider) Statistics() ([]Statistic, error) {
+	c.m.RLock()
+	providers := append([]namedProvider(nil), c.providers...)
+	labels := c.labels
+	c.m.RUnlock()
+
+	res := make([]Statistic, 0)
+	for i, np := range providers {
+		l := labels
+		if np.component != "" {
+			l = mergeLabels(map[string]string{LabelComponent: np.component}, labels)
+		}
+		ss, err := np.p.Statistics()
+		if err != nil {
+			component := np.component
+			if component == "" {
+				component = strconv.Itoa(i)
+			}
+			res = append(res, withLabels(providerError(component, err), l))
+			continue
+		}
+		for _, s := range ss {
+			if s == nil {
+				continue
+			}
+			res = append(res, withLabels(s, l))
+		}
+	}
+	return res, nil
+}
+
+// статистика-ошибка провайдера
+func providerError(component string, err error) Statistic {
+	return labeledStatistic{
+		Statistic: statisticProxy{dto: StatisticDTO{
+			Name:        providerErrorStatisticName,
+			Value:       err.Error(),
+			Descriprion: `Ошибка получения статистик компоненты.`,
+		}},
+		labels: map[string]string{"provider": component},
+	}
+}
+
+// метки из конфига сервиса статистики (раздел labels) и имя хоста.
+func LabelsFromConfig(cfg helpful.Config) (map[string]string, error) {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "unknown"
+	}
+	labels := map[string]string{
+		LabelHost:       host,
+		LabelInstanceID: host + "-" + strconv.Itoa(os.Getpid()),
+	}
+	if cfg == nil || !cfg.Contains(labelsConfigName) {
+		return labels, nil
+	}
+	lc := cfg.Child(labelsConfigName)
+	for _, k := range []string{LabelService, LabelHost, LabelInstanceID} {
+		if !lc.Contains(k) {
+			continue
+		}
+		v, err := lc.GetString(k)
+		if err != nil {
+			return nil, fmt.Errorf("cant get label %v: %v", k, err)
+		}
+		labels[k] = v
+	}
+	return labels, nil
+}
+
+// добавляет метки к статистике, сохраняя ее типизированную форму
+func withLabels(s Statistic, labels map[string]string) Statistic {
+	if len(labels) == 0 {
+		return s
+	}
+	l := mergeLabels(StatisticLabels(s), labels)
+	if ls, ok := s.(labeledStatistic); ok {
+		s = ls.Statistic
+	}
+	switch ts := s.(type) {
+	case HistogramStatistic:
+		return labeledHistogram{HistogramStatistic: ts, labels: l}
+	case TypedStatistic:
+		return labeledTyped{TypedStatistic: ts, labels: l}
+	}
+	return labeledStatistic{Statistic: s, labels: l}
+}
+
+// объединяет метки, primary имеет приоритет
+func mergeLabels(primary, secondary map[string]string) map[string]string {
+	res := make(map[string]string, len(primary)+len(secondary))
+	for k, v := range secondary {
+		res[k] = v
+	}
+	for k, v := range primary {
+		res[k] = v
+	}
+	return res
+}
+
+// ключ статистики с учетом меток
+func statisticKey(s Statistic) string {
+	labels := StatisticLabels(s)
+	if len(labels) == 0 {
+		return s.Name()
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(s.Name())
+	for _, k := range keys {
+		b.WriteString("|" + k + "=" + labels[k])
+	}
+	return b.String()
+}
+
+type labeledStatistic struct {
+	Statistic
+	labels map[string]string
+}
+
+func (s labeledStatistic) Labels() map[string]string {
+	return s.labels
+}
+
+type labeledTyped struct {
+	TypedStatistic
+	labels map[string]string
+}
+
+func (s labeledTyped) Labels() map[string]string {
+	return s.labels
+}
+
+type labeledHistogram struct {
+	HistogramStatistic
+	labels map[string]string
+}
+
+func (s labeledHistogram) Labels() map[string]string {
+	return s.labels
+}
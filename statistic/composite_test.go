@@ -0,0 +1,94 @@
+package statistic
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+type failingProvider struct{}
+
+func (failingProvider) Statistics() ([]Statistic, error) {
+	return nil, fmt.Errorf("kafka unavailable")
+}
+
+type staticProvider []Statistic
+
+func (p staticProvider) Statistics() ([]Statistic, error) {
+	return p, nil
+}
+
+func TestCompositeProvider(t *testing.T) {
+	c := NewCounter("Orders received", "received")
+	c.Add(2)
+	h := NewHistogram("Ack latency seconds", "ack", 0.1)
+	h.Observe(0.05)
+
+	cp := NewCompositeProvider(staticProvider{c}, nil).
+		AddNamed("provider", failingProvider{}).
+		AddNamed("commits", staticProvider{h}).
+		WithLabels(map[string]string{LabelService: "checker", LabelHost: "host-1"})
+
+	ss, err := cp.Statistics()
+	if err != nil {
+		t.Fatalf("composite must tolerate provider errors, got %v", err)
+	}
+	if len(ss) != 3 {
+		t.Fatalf("expected 3 statistics, got %v", len(ss))
+	}
+
+	if _, ok := ss[0].(TypedStatistic); !ok {
+		t.Errorf("counter must keep its typed form")
+	}
+	if l := StatisticLabels(ss[0]); l[LabelService] != "checker" || l[LabelHost] != "host-1" {
+		t.Errorf("unexpected counter labels %v", l)
+	}
+
+	if ss[1].Name() != providerErrorStatisticName || ss[1].Value() != "kafka unavailable" {
+		t.Errorf("unexpected error statistic %v: %v", ss[1].Name(), ss[1].Value())
+	}
+	if l := StatisticLabels(ss[1]); l["provider"] != "provider" || l[LabelComponent] != "provider" {
+		t.Errorf("unexpected error statistic labels %v", l)
+	}
+
+	if _, ok := ss[2].(HistogramStatistic); !ok {
+		t.Errorf("histogram must keep its form")
+	}
+	if l := StatisticLabels(ss[2]); l[LabelComponent] != "commits" || l[LabelService] != "checker" {
+		t.Errorf("unexpected histogram labels %v", l)
+	}
+
+	buf := &bytes.Buffer{}
+	err = WritePrometheus(buf, ss)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, expected := range []string{
+		"orders_received_total{host=\"host-1\",service=\"checker\"} 2\n",
+		"ack_latency_seconds_bucket{component=\"commits\",host=\"host-1\",service=\"checker\",le=\"0.1\"} 1\n",
+		"ack_latency_seconds_count{component=\"commits\",host=\"host-1\",service=\"checker\"} 1\n",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected %q in output:\n%v", expected, out)
+		}
+	}
+}
+
+func TestWritePrometheusLabels(t *testing.T) {
+	a := withLabels(NewGaugeValue("Consumer lag", "lag", 1), map[string]string{"instance_id": "a"})
+	b := withLabels(NewGaugeValue("Consumer lag", "lag", 2), map[string]string{"instance_id": "b\"\n"})
+
+	buf := &bytes.Buffer{}
+	err := WritePrometheus(buf, []Statistic{a, b, a})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "# HELP consumer_lag lag\n# TYPE consumer_lag gauge\n" +
+		"consumer_lag{instance_id=\"a\"} 1\n" +
+		"consumer_lag{instance_id=\"b\\\"\\n\"} 2\n"
+	if buf.String() != expected {
+		t.Errorf("unexpected output:\n%v", buf.String())
+	}
+}
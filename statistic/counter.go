@@ -0,0 +1,134 @@
+package statistic
+
+import (
+	"strconv"
+	"sync/atomic"
+)
+
+// NewCounter создает счетчик.
+// счетчик - статистика с целочисленным значением, которое только растет (например, кол-во обработанных заказов).
+// конкурентно-безопасен.
+func NewCounter(name, description string) *Counter {
+	return &Counter{
+		name: name,
+		desc: description,
+	}
+}
+
+type Counter struct {
+	v    int64
+	name string
+	desc string
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+func (c *Counter) Add(delta int64) {
+	atomic.AddInt64(&c.v, delta)
+}
+
+func (c *Counter) Get() int64 {
+	return atomic.LoadInt64(&c.v)
+}
+
+func (c *Counter) Name() string {
+	return c.name
+}
+
+func (c *Counter) Value() string {
+	return strconv.FormatInt(c.Get(), 10)
+}
+
+func (c *Counter) Description() string {
+	return c.desc
+}
+
+func (c *Counter) MetricType() MetricType {
+	return MetricCounter
+}
+
+func (c *Counter) NumericValue() float64 {
+	return float64(c.Get())
+}
+
+// NewGauge создает измеритель.
+// в отличие от счетчика значение может как расти, так и уменьшаться (например, кол-во заказов в работе).
+// конкурентно-безопасен.
+func NewGauge(name, description string) *Gauge {
+	return &Gauge{
+		name: name,
+		desc: description,
+	}
+}
+
+type Gauge struct {
+	v    int64
+	name string
+	desc string
+}
+
+func (g *Gauge) Set(v int64) {
+	atomic.StoreInt64(&g.v, v)
+}
+
+func (g *Gauge) Add(delta int64) {
+	atomic.AddInt64(&g.v, delta)
+}
+
+func (g *Gauge) Get() int64 {
+	return atomic.LoadInt64(&g.v)
+}
+
+func (g *Gauge) Name() string {
+	return g.name
+}
+
+func (g *Gauge) Value() string {
+	return strconv.FormatInt(g.Get(), 10)
+}
+
+func (g *Gauge) Description() string {
+	return g.desc
+}
+
+func (g *Gauge) MetricType() MetricType {
+	return MetricGauge
+}
+
+func (g *Gauge) NumericValue() float64 {
+	return float64(g.Get())
+}
+
+// NewGaugeValue создает статистику-снимок с заданным значением измерителя.
+// используется для значений, вычисляемых в момент запроса статистик (например, лаг очереди).
+func NewGaugeValue(name, description string, v float64) TypedStatistic {
+	return gaugeValue{name: name, desc: description, v: v}
+}
+
+type gaugeValue struct {
+	name string
+	desc string
+	v    float64
+}
+
+func (g gaugeValue) Name() string {
+	return g.name
+}
+
+func (g gaugeValue) Value() string {
+	return strconv.FormatFloat(g.v, 'f', -1, 64)
+}
+
+func (g gaugeValue) Description() string {
+	return g.desc
+}
+
+func (g gaugeValue) MetricType() MetricType {
+	return MetricGauge
+}
+
+func (g gaugeValue) NumericValue() float64 {
+	return g.v
+}
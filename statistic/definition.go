@@ -14,3 +14,30 @@ type Statistic interface {
 	Value() string
 	Description() string
 }
+
+// тип метрики для статистик с типизированным значением
+type MetricType string
+
+const (
+	MetricCounter   MetricType = "counter"
+	MetricGauge     MetricType = "gauge"
+	MetricHistogram MetricType = "histogram"
+)
+
+// статистика с типизированным значением.
+// необязательная форма Statistic: если статистика ее реализует, то она экспортируется (например, в prometheus)
+// без разбора строкового значения.
+type TypedStatistic interface {
+	Statistic
+	MetricType() MetricType
+	NumericValue() float64
+}
+
+// статистика-гистограмма.
+// Buckets возвращает верхние границы корзин (по возрастанию) и кумулятивное кол-во наблюдений в каждой.
+type HistogramStatistic interface {
+	TypedStatistic
+	Buckets() (bounds []float64, counts []uint64)
+	Sum() float64
+	Count() uint64
+}
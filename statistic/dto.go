@@ -13,13 +13,15 @@ func convert(s Statistic) (StatisticDTO, error) {
 		Name:        s.Name(),
 		Value:       s.Value(),
 		Descriprion: s.Description(),
+		Labels:      StatisticLabels(s),
 	}, nil
 }
 
 type StatisticDTO struct {
-	Name        string `json:"name"`
-	Value       string `json:"value"`
-	Descriprion string `json:"descriprion"`
+	Name        string            `json:"name"`
+	Value       string            `json:"value"`
+	Descriprion string            `json:"descriprion"`
+	Labels      map[string]string `json:"labels,omitempty"`
 	//Error       string `json:"error"`
 }
 
@@ -48,6 +50,10 @@ func (s statisticProxy) Description() string {
 	return s.dto.Descriprion
 }
 
+func (s statisticProxy) Labels() map[string]string {
+	return s.dto.Labels
+}
+
 func unmarshal(data []byte) (StatisticDTO, error) {
 	res := StatisticDTO{}
 	err := json.Unmarshal(data, &res)
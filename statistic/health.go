@@ -0,0 +1,128 @@
+package statistic
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	healthMethod    = "healthz"
+	readinessMethod = "readyz"
+
+	healthCheckTimeout = time.Second * 5
+)
+
+// вид проверки здоровья.
+// Liveness - процесс жив и работает (иначе его надо перезапустить), используется /healthz,
+// Readiness - процесс может обрабатывать данные (доступны внешние ресурсы), используется /readyz.
+// readyz включает и liveness проверки.
+type HealthKind int
+
+const (
+	Liveness HealthKind = iota
+	Readiness
+)
+
+// проверка здоровья компоненты.
+// Check должна завершаться при закрытии контекста и возвращать ошибку, если компонента нездорова.
+type HealthCheck struct {
+	Name  string
+	Kind  HealthKind
+	Check func(ctx context.Context) error
+}
+
+// компонента, предоставляющая проверки здоровья.
+// стандартные сервисы собирают проверки своих компонент (провайдеров, процессоров, сохранятелей)
+// через приведение к этому интерфейсу, так что пользовательские реализации тоже могут их добавлять.
+type HealthCheckProvider interface {
+	HealthChecks() []HealthCheck
+}
+
+// объединяет несколько провайдеров проверок здоровья в один.
+type HealthCheckProviders []HealthCheckProvider
+
+func (ps HealthCheckProviders) HealthChecks() []HealthCheck {
+	var res []HealthCheck
+	for _, p := range ps {
+		if p == nil {
+			continue
+		}
+		res = append(res, p.HealthChecks()...)
+	}
+	return res
+}
+
+// результат проверок здоровья
+type HealthReport struct {
+	Healthy bool                    `json:"healthy"`
+	Checks  map[string]HealthStatus `json:"checks"`
+}
+
+type HealthStatus struct {
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+}
+
+// выполняет проверки данного вида (конкурентно, с общим таймаутом).
+// для Readiness выполняются и Liveness проверки.
+func CheckHealth(ctx context.Context, p HealthCheckProvider, kind HealthKind) HealthReport {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	report := HealthReport{Healthy: true, Checks: make(map[string]HealthStatus)}
+	var m sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range p.HealthChecks() {
+		if c.Check == nil || c.Kind > kind {
+			continue
+		}
+		wg.Add(1)
+		go func(c HealthCheck) {
+			defer wg.Done()
+			err := c.Check(ctx)
+			m.Lock()
+			defer m.Unlock()
+			st := HealthStatus{Healthy: err == nil}
+			if err != nil {
+				st.Error = err.Error()
+				report.Healthy = false
+			}
+			report.Checks[c.Name] = st
+		}(c)
+	}
+	wg.Wait()
+	return report
+}
+
+// дополнительный http метод сервиса статистики
+type Endpoint struct {
+	Path    string
+	Handler http.HandlerFunc
+}
+
+// методы /healthz и /readyz для данных проверок.
+// отвечают 200, если все проверки пройдены, и 503 - если нет; в теле - отчет по каждой проверке.
+func HealthEndpoints(p HealthCheckProvider) []Endpoint {
+	return []Endpoint{
+		{Path: "/" + healthMethod, Handler: healthHandler(p, Liveness)},
+		{Path: "/" + readinessMethod, Handler: healthHandler(p, Readiness)},
+	}
+}
+
+func healthHandler(p HealthCheckProvider, kind HealthKind) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		report := CheckHealth(req.Context(), p, kind)
+		data, err := json.Marshal(report)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !report.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		w.Write(data)
+	}
+}
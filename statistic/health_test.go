@@ -0,0 +1,41 @@
+package statistic
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type healthChecks []HealthCheck
+
+func (h healthChecks) HealthChecks() []HealthCheck {
+	return h
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	ok := func(ctx context.Context) error { return nil }
+	failed := func(ctx context.Context) error { return fmt.Errorf("unavailable") }
+	hp := healthChecks{
+		{Name: "progress", Kind: Liveness, Check: ok},
+		{Name: "kafka", Kind: Readiness, Check: failed},
+	}
+	codes := make(map[string]int)
+	for _, e := range HealthEndpoints(hp) {
+		w := httptest.NewRecorder()
+		e.Handler(w, httptest.NewRequest(http.MethodGet, e.Path, nil))
+		codes[e.Path] = w.Code
+	}
+	if codes["/healthz"] != http.StatusOK {
+		t.Fatalf("readiness checks must not affect /healthz, got %v", codes["/healthz"])
+	}
+	if codes["/readyz"] != http.StatusServiceUnavailable {
+		t.Fatalf("failed readiness check must fail /readyz, got %v", codes["/readyz"])
+	}
+
+	report := CheckHealth(context.Background(), hp, Readiness)
+	if report.Healthy || !report.Checks["progress"].Healthy || report.Checks["kafka"].Error != "unavailable" {
+		t.Fatalf("incorrect health report: %+v", report)
+	}
+}
@@ -0,0 +1,111 @@
+package statistic
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// границы корзин по умолчанию для длительностей (в секундах)
+var DefaultDurationBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// NewHistogram создает гистограмму с данными верхними границами корзин.
+// если границы не заданы - используются DefaultDurationBuckets.
+// строковое значение гистограммы - среднее наблюдение.
+// конкурентно-безопасна.
+func NewHistogram(name, description string, buckets ...float64) *Histogram {
+	if len(buckets) == 0 {
+		buckets = DefaultDurationBuckets
+	}
+	bounds := append([]float64(nil), buckets...)
+	sort.Float64s(bounds)
+	return &Histogram{
+		name:   name,
+		desc:   description,
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)),
+	}
+}
+
+type Histogram struct {
+	name string
+	desc string
+
+	m      sync.Mutex
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	i := sort.SearchFloat64s(h.bounds, v)
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+}
+
+// наблюдение длительности в секундах
+func (h *Histogram) ObserveDuration(d time.Duration) {
+	h.Observe(d.Seconds())
+}
+
+// наблюдение времени, прошедшего с started
+func (h *Histogram) ObserveSince(started time.Time) {
+	h.ObserveDuration(time.Since(started))
+}
+
+func (h *Histogram) Name() string {
+	return h.name
+}
+
+func (h *Histogram) Value() string {
+	return strconv.FormatFloat(h.NumericValue(), 'f', -1, 64)
+}
+
+func (h *Histogram) Description() string {
+	return h.desc
+}
+
+func (h *Histogram) MetricType() MetricType {
+	return MetricHistogram
+}
+
+// среднее наблюдение
+func (h *Histogram) NumericValue() float64 {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if h.count == 0 {
+		return 0
+	}
+	return h.sum / float64(h.count)
+}
+
+func (h *Histogram) Buckets() ([]float64, []uint64) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	counts := make([]uint64, len(h.counts))
+	var c uint64
+	for i, n := range h.counts {
+		c += n
+		counts[i] = c
+	}
+	return append([]float64(nil), h.bounds...), counts
+}
+
+func (h *Histogram) Sum() float64 {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return h.sum
+}
+
+func (h *Histogram) Count() uint64 {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return h.count
+}
@@ -0,0 +1,187 @@
+package statistic
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	metricsMethod = "metrics"
+
+	prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// пишет статистики в текстовом формате prometheus.
+// типизированные статистики (TypedStatistic, HistogramStatistic) экспортируются со своим типом,
+// остальные - как untyped, если их значение - число. нечисловые статистики пропускаются.
+// имя метрики получается из названия статистики: латиница в нижнем регистре, цифры и подчеркивания.
+// метки статистик (LabeledStatistic) становятся метками метрики, статистики с одним именем группируются.
+func WritePrometheus(w io.Writer, ss []Statistic) error {
+	type family struct {
+		name       string
+		help       string
+		metricType string
+		samples    []Statistic
+	}
+	var families []*family
+	byName := make(map[string]*family)
+	written := make(map[string]struct{})
+	for _, s := range ss {
+		if s == nil {
+			continue
+		}
+		name := MetricName(s.Name())
+		if name == "" {
+			continue
+		}
+		metricType := "untyped"
+		if ts, ok := s.(TypedStatistic); ok {
+			metricType = string(ts.MetricType())
+			if ts.MetricType() == MetricCounter && !strings.HasSuffix(name, "_total") {
+				name += "_total"
+			}
+			if _, ok := s.(HistogramStatistic); ts.MetricType() == MetricHistogram && !ok {
+				continue
+			}
+		} else if _, err := parseValue(s); err != nil {
+			continue
+		}
+		// prometheus не допускает повторов метрики с одинаковыми метками
+		key := name + formatLabels(StatisticLabels(s))
+		if _, ok := written[key]; ok {
+			continue
+		}
+		written[key] = struct{}{}
+		f, ok := byName[name]
+		if !ok {
+			f = &family{name: name, help: s.Description(), metricType: metricType}
+			byName[name] = f
+			families = append(families, f)
+		}
+		if f.metricType != metricType {
+			continue
+		}
+		f.samples = append(f.samples, s)
+	}
+
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		_, err := fmt.Fprintf(bw, "# HELP %v %v\n# TYPE %v %v\n", f.name, escapeHelp(f.help), f.name, f.metricType)
+		if err != nil {
+			return err
+		}
+		for _, s := range f.samples {
+			labels := StatisticLabels(s)
+			switch ts := s.(type) {
+			case HistogramStatistic:
+				err = writeHistogram(bw, f.name, labels, ts)
+			case TypedStatistic:
+				err = writeSample(bw, f.name, labels, ts.NumericValue())
+			default:
+				v, _ := parseValue(s)
+				err = writeSample(bw, f.name, labels, v)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+func parseValue(s Statistic) (float64, error) {
+	return strconv.ParseFloat(strings.TrimSpace(s.Value()), 64)
+}
+
+func writeSample(w io.Writer, name string, labels map[string]string, v float64) error {
+	_, err := fmt.Fprintf(w, "%v%v %v\n", name, formatLabels(labels), formatFloat(v))
+	return err
+}
+
+func writeHistogram(w io.Writer, name string, labels map[string]string, h HistogramStatistic) error {
+	bounds, counts := h.Buckets()
+	for i, b := range bounds {
+		_, err := fmt.Fprintf(w, "%v_bucket%v %v\n", name, formatLabels(labels, "le", formatFloat(b)), counts[i])
+		if err != nil {
+			return err
+		}
+	}
+	l := formatLabels(labels)
+	_, err := fmt.Fprintf(w, "%v_bucket%v %v\n%v_sum%v %v\n%v_count%v %v\n",
+		name, formatLabels(labels, "le", "+Inf"), h.Count(), name, l, formatFloat(h.Sum()), name, l, h.Count())
+	return err
+}
+
+// метки в формате prometheus: {a="1",b="2"}, по алфавиту.
+// extra - дополнительные пары ключ-значение, которые пишутся последними (например, le для гистограмм).
+func formatLabels(labels map[string]string, extra ...string) string {
+	if len(labels) == 0 && len(extra) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys)+len(extra)/2)
+	for _, k := range keys {
+		if n := MetricName(k); n != "" {
+			pairs = append(pairs, n+"=\""+escapeLabel(labels[k])+"\"")
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"=\""+escapeLabel(extra[i+1])+"\"")
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabel(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return strings.ReplaceAll(s, "\n", `\n`)
+}
+
+// имя метрики prometheus для названия статистики.
+// например, "Orders received" -> "orders_received".
+func MetricName(statisticName string) string {
+	var b strings.Builder
+	underscore := false
+	for _, r := range strings.ToLower(statisticName) {
+		ok := (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9')
+		if !ok {
+			underscore = b.Len() > 0
+			continue
+		}
+		if underscore {
+			b.WriteByte('_')
+			underscore = false
+		}
+		if b.Len() == 0 && r >= '0' && r <= '9' {
+			b.WriteByte('_')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func escapeHelp(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return strings.ReplaceAll(s, "\n", `\n`)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,53 @@
+package statistic
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+type stringStatistic struct {
+	name, value string
+}
+
+func (s stringStatistic) Name() string        { return s.name }
+func (s stringStatistic) Value() string       { return s.value }
+func (s stringStatistic) Description() string { return "" }
+
+func TestWritePrometheus(t *testing.T) {
+	c := NewCounter("Orders received", "received")
+	c.Add(3)
+	g := NewGauge(`Consumer lag for check "images" (object type: product)`, "lag")
+	g.Set(7)
+	h := NewHistogram("Ack latency seconds", "ack", 0.01, 0.1)
+	h.ObserveDuration(time.Millisecond * 5)
+	h.ObserveDuration(time.Millisecond * 50)
+	h.ObserveDuration(time.Second)
+
+	buf := &bytes.Buffer{}
+	err := WritePrometheus(buf, []Statistic{c, g, h,
+		stringStatistic{"Legacy value", "42"},
+		stringStatistic{"Not a number", "n/a"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, expected := range []string{
+		"# TYPE orders_received_total counter\norders_received_total 3\n",
+		"# TYPE consumer_lag_for_check_images_object_type_product gauge\nconsumer_lag_for_check_images_object_type_product 7\n",
+		"ack_latency_seconds_bucket{le=\"0.01\"} 1\n",
+		"ack_latency_seconds_bucket{le=\"0.1\"} 2\n",
+		"ack_latency_seconds_bucket{le=\"+Inf\"} 3\n",
+		"ack_latency_seconds_count 3\n",
+		"# TYPE legacy_value untyped\nlegacy_value 42\n",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Fatalf("metrics must contain %q, got:\n%v", expected, out)
+		}
+	}
+	if strings.Contains(out, "not_a_number") {
+		t.Fatalf("non-numeric statistic must be skipped")
+	}
+}
@@ -11,14 +11,17 @@ import (
 )
 
 const (
+	// наименьший допустимый порт сервиса статистики
+	MinPort = 8000
+
 	portConfigName   = "port"
-	minPort          = 8000
 	echoMethod       = "echo"
 	statisticsMethod = "statistics"
 )
 
 // конструктор сервиса статистики
-func NewStatisticService(config helpful.Config, sp StatisticProvider, l helpful.Logger) (rrr.Service, error) {
+// endpoints - дополнительные http методы (например, HealthEndpoints).
+func NewStatisticService(config helpful.Config, sp StatisticProvider, l helpful.Logger, endpoints ...Endpoint) (rrr.Service, error) {
 	if config == nil {
 		return nil, fmt.Errorf("must be not-nil Config")
 	}
@@ -34,31 +37,45 @@ func NewStatisticService(config helpful.Config, sp StatisticProvider, l helpful.
 		return nil, err
 	}
 
-	if port < minPort {
-		return nil, fmt.Errorf("port must be above %v", minPort)
+	if port < MinPort {
+		return nil, fmt.Errorf("port must be above %v", MinPort)
+	}
+
+	for _, e := range endpoints {
+		if e.Path == "" || e.Handler == nil {
+			return nil, fmt.Errorf("must be not-empty endpoint path and handler")
+		}
 	}
 
 	s := &statisticService{
-		port: port,
-		p:    sp,
-		l:    l,
+		port:      port,
+		p:         sp,
+		l:         l,
+		endpoints: endpoints,
 	}
 	return s, nil
 }
 
-// предоставляет http метод для получения статистик и эхо метод
+// предоставляет http методы для получения статистик (json и prometheus) и эхо метод
 type statisticService struct {
-	port int
-	p    StatisticProvider
-	l    helpful.Logger
+	port      int
+	p         StatisticProvider
+	l         helpful.Logger
+	endpoints []Endpoint
 }
 
 func (s *statisticService) Run(ctx context.Context) error {
 	sm := http.NewServeMux()
 	sm.HandleFunc("/"+statisticsMethod, s.statisticHandler)
 	s.l.Infof("%v registered in statisticservice", statisticsMethod)
+	sm.HandleFunc("/"+metricsMethod, s.metricsHandler)
+	s.l.Infof("%v registered in statisticservice", metricsMethod)
 	sm.HandleFunc("/"+echoMethod, echo)
 	s.l.Infof("%v registered in statisticservice", echoMethod)
+	for _, e := range s.endpoints {
+		sm.HandleFunc(e.Path, e.Handler)
+		s.l.Infof("%v registered in statisticservice", e.Path)
+	}
 	ctx, cancel := context.WithCancel(ctx)
 
 	var err error
@@ -84,6 +101,7 @@ func (s *statisticService) statisticHandler(w http.ResponseWriter, req *http.Req
 			Name:        s.Name(),
 			Value:       s.Value(),
 			Description: s.Description(),
+			Labels:      StatisticLabels(s),
 		})
 	}
 	data, err := json.Marshal(res)
@@ -101,6 +119,21 @@ func (s *statisticService) statisticHandler(w http.ResponseWriter, req *http.Req
 	}
 }
 
+// метрики в текстовом формате prometheus
+func (s *statisticService) metricsHandler(w http.ResponseWriter, req *http.Request) {
+	ss, err := s.p.Statistics()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf("Server side error: %v", err)))
+		return
+	}
+	w.Header().Set("Content-Type", prometheusContentType)
+	err = WritePrometheus(w, ss)
+	if err != nil {
+		s.l.Errorf("err during metrics writing in statistic service: %v", err)
+	}
+}
+
 func echo(w http.ResponseWriter, req *http.Request) {
 	w.Write([]byte(req.URL.RawQuery))
 }
@@ -110,7 +143,8 @@ type statisticsDTO struct {
 }
 
 type statisticDTO struct {
-	Name        string `json:"name"`
-	Value       string `json:"value"`
-	Description string `json:"description"`
+	Name        string            `json:"name"`
+	Value       string            `json:"value"`
+	Description string            `json:"description"`
+	Labels      map[string]string `json:"labels,omitempty"`
 }
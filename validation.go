@@ -0,0 +1,354 @@
+package reactivetools
+
+import (
+	"context"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"github.com/iddqdeika/reactivetools/statistic"
+	"github.com/iddqdeika/rrr/helpful"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// флаг командной строки режима проверки конфигурации: -dry-run
+	DryRunFlag = "dry-run"
+	// переменная окружения режима проверки конфигурации (true/1)
+	DryRunEnv = "DRY_RUN"
+)
+
+// проблема конфигурации: путь ключа и описание
+type ConfigProblem struct {
+	Path    string
+	Message string
+}
+
+func (p ConfigProblem) Error() string {
+	return p.Path + ": " + p.Message
+}
+
+// ошибка проверки конфига со всеми найденными проблемами
+type ConfigValidationError struct {
+	Problems []ConfigProblem
+}
+
+func (e *ConfigValidationError) Error() string {
+	ps := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		ps[i] = p.Error()
+	}
+	return "invalid config: " + strings.Join(ps, "; ")
+}
+
+// проблемы как отдельные ошибки (для Register рута)
+func (e *ConfigValidationError) Errors() []error {
+	errs := make([]error, len(e.Problems))
+	for i, p := range e.Problems {
+		errs[i] = p
+	}
+	return errs
+}
+
+// проверяет конфиг NewKafkaCheckService целиком, не обращаясь к кафка:
+// parallelism, провайдер, паблишер, статистики, отправщик статистик, публикатор "мертвых" заказов,
+// политики повторов, таймаутов, пакетов и ограничения частоты, схлопывание заказов, кэш результатов, outbox, адаптивный параллелизм,
+// предохранитель, логгер.
+// возвращает *ConfigValidationError со всеми найденными проблемами или nil.
+func ValidateKafkaCheckServiceConfig(cfg helpful.Config) error {
+	if cfg == nil {
+		return fmt.Errorf("must be not-nil Config")
+	}
+	v := &configValidator{}
+	v.integer(cfg, "", "parallelism", true, 1)
+	v.integer(cfg, "", DrainTimeoutConfigKey, false, 0)
+	v.integer(cfg, "", NoProgressTimeoutConfigKey, false, 0)
+	if lc, ok := v.section(cfg, "", LogConfigKey, false); ok {
+		v.oneOf(lc, LogConfigKey, logLevelConfigName, false, logLevelNames()...)
+		v.oneOf(lc, LogConfigKey, logFormatConfigName, false, LogFormatText, LogFormatJSON)
+		if cc, ok := v.section(lc, LogConfigKey, logComponentsConfigName, false); ok {
+			for _, c := range logComponents {
+				v.oneOf(cc, configKey(LogConfigKey, logComponentsConfigName), c, false, logLevelNames()...)
+			}
+		}
+	}
+
+	prov, ok := v.section(cfg, "", CheckOrderProviderConfigKey, true)
+	checkName := ""
+	if ok {
+		v.str(prov, CheckOrderProviderConfigKey, ConfigOrderTopicNameKey, true)
+		v.str(prov, CheckOrderProviderConfigKey, ConfigObjectTypeKey, true)
+		checkName = v.str(prov, CheckOrderProviderConfigKey, ConfigCheckNameKey, true)
+		v.oneOf(prov, CheckOrderProviderConfigKey, ConfigCodecKey, false, CodecJSON, CodecEnvelope)
+		policy := v.oneOf(prov, CheckOrderProviderConfigKey, ConfigMalformedPolicyKey, false,
+			MalformedPolicyAck, MalformedPolicyDeadLetter, MalformedPolicyStop)
+		v.str(prov, CheckOrderProviderConfigKey, ConfigDeadLetterTopicNameKey, policy == MalformedPolicyDeadLetter)
+		v.kafka(prov, CheckOrderProviderConfigKey, true)
+	}
+
+	pub, ok := v.section(cfg, "", CheckResultPublisherConfigKey, true)
+	if ok {
+		v.str(pub, CheckResultPublisherConfigKey, ConfigResultsTopicNameKey, true)
+		v.oneOf(pub, CheckResultPublisherConfigKey, ConfigCodecKey, false, CodecJSON, CodecEnvelope)
+		v.kafka(pub, CheckResultPublisherConfigKey, false)
+	}
+
+	stats, ok := v.section(cfg, "", StatisticServiceConfigKey, true)
+	if ok {
+		v.integer(stats, StatisticServiceConfigKey, "port", true, statistic.MinPort, 65535)
+		labels, ok := v.section(stats, StatisticServiceConfigKey, "labels", false)
+		if ok {
+			for _, k := range []string{"service", "host", "instance_id"} {
+				v.str(labels, configKey(StatisticServiceConfigKey, "labels"), k, false)
+			}
+		}
+	}
+
+	sender, ok := v.section(cfg, "", "statistic_sender", false)
+	if ok {
+		v.str(sender, "statistic_sender", "topic", true)
+		v.integer(sender, "statistic_sender", "interval_in_secs", true, 1)
+		v.kafka(sender, "statistic_sender", false)
+	}
+
+	dl, ok := v.section(cfg, "", DeadLetterPublisherConfigKey, false)
+	if ok {
+		v.str(dl, DeadLetterPublisherConfigKey, ConfigDeadLetterTopicNameKey, true)
+		v.kafka(dl, DeadLetterPublisherConfigKey, false)
+	}
+
+	if cfg.Contains(RetryPolicyConfigKey) {
+		retry, err := NewRetryPolicy(cfg.Child(RetryPolicyConfigKey))
+		v.wrap(RetryPolicyConfigKey, err)
+		if err == nil && retry.bounded() && !cfg.Contains(DeadLetterPublisherConfigKey) {
+			v.add("", DeadLetterPublisherConfigKey, "is required when %v limits attempts", RetryPolicyConfigKey)
+		}
+	}
+	if dc, ok := v.section(cfg, "", DedupConfigKey, false); ok {
+		v.integer(dc, DedupConfigKey, "window_in_ms", true, 1)
+		v.integer(dc, DedupConfigKey, "max_superseded", false, 1)
+	}
+	if rc, ok := v.section(cfg, "", ResultCacheConfigKey, false); ok {
+		v.integer(rc, ResultCacheConfigKey, "ttl_in_secs", true, 1)
+		v.str(rc, ResultCacheConfigKey, "revision_header", false)
+		storage := v.oneOf(rc, ResultCacheConfigKey, "storage", false, ResultCacheStorageMemory, ResultCacheStorageBolt)
+		v.integer(rc, ResultCacheConfigKey, "max_entries", false, 1)
+		v.str(rc, ResultCacheConfigKey, "bolt_storage_path", storage == ResultCacheStorageBolt)
+	}
+	if oc, ok := v.section(cfg, "", OutboxConfigKey, false); ok {
+		v.str(oc, OutboxConfigKey, "bolt_storage_path", true)
+		if oc.Contains(RetryPolicyConfigKey) {
+			_, err := NewRetryPolicy(oc.Child(RetryPolicyConfigKey))
+			v.wrap(configKey(OutboxConfigKey, RetryPolicyConfigKey), err)
+		}
+	}
+	if cfg.Contains(RateLimitConfigKey) {
+		_, err := rateLimitsFromConfig(cfg, checkName)
+		v.wrap(RateLimitConfigKey, err)
+	}
+	if cfg.Contains(AdaptiveConcurrencyConfigKey) {
+		parallelism, err := cfg.GetInt("parallelism")
+		if err == nil {
+			_, err = NewAdaptiveConcurrencySettings(cfg.Child(AdaptiveConcurrencyConfigKey), parallelism)
+			v.wrap(AdaptiveConcurrencyConfigKey, err)
+		}
+	}
+	if cfg.Contains(CircuitBreakerConfigKey) {
+		_, err := NewCircuitBreakerSettings(cfg.Child(CircuitBreakerConfigKey))
+		v.wrap(CircuitBreakerConfigKey, err)
+	}
+	var timeouts CheckTimeoutPolicy
+	var timeoutsErr error
+	if cfg.Contains(CheckTimeoutConfigKey) {
+		timeouts, timeoutsErr = NewCheckTimeoutPolicy(cfg.Child(CheckTimeoutConfigKey), checkName)
+		v.wrap(CheckTimeoutConfigKey, timeoutsErr)
+	}
+	if cfg.Contains(BatchConfigKey) {
+		policy, err := NewBatchPolicy(cfg.Child(BatchConfigKey), checkName)
+		v.wrap(BatchConfigKey, err)
+		// некорректные параллелизм и таймауты сообщаются отдельно
+		parallelism, perr := cfg.GetInt("parallelism")
+		if err == nil && perr == nil && timeoutsErr == nil {
+			v.wrap(BatchConfigKey, policy.validateFor(checkName, parallelism, timeouts.timeout(checkName)))
+		}
+	}
+	return v.err()
+}
+
+// режим проверки конфигурации: флаг -dry-run (или -dry-run=true), либо переменная окружения DRY_RUN.
+// в этом режиме рут только проверяет конфиг и собирает компоненты, не требующие кафка, и завершается.
+func IsDryRun() bool {
+	if v, ok := boolFlagFromArgs(os.Args[1:], DryRunFlag); ok {
+		return v
+	}
+	v, err := strconv.ParseBool(os.Getenv(DryRunEnv))
+	return err == nil && v
+}
+
+func boolFlagFromArgs(args []string, name string) (bool, bool) {
+	for _, a := range args {
+		if a == "--" {
+			return false, false
+		}
+		n := strings.TrimLeft(a, "-")
+		if n == a || len(a)-len(n) > 2 {
+			continue
+		}
+		if n == name {
+			return true, true
+		}
+		if strings.HasPrefix(n, name+"=") {
+			v, err := strconv.ParseBool(strings.TrimPrefix(n, name+"="))
+			return err == nil && v, true
+		}
+	}
+	return false, false
+}
+
+// собирает все, что можно собрать без кафка: логику проверки, процессор с таймаутами,
+// кодеки, политики сервиса и метки статистик. ни подключений, ни топиков не создается.
+func dryRunKafkaCheckService(cfg helpful.Config, l helpful.Logger, p CheckProvider) error {
+	checkName, err := cfg.Child(CheckOrderProviderConfigKey).GetString(ConfigCheckNameKey)
+	if err != nil {
+		return err
+	}
+	var proc CheckOrderProcessor
+	if bp, ok := p.(BatchCheckProvider); ok {
+		proc, err = batchProcessorFromConfig(cfg, l, bp, checkName)
+	} else {
+		proc, err = NewCheckOrderProcessor(p)
+	}
+	if err != nil {
+		return err
+	}
+	proc, err = timeoutProcessorFromConfig(cfg, l, proc, checkName)
+	if err != nil {
+		return err
+	}
+	_, err = orderCodecFromConfig(cfg.Child(CheckOrderProviderConfigKey))
+	if err != nil {
+		return err
+	}
+	_, err = resultCodecFromConfig(cfg.Child(CheckResultPublisherConfigKey))
+	if err != nil {
+		return err
+	}
+	parallelism, err := cfg.GetInt("parallelism")
+	if err != nil {
+		return err
+	}
+	prov := NewStubOrderProvider(context.Background(), 0, 0)
+	err = newCheckService(l, prov, proc, NewStubResultPublisher(), parallelism, "").configure(cfg)
+	if err != nil {
+		return err
+	}
+	_, err = statistic.LabelsFromConfig(cfg.Child(StatisticServiceConfigKey))
+	return err
+}
+
+// собирает проблемы конфига
+type configValidator struct {
+	problems []ConfigProblem
+}
+
+func (v *configValidator) add(path, key, format string, args ...interface{}) {
+	if path != "" {
+		key = configKey(path, key)
+	}
+	v.problems = append(v.problems, ConfigProblem{Path: key, Message: fmt.Sprintf(format, args...)})
+}
+
+// ошибка компоненты, собранной из раздела конфига
+func (v *configValidator) wrap(path string, err error) {
+	if err != nil {
+		v.problems = append(v.problems, ConfigProblem{Path: path, Message: err.Error()})
+	}
+}
+
+func (v *configValidator) section(cfg helpful.Config, path, key string, required bool) (helpful.Config, bool) {
+	if !cfg.Contains(key) {
+		if required {
+			v.add(path, key, "section is required")
+		}
+		return nil, false
+	}
+	return cfg.Child(key), true
+}
+
+func (v *configValidator) str(cfg helpful.Config, path, key string, required bool) string {
+	if !cfg.Contains(key) {
+		if required {
+			v.add(path, key, "is required")
+		}
+		return ""
+	}
+	s, err := cfg.GetString(key)
+	if err != nil {
+		v.add(path, key, "must be a string: %v", err)
+		return ""
+	}
+	if required && strings.TrimSpace(s) == "" {
+		v.add(path, key, "must not be empty")
+	}
+	return s
+}
+
+func (v *configValidator) oneOf(cfg helpful.Config, path, key string, required bool, allowed ...string) string {
+	s := v.str(cfg, path, key, required)
+	if s == "" {
+		return s
+	}
+	for _, a := range allowed {
+		if s == a {
+			return s
+		}
+	}
+	v.add(path, key, "unknown value %q, must be one of: %v", s, strings.Join(allowed, ", "))
+	return ""
+}
+
+// целое в пределах [bounds[0], bounds[1]] (границы необязательны)
+func (v *configValidator) integer(cfg helpful.Config, path, key string, required bool, bounds ...int) {
+	if !cfg.Contains(key) {
+		if required {
+			v.add(path, key, "is required")
+		}
+		return
+	}
+	i, err := cfg.GetInt(key)
+	if err != nil {
+		v.add(path, key, "must be an integer: %v", err)
+		return
+	}
+	if len(bounds) > 0 && i < bounds[0] {
+		v.add(path, key, "must be at least %v, got %v", bounds[0], i)
+	}
+	if len(bounds) > 1 && i > bounds[1] {
+		v.add(path, key, "must be at most %v, got %v", bounds[1], i)
+	}
+}
+
+// раздел KAFKA компоненты. читателю (reader) нужна группа потребителей.
+func (v *configValidator) kafka(cfg helpful.Config, path string, reader bool) {
+	kc, ok := v.section(cfg, path, kafkaConfigKey, true)
+	if !ok {
+		return
+	}
+	kp := configKey(path, kafkaConfigKey)
+	v.str(kc, kp, kafkaBrokersKey, true)
+	v.str(kc, kp, kafkaConsumerGroupKey, reader)
+	v.integer(kc, kp, "CONCURRENCY", false, 1)
+	v.integer(kc, kp, "BATCH_SIZE", false, 1)
+	if version := v.str(kc, kp, kafkaVersionKey, false); version != "" {
+		if _, err := sarama.ParseKafkaVersion(version); err != nil {
+			v.add(kp, kafkaVersionKey, "incorrect kafka version: %v", err)
+		}
+	}
+}
+
+func (v *configValidator) err() error {
+	if len(v.problems) == 0 {
+		return nil
+	}
+	return &ConfigValidationError{Problems: v.problems}
+}
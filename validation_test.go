@@ -0,0 +1,100 @@
+package reactivetools
+
+import (
+	"github.com/iddqdeika/rrr/helpful"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateKafkaCheckServiceConfig(t *testing.T) {
+	cfg, err := LoadConfig("config_template.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ValidateKafkaCheckServiceConfig(cfg)
+	if err != nil {
+		t.Fatalf("config template must be valid: %v", err)
+	}
+	err = dryRunKafkaCheckService(cfg, helpful.DefaultLogger.WithLevel(helpful.LogNone), &stubCheckProvider{})
+	if err != nil {
+		t.Fatalf("dry run of config template failed: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "validation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	err = ioutil.WriteFile(path, []byte(`{
+  "parallelism": 0,
+  "log": {"level": "verbose"},
+  "check_order_provider": {
+    "pim_check_orders_topic": "orders",
+    "check_name": "",
+    "malformed_message_policy": "dead_letter",
+    "KAFKA": {"CONCURRENCY": "many"}
+  },
+  "statistics": {"port": 80},
+  "statistic_sender": {"topic": "stats", "interval_in_secs": 10},
+  "retry_policy": {"max_attempts": 3, "initial_interval_in_ms": 100}
+}`), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err = LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ValidateKafkaCheckServiceConfig(cfg)
+	ve, ok := err.(*ConfigValidationError)
+	if !ok {
+		t.Fatalf("expected validation error, got %v", err)
+	}
+	problems := make(map[string]bool)
+	for _, p := range ve.Problems {
+		problems[p.Path] = true
+	}
+	for _, expected := range []string{
+		"parallelism",
+		"log.level",
+		"check_order_provider.object_type",
+		"check_order_provider.check_name",
+		"check_order_provider.dead_letter_topic",
+		"check_order_provider.KAFKA.BROKERS",
+		"check_order_provider.KAFKA.CONSUMER_GROUP",
+		"check_order_provider.KAFKA.CONCURRENCY",
+		"check_result_publisher",
+		"statistics.port",
+		"statistic_sender.KAFKA",
+		"dead_letter_publisher",
+	} {
+		if !problems[expected] {
+			t.Errorf("expected problem for %v, got %v", expected, err)
+		}
+	}
+	if len(ve.Problems) != 12 {
+		t.Errorf("expected 12 problems, got %v", err)
+	}
+}
+
+func TestBoolFlagFromArgs(t *testing.T) {
+	for _, c := range []struct {
+		args     []string
+		value    bool
+		provided bool
+	}{
+		{[]string{"-dry-run"}, true, true},
+		{[]string{"-config", "x.yaml", "--dry-run=false"}, false, true},
+		{[]string{"-dry-run=1"}, true, true},
+		{[]string{"-dry-runs"}, false, false},
+		{nil, false, false},
+	} {
+		v, ok := boolFlagFromArgs(c.args, DryRunFlag)
+		if v != c.value || ok != c.provided {
+			t.Errorf("args %v: expected %v, %v, got %v, %v", c.args, c.value, c.provided, v, ok)
+		}
+	}
+}